@@ -0,0 +1,390 @@
+package shelly
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultTimeout is the default timeout for each request to device.
+const DefaultTimeout = 10 * time.Second
+
+// DefaultRetries is the default number of retries of failed requests.
+const DefaultRetries = 2
+
+// DefaultBackoff is the default delay before the first retry. The delay is
+// doubled for each subsequent retry.
+const DefaultBackoff = 500 * time.Millisecond
+
+// HTTPDoer sends HTTP requests, e.g. *http.Client.
+type HTTPDoer interface {
+	Do(req *http.Request) (*http.Response, error)
+}
+
+// Client holds the HTTP client and credentials used to communicate with the
+// device. If DryRun is set, calls modifying schedules are not sent to device.
+// Gen is the generation of the device, see Gen1; zero means Gen2 or later.
+// Switching relays of Gen1 devices uses their REST API, while other RPC calls
+// are not supported.
+// If Doer is set, it is used to send the requests instead of HTTPClient, e.g.
+// to replace the device in tests.
+//
+// Requests failing with network error or 5xx status code are retried Retries
+// times with exponential backoff starting from Backoff. Sleep is used to wait
+// between retries, and can be replaced e.g. in tests.
+type Client struct {
+	HTTPClient  *http.Client
+	Doer        HTTPDoer
+	Credentials Credentials
+	DryRun      bool
+	Retries     int
+	Backoff     time.Duration
+	Sleep       func(ctx context.Context, d time.Duration) error
+	Gen         int
+
+	// wsMu guards ws, which is replaced and read by concurrent calls, e.g.
+	// of the metrics handler, see webSocket.
+	wsMu sync.Mutex
+	ws   *wsConn
+}
+
+// NewClient returns a client with default timeout and retries, and no
+// credentials.
+func NewClient() *Client {
+	return &Client{
+		HTTPClient: &http.Client{Timeout: DefaultTimeout},
+		Retries:    DefaultRetries,
+		Backoff:    DefaultBackoff,
+		Sleep:      sleep,
+	}
+}
+
+// sleep waits for duration d or until the context is cancelled.
+func sleep(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// BuildBaseURI returns the RPC base URI of the device, e.g.
+// http://192.168.1.50/rpc/. Host is given as <host> or <host>:<port>. If host
+// already contains a scheme, e.g. https://shelly.example.com/, it takes
+// precedence over scheme. Addresses copied from the browser are accepted as
+// well: surrounding whitespace, trailing slashes, fragment of the web UI, e.g.
+// http://192.168.1.50/#/, and path /rpc/ are ignored. IPv6 addresses are
+// given as such, e.g. fe80::1 or fe80::1%eth0, or in brackets with a port,
+// e.g. [fe80::1]:8080.
+func BuildBaseURI(host string, scheme string) (string, error) {
+	original := host
+	host = strings.TrimSpace(host)
+	if strings.Contains(host, "://") {
+		strs := strings.SplitN(host, "://", 2)
+		scheme, host = strings.ToLower(strs[0]), strs[1]
+		if strings.Contains(host, "://") {
+			return "", errors.New("invalid host: " + original + ", scheme given twice")
+		}
+		if i := strings.Index(host, "#"); i >= 0 {
+			host = host[:i]
+		}
+		if i := strings.Index(host, "/rpc/"); i >= 0 {
+			host = host[:i]
+		}
+		host = strings.TrimSuffix(strings.TrimRight(host, "/"), "/rpc")
+	}
+	if scheme != "http" && scheme != "https" {
+		return "", errors.New("unsupported scheme: " + scheme + ", expected http or https")
+	}
+	host = strings.TrimRight(host, "/")
+	if host == "" {
+		return "", errors.New("invalid host: host is empty")
+	}
+	if strings.Contains(host, "/") {
+		return "", errors.New("invalid host: " + original + ", expected <host> or <host>:<port> without path")
+	}
+	if strings.ContainsAny(host, " ?#@") {
+		return "", errors.New("invalid host: " + host + ", expected <host> or <host>:<port>")
+	}
+	host, err := bracketIPv6(host)
+	if err != nil {
+		return "", err
+	}
+	u, err := url.Parse(scheme + "://" + host)
+	if err != nil || u.Host != strings.Replace(host, "%25", "%", 1) {
+		return "", errors.New("invalid host: " + host + ", expected <host> or <host>:<port>")
+	}
+	if strings.HasSuffix(host, ":") {
+		return "", errors.New("invalid host: " + host + ", port is empty")
+	}
+	if port := u.Port(); port != "" {
+		if n, err := strconv.Atoi(port); err != nil || n < 1 || n > 65535 {
+			return "", errors.New("invalid host: " + host + ", port out of range 1..65535")
+		}
+	}
+	return scheme + "://" + host + "/rpc/", nil
+}
+
+// bracketIPv6 returns IPv6 address in brackets as required in URIs, e.g.
+// [fe80::1], with the zone escaped as %25, e.g. [fe80::1%25eth0]. Addresses
+// already in brackets are checked, and other hosts are returned as such.
+func bracketIPv6(host string) (string, error) {
+	addr, port := host, ""
+	if strings.HasPrefix(host, "[") {
+		end := strings.Index(host, "]")
+		if end < 0 {
+			return "", errors.New("invalid host: " + host + ", missing ] of IPv6 address")
+		}
+		addr, port = host[1:end], host[end+1:]
+	} else if strings.Count(host, ":") < 2 {
+		return host, nil
+	}
+	ip, zone, hasZone := strings.Cut(strings.Replace(addr, "%25", "%", 1), "%")
+	if net.ParseIP(ip) == nil || !strings.Contains(ip, ":") {
+		return "", errors.New("invalid host: " + host + ", invalid IPv6 address")
+	}
+	if hasZone {
+		ip += "%25" + zone
+	}
+	return "[" + ip + "]" + port, nil
+}
+
+func newRequest(ctx context.Context, method string, uri string, payload []byte) (*http.Request, error) {
+	var body io.Reader
+	if payload != nil {
+		body = bytes.NewReader(payload)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, uri, body)
+	if err != nil {
+		return nil, err
+	}
+	if payload != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	return req, nil
+}
+
+// ConnectionError is returned when the request could not be sent to the
+// device or no response was received, e.g. because of a timeout.
+type ConnectionError struct {
+	Host string
+	Err  error
+}
+
+func (e *ConnectionError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *ConnectionError) Unwrap() error {
+	return e.Err
+}
+
+func doRequest(client *Client, req *http.Request) (*http.Response, error) {
+	var resp *http.Response
+	var err error
+	if client.Doer != nil {
+		resp, err = client.Doer.Do(req)
+	} else {
+		resp, err = client.HTTPClient.Do(req)
+	}
+	if err == nil {
+		return resp, nil
+	}
+	// A deadline of the context is reported as such, not as the timeout of
+	// the HTTP client.
+	if netErr, ok := err.(net.Error); ok && netErr.Timeout() && client.Doer == nil && req.Context().Err() == nil {
+		err = fmt.Errorf("request to %s timed out after %s", req.URL.Host, client.HTTPClient.Timeout)
+	}
+	return nil, &ConnectionError{req.URL.Host, err}
+}
+
+// doWithRetry sends request to the device, retrying on network errors and
+// 5xx status codes. Requests failing with 4xx status codes are not retried.
+func doWithRetry(ctx context.Context, client *Client, method string, uri string, payload []byte, authorization string) (*http.Response, error) {
+	backoff := client.Backoff
+	for retry := 0; ; retry++ {
+		req, err := newRequest(ctx, method, uri, payload)
+		if err != nil {
+			return nil, err
+		}
+		if authorization != "" {
+			req.Header.Set("Authorization", authorization)
+		}
+		resp, err := doRequest(client, req)
+		if err == nil && resp.StatusCode < 500 {
+			return resp, nil
+		}
+		if retry >= client.Retries || ctx.Err() != nil {
+			return resp, err
+		}
+		if err != nil {
+			warnf("Request to %s failed: %s, retrying in %s", uri, err, backoff)
+		} else {
+			resp.Body.Close()
+			warnf("Request to %s failed with status code %d, retrying in %s", uri, resp.StatusCode, backoff)
+		}
+		wait := client.Sleep
+		if wait == nil {
+			wait = sleep
+		}
+		if err := wait(ctx, backoff); err != nil {
+			return nil, err
+		}
+		backoff *= 2
+	}
+}
+
+// httpDo sends request to the device, see doWithRetry. If the device
+// responds with 401 Unauthorized, the request is retried once with digest
+// authentication, or basic authentication used by Gen1 devices.
+func httpDo(ctx context.Context, client *Client, method string, uri string, payload []byte) (*http.Response, error) {
+	resp, err := doWithRetry(ctx, client, method, uri, payload, "")
+	if err != nil || resp.StatusCode != http.StatusUnauthorized {
+		return resp, err
+	}
+	resp.Body.Close()
+	if client.Credentials.Password == "" {
+		return nil, errors.New("device requires authentication, but password is not set")
+	}
+	challenge := resp.Header.Get("WWW-Authenticate")
+	var authorization string
+	if strings.HasPrefix(strings.ToLower(challenge), "basic") {
+		authorization = "Basic " + base64.StdEncoding.EncodeToString(
+			[]byte(client.Credentials.User+":"+client.Credentials.Password))
+	} else {
+		// The request URI is taken from uri, as responses of custom Doers
+		// need not carry the request.
+		u, err := url.Parse(uri)
+		if err != nil {
+			return nil, err
+		}
+		authorization, err = digestAuthorization(challenge, method, u.RequestURI(), client.Credentials)
+		if err != nil {
+			return nil, err
+		}
+	}
+	resp, err = doWithRetry(ctx, client, method, uri, payload, authorization)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusUnauthorized {
+		resp.Body.Close()
+		return nil, errors.New("authentication failed, check user name and password")
+	}
+	return resp, nil
+}
+
+// RPCError is an error returned by the device, e.g.
+// {"error": {"code": -103, "message": "Invalid argument 'id'"}}
+type RPCError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *RPCError) Error() string {
+	return fmt.Sprintf("RPC error %d: %s", e.Code, e.Message)
+}
+
+// parseRPCError returns the error in response body, if any. The error is
+// either wrapped in "error" object, or for non-200 responses, the body itself.
+func parseRPCError(body []byte, statusCode int) *RPCError {
+	var wrapped struct {
+		Error *RPCError `json:"error"`
+	}
+	if json.Unmarshal(body, &wrapped) == nil && wrapped.Error != nil {
+		return wrapped.Error
+	}
+	var direct RPCError
+	if statusCode != http.StatusOK && json.Unmarshal(body, &direct) == nil && direct.Message != "" {
+		return &direct
+	}
+	return nil
+}
+
+// snippet returns the beginning of response body for error messages, e.g. of
+// an HTML error page.
+func snippet(body []byte) string {
+	const max = 80
+	s := strings.TrimSpace(string(body))
+	if len(s) > max {
+		return s[:max] + "..."
+	}
+	return s
+}
+
+// rpcCall calls RPC method with params, which are sent as JSON body unless
+// nil, and decodes the response into result unless nil. Error responses of
+// the device are returned as *RPCError. If WebSocket connection is open, see
+// DialWebSocket, the call is sent over it, falling back to HTTP if the
+// connection fails.
+func rpcCall(ctx context.Context, client *Client, uri string, method string, params interface{}, result interface{}) error {
+	if client.Gen == Gen1 {
+		return fmt.Errorf("%s: not supported by Gen1 device", method)
+	}
+	if ws := client.webSocket(); ws != nil {
+		raw, err := wsCall(ctx, client, ws, method, params)
+		var connErr *ConnectionError
+		if errors.As(err, &connErr) {
+			warnf("WebSocket connection failed: %s, falling back to HTTP", err)
+		} else if err != nil {
+			return err
+		} else {
+			if result == nil || len(raw) == 0 {
+				return nil
+			}
+			if err := json.Unmarshal(raw, result); err != nil {
+				return fmt.Errorf("%s: unexpected response: %s", method, string(raw))
+			}
+			return nil
+		}
+	}
+	var payload []byte
+	httpMethod := "GET"
+	if params != nil {
+		var err error
+		payload, err = json.Marshal(params)
+		if err != nil {
+			return err
+		}
+		httpMethod = "POST"
+	}
+	resp, err := httpDo(ctx, client, httpMethod, uri+method, payload)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	bodyBytes, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	debugf("Response from %s (status code %d): %s", method, resp.StatusCode, bodyBytes)
+	if rpcErr := parseRPCError(bodyBytes, resp.StatusCode); rpcErr != nil {
+		return fmt.Errorf("%s: %w", method, rpcErr)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s: status code %d != 200", method, resp.StatusCode)
+	}
+	if result == nil {
+		return nil
+	}
+	err = json.Unmarshal(bodyBytes, result)
+	if err != nil {
+		return fmt.Errorf("%s: unexpected response: %s", method, snippet(bodyBytes))
+	}
+	return nil
+}
@@ -0,0 +1,525 @@
+package shelly
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testDevice is a fake device serving RPC calls with respond, and recording
+// the names of the called methods.
+type testDevice struct {
+	mu      sync.Mutex
+	methods []string
+}
+
+// called returns the names of the methods called so far.
+func (d *testDevice) called() []string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return append([]string{}, d.methods...)
+}
+
+// newTestDevice starts a fake device serving RPC calls with respond, which
+// gets the method name and the request body. Returns a client for the
+// device, without retry delays, and the base URI of the device.
+func newTestDevice(t *testing.T, respond func(w http.ResponseWriter, r *http.Request, method string, body []byte)) (*testDevice, *Client, string) {
+	t.Helper()
+	device := &testDevice{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		method := strings.TrimPrefix(r.URL.Path, "/rpc/")
+		body, _ := io.ReadAll(r.Body)
+		device.mu.Lock()
+		device.methods = append(device.methods, method)
+		device.mu.Unlock()
+		respond(w, r, method, body)
+	}))
+	t.Cleanup(server.Close)
+	client := NewClient()
+	client.Sleep = func(ctx context.Context, d time.Duration) error { return ctx.Err() }
+	return device, client, server.URL + "/rpc/"
+}
+
+func TestCancelledContextSendsNothing(t *testing.T) {
+	device, client, uri := newTestDevice(t, func(w http.ResponseWriter, r *http.Request, method string, body []byte) {
+		io.WriteString(w, `{"id": 1, "rev": 1}`)
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	schedules := []Schedule{
+		{true, "0 0 17 * * *", []Call{{DefaultMethod, switchParams(0, true, nil)}}},
+		{true, "0 0 18 * * *", []Call{{DefaultMethod, switchParams(0, false, nil)}}},
+	}
+	opts := DefaultScheduleOptions()
+	ids, err := createSchedules(ctx, client, uri, schedules, opts, newRateLimiter(client, opts.Rate))
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("createSchedules with cancelled context: got error %v, want %v", err, context.Canceled)
+	}
+	if len(ids) != 0 {
+		t.Errorf("createSchedules with cancelled context created schedules %v", ids)
+	}
+	if err := ScheduleDeleteAll(ctx, client, uri); !errors.Is(err, context.Canceled) {
+		t.Errorf("ScheduleDeleteAll with cancelled context: got error %v, want %v", err, context.Canceled)
+	}
+	if methods := device.called(); len(methods) != 0 {
+		t.Errorf("requests sent with cancelled context: %v", methods)
+	}
+}
+
+func TestCancelAbortsPendingRequest(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+	_, client, uri := newTestDevice(t, func(w http.ResponseWriter, r *http.Request, method string, body []byte) {
+		select {
+		case <-r.Context().Done():
+		case <-release:
+		}
+	})
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, err := CheckConnection(ctx, client, uri)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("CheckConnection: got error %v, want %v", err, context.DeadlineExceeded)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("CheckConnection returned after %s, want promptly after cancel", elapsed)
+	}
+}
+
+func TestRPCErrorResponse(t *testing.T) {
+	_, client, uri := newTestDevice(t, func(w http.ResponseWriter, r *http.Request, method string, body []byte) {
+		io.WriteString(w, `{"id": 1, "src": "shellypro4pm", "error": {"code": -103, "message": "Invalid argument 'id': no such component"}}`)
+	})
+	err := SwitchSet(context.Background(), client, uri, 7, true)
+	var rpcErr *RPCError
+	if !errors.As(err, &rpcErr) {
+		t.Fatalf("SwitchSet: got error %v, want *RPCError", err)
+	}
+	if rpcErr.Code != -103 || rpcErr.Message != "Invalid argument 'id': no such component" {
+		t.Errorf("got RPC error %d %q", rpcErr.Code, rpcErr.Message)
+	}
+	if !strings.HasPrefix(err.Error(), "Switch.Set: RPC error -103: ") {
+		t.Errorf("got error message %q", err)
+	}
+}
+
+func TestParseRPCError(t *testing.T) {
+	tests := []struct {
+		body       string
+		statusCode int
+		code       int
+	}{
+		{`{"error": {"code": -103, "message": "Invalid argument"}}`, http.StatusOK, -103},
+		{`{"code": 401, "message": "Unauthorized"}`, http.StatusUnauthorized, 401},
+		// Results which happen to have a message are not errors.
+		{`{"code": 1, "message": "ok"}`, http.StatusOK, 0},
+		{`{"was_on": true}`, http.StatusOK, 0},
+		{`<html>Not found</html>`, http.StatusNotFound, 0},
+	}
+	for _, tt := range tests {
+		rpcErr := parseRPCError([]byte(tt.body), tt.statusCode)
+		code := 0
+		if rpcErr != nil {
+			code = rpcErr.Code
+		}
+		if code != tt.code {
+			t.Errorf("parseRPCError(%s, %d): got code %d, want %d", tt.body, tt.statusCode, code, tt.code)
+		}
+	}
+}
+
+// doerFunc is an HTTPDoer sending requests with the function.
+type doerFunc func(req *http.Request) (*http.Response, error)
+
+func (f doerFunc) Do(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+// response returns a response with status code and body to req.
+func response(req *http.Request, statusCode int, body string) *http.Response {
+	return &http.Response{
+		StatusCode: statusCode,
+		Header:     http.Header{},
+		Body:       io.NopCloser(strings.NewReader(body)),
+		Request:    req,
+	}
+}
+
+func TestRetry(t *testing.T) {
+	errReset := errors.New("connection reset by peer")
+	tests := []struct {
+		name      string
+		responses []int // status codes, 0 for network error
+		requests  int
+		fails     bool
+	}{
+		{"success", []int{200}, 1, false},
+		{"server error then success", []int{503, 200}, 2, false},
+		{"network error then success", []int{0, 0, 200}, 3, false},
+		{"server error after retries", []int{500, 502, 503}, 3, true},
+		{"network error after retries", []int{0, 0, 0}, 3, true},
+		{"client error", []int{400, 200}, 1, true},
+		{"not found", []int{404, 200}, 1, true},
+	}
+	for _, tt := range tests {
+		requests := 0
+		client := NewClient()
+		client.Backoff = time.Second
+		client.Doer = doerFunc(func(req *http.Request) (*http.Response, error) {
+			statusCode := tt.responses[requests]
+			requests++
+			if statusCode == 0 {
+				return nil, errReset
+			}
+			return response(req, statusCode, `{"was_on": false}`), nil
+		})
+		var sleeps []time.Duration
+		client.Sleep = func(ctx context.Context, d time.Duration) error {
+			sleeps = append(sleeps, d)
+			return nil
+		}
+		err := SwitchSet(context.Background(), client, "http://device/rpc/", 0, true)
+		if (err != nil) != tt.fails {
+			t.Errorf("%s: got error %v, want failure %v", tt.name, err, tt.fails)
+		}
+		if requests != tt.requests {
+			t.Errorf("%s: sent %d requests, want %d", tt.name, requests, tt.requests)
+		}
+		// The backoff doubles for each retry.
+		for i, d := range sleeps {
+			if want := time.Second << i; d != want {
+				t.Errorf("%s: retry %d after %s, want %s", tt.name, i+1, d, want)
+			}
+		}
+		if len(sleeps) != requests-1 {
+			t.Errorf("%s: slept %d times for %d requests", tt.name, len(sleeps), requests)
+		}
+	}
+}
+
+func TestRetryStopsOnCancel(t *testing.T) {
+	requests := 0
+	client := NewClient()
+	client.Doer = doerFunc(func(req *http.Request) (*http.Response, error) {
+		requests++
+		return response(req, 503, ""), nil
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	client.Sleep = func(context.Context, time.Duration) error {
+		cancel()
+		return context.Canceled
+	}
+	err := SwitchSet(ctx, client, "http://device/rpc/", 0, true)
+	if !errors.Is(err, context.Canceled) || requests != 1 {
+		t.Errorf("got error %v after %d requests, want %v after 1 request", err, requests, context.Canceled)
+	}
+}
+
+func TestBuildBaseURI(t *testing.T) {
+	tests := []struct {
+		host, scheme string
+		want         string
+	}{
+		{"1.2.3.4", "http", "http://1.2.3.4/rpc/"},
+		{"1.2.3.4", "https", "https://1.2.3.4/rpc/"},
+		{"host:8080", "http", "http://host:8080/rpc/"},
+		{"shelly.local", "http", "http://shelly.local/rpc/"},
+		{"http://x/", "https", "http://x/rpc/"},
+		{"https://x", "http", "https://x/rpc/"},
+		{"https://x:8443/", "http", "https://x:8443/rpc/"},
+		{"::1", "http", "http://[::1]/rpc/"},
+		{"[::1]:8080", "http", "http://[::1]:8080/rpc/"},
+	}
+	for _, tt := range tests {
+		got, err := BuildBaseURI(tt.host, tt.scheme)
+		if err != nil {
+			t.Errorf("BuildBaseURI(%q, %q): %s", tt.host, tt.scheme, err)
+		} else if got != tt.want {
+			t.Errorf("BuildBaseURI(%q, %q) = %q, want %q", tt.host, tt.scheme, got, tt.want)
+		}
+	}
+}
+
+func TestBuildBaseURIInvalid(t *testing.T) {
+	tests := []struct {
+		host, scheme string
+	}{
+		{"", "http"},
+		{"host:", "http"},
+		{"[::1]:", "http"},
+		{"host:port", "http"},
+		{"host:0", "http"},
+		{"host:65536", "http"},
+		{"1.2.3.4", "ftp"},
+		{"ftp://1.2.3.4", "http"},
+		{"user@host", "http"},
+		{"host name", "http"},
+	}
+	for _, tt := range tests {
+		if got, err := BuildBaseURI(tt.host, tt.scheme); err == nil {
+			t.Errorf("BuildBaseURI(%q, %q) = %q, want error", tt.host, tt.scheme, got)
+		}
+	}
+}
+
+func TestBuildBaseURIFromBrowser(t *testing.T) {
+	tests := []struct {
+		host string
+		want string
+	}{
+		{"http://1.2.3.4/", "http://1.2.3.4/rpc/"},
+		{" http://1.2.3.4/ \n", "http://1.2.3.4/rpc/"},
+		{"HTTP://1.2.3.4/#/", "http://1.2.3.4/rpc/"},
+		{"http://1.2.3.4/#/settings/device", "http://1.2.3.4/rpc/"},
+		{"http://1.2.3.4/rpc", "http://1.2.3.4/rpc/"},
+		{"http://1.2.3.4/rpc/", "http://1.2.3.4/rpc/"},
+		{"http://1.2.3.4/rpc/Shelly.GetStatus", "http://1.2.3.4/rpc/"},
+		{"https://shelly.local:8443//", "https://shelly.local:8443/rpc/"},
+		{"http://[fe80::1]:8080/#/", "http://[fe80::1]:8080/rpc/"},
+	}
+	for _, tt := range tests {
+		got, err := BuildBaseURI(tt.host, "http")
+		if err != nil {
+			t.Errorf("BuildBaseURI(%q): %s", tt.host, err)
+		} else if got != tt.want {
+			t.Errorf("BuildBaseURI(%q) = %q, want %q", tt.host, got, tt.want)
+		}
+	}
+}
+
+func TestBuildBaseURIFromBrowserInvalid(t *testing.T) {
+	tests := []struct {
+		host string
+		err  string
+	}{
+		{"http://http://1.2.3.4/", "scheme given twice"},
+		{"http://1.2.3.4/settings", "without path"},
+		{"1.2.3.4/rpc/", "without path"},
+		{"http:///", "host is empty"},
+		{"http://#/", "host is empty"},
+	}
+	for _, tt := range tests {
+		got, err := BuildBaseURI(tt.host, "http")
+		if err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("BuildBaseURI(%q) = %q, %v, want error containing %q", tt.host, got, err, tt.err)
+		}
+	}
+}
+
+func TestBuildBaseURIIPv6(t *testing.T) {
+	tests := []struct {
+		host string
+		want string
+	}{
+		{"::1", "http://[::1]/rpc/"},
+		{"fe80::1", "http://[fe80::1]/rpc/"},
+		{"fe80::1%eth0", "http://[fe80::1%25eth0]/rpc/"},
+		{"fe80::1%25eth0", "http://[fe80::1%25eth0]/rpc/"},
+		{"2001:db8::1:2", "http://[2001:db8::1:2]/rpc/"},
+		{"[::1]", "http://[::1]/rpc/"},
+		{"[::1]:8080", "http://[::1]:8080/rpc/"},
+		{"[fe80::1%eth0]:8080", "http://[fe80::1%25eth0]:8080/rpc/"},
+		{"http://[::1]:8080/", "http://[::1]:8080/rpc/"},
+	}
+	for _, tt := range tests {
+		got, err := BuildBaseURI(tt.host, "http")
+		if err != nil {
+			t.Errorf("BuildBaseURI(%q): %s", tt.host, err)
+		} else if got != tt.want {
+			t.Errorf("BuildBaseURI(%q) = %q, want %q", tt.host, got, tt.want)
+		}
+	}
+}
+
+func TestBuildBaseURIIPv6Invalid(t *testing.T) {
+	tests := []string{
+		"[::1",
+		"[::1]:",
+		"[::1]8080",
+		"[::1]:http",
+		"[1.2.3.4]",
+		"[shelly.local]",
+		"::g",
+		"fe80::1::2",
+		"1:2:3",
+	}
+	for _, host := range tests {
+		if got, err := BuildBaseURI(host, "http"); err == nil {
+			t.Errorf("BuildBaseURI(%q) = %q, want error", host, got)
+		}
+	}
+}
+
+func TestScheduleDeleteAll(t *testing.T) {
+	const jobs = `{"jobs": [{"id": 1, "enable": true, "timespec": "0 0 17 * * *", "calls": [{"method": "Switch.Set"}]},
+		{"id": 2, "enable": true, "timespec": "0 0 18 * * *", "calls": [{"method": "Switch.Set"}]}], "rev": 5}`
+	tests := []struct {
+		name    string
+		list    string
+		dryRun  bool
+		methods []string
+	}{
+		// Schedule.DeleteAll is not called if there is nothing to delete.
+		{"empty", `{"jobs": [], "rev": 5}`, false, []string{"Schedule.List"}},
+		{"no jobs field", `{"rev": 5}`, false, []string{"Schedule.List"}},
+		{"two schedules", jobs, false, []string{"Schedule.List", "Schedule.DeleteAll"}},
+		{"dry run", jobs, true, []string{"Schedule.List"}},
+	}
+	for _, tt := range tests {
+		device, client, uri := newTestDevice(t, func(w http.ResponseWriter, r *http.Request, method string, body []byte) {
+			switch method {
+			case "Schedule.List":
+				io.WriteString(w, tt.list)
+			case "Schedule.DeleteAll":
+				io.WriteString(w, `null`)
+			default:
+				w.WriteHeader(http.StatusNotFound)
+			}
+		})
+		client.DryRun = tt.dryRun
+		if err := ScheduleDeleteAll(context.Background(), client, uri); err != nil {
+			t.Errorf("%s: %s", tt.name, err)
+		}
+		if methods := device.called(); !reflect.DeepEqual(methods, tt.methods) {
+			t.Errorf("%s: called %v, want %v", tt.name, methods, tt.methods)
+		}
+	}
+}
+
+func TestScheduleDeleteAllError(t *testing.T) {
+	device, client, uri := newTestDevice(t, func(w http.ResponseWriter, r *http.Request, method string, body []byte) {
+		if method == "Schedule.List" {
+			io.WriteString(w, `{"jobs": [{"id": 1, "enable": true, "timespec": "0 0 17 * * *"}], "rev": 5}`)
+			return
+		}
+		w.WriteHeader(http.StatusInternalServerError)
+		io.WriteString(w, `{"code": -114, "message": "Deleting schedules failed"}`)
+	})
+	client.Retries = 0
+	err := ScheduleDeleteAll(context.Background(), client, uri)
+	var rpcErr *RPCError
+	if !errors.As(err, &rpcErr) || rpcErr.Code != -114 {
+		t.Errorf("ScheduleDeleteAll: got error %v, want RPC error -114", err)
+	}
+	if methods := device.called(); !reflect.DeepEqual(methods, []string{"Schedule.List", "Schedule.DeleteAll"}) {
+		t.Errorf("called %v", methods)
+	}
+}
+
+func TestRPCCall(t *testing.T) {
+	tests := []struct {
+		name       string
+		statusCode int
+		body       string
+		params     interface{}
+		httpMethod string
+		err        string
+	}{
+		{"success with params", 200, `{"id": 0, "output": true}`, map[string]int{"id": 0}, "POST", ""},
+		{"success without params", 200, `{"id": 0, "output": true}`, nil, "GET", ""},
+		{"RPC error", 200, `{"error": {"code": -105, "message": "Argument 'id', value 9 not found!"}}`, nil, "GET",
+			"Switch.GetStatus: RPC error -105: Argument 'id', value 9 not found!"},
+		{"RPC error with status code", 500, `{"code": -114, "message": "Method Switch.GetStatus failed"}`, nil, "GET",
+			"Switch.GetStatus: RPC error -114: Method Switch.GetStatus failed"},
+		{"status code", 404, `<html><body>Not Found</body></html>`, nil, "GET",
+			"Switch.GetStatus: status code 404 != 200"},
+		{"unexpected response", 200, `<html><body>Shelly</body></html>`, nil, "GET",
+			"Switch.GetStatus: unexpected response: <html><body>Shelly</body></html>"},
+	}
+	for _, tt := range tests {
+		var httpMethod string
+		var payload []byte
+		_, client, uri := newTestDevice(t, func(w http.ResponseWriter, r *http.Request, method string, body []byte) {
+			httpMethod, payload = r.Method, body
+			w.WriteHeader(tt.statusCode)
+			io.WriteString(w, tt.body)
+		})
+		client.Retries = 0
+		var result SwitchStatus
+		err := rpcCall(context.Background(), client, uri, "Switch.GetStatus", tt.params, &result)
+		if tt.err == "" && err != nil {
+			t.Errorf("%s: %s", tt.name, err)
+		} else if tt.err != "" && (err == nil || err.Error() != tt.err) {
+			t.Errorf("%s: got error %v, want %s", tt.name, err, tt.err)
+		}
+		if httpMethod != tt.httpMethod {
+			t.Errorf("%s: sent %s request, want %s", tt.name, httpMethod, tt.httpMethod)
+		}
+		if tt.params != nil && string(payload) != `{"id":0}` {
+			t.Errorf("%s: sent payload %s", tt.name, payload)
+		}
+		if tt.err == "" && !result.Output {
+			t.Errorf("%s: got result %+v", tt.name, result)
+		}
+	}
+}
+
+// checkDigest returns true if the Authorization header answers the digest
+// challenge with realm and nonce for the request.
+func checkDigest(r *http.Request, realm string, nonce string, creds Credentials) bool {
+	params, err := parseDigestChallenge(r.Header.Get("Authorization"))
+	if err != nil || params["realm"] != realm || params["nonce"] != nonce || params["uri"] != r.URL.RequestURI() {
+		return false
+	}
+	ha1, _ := digestHash("SHA-256", creds.User+":"+realm+":"+creds.Password)
+	ha2, _ := digestHash("SHA-256", r.Method+":"+params["uri"])
+	want, _ := digestHash("SHA-256", ha1+":"+nonce+":"+params["nc"]+":"+params["cnonce"]+":auth:"+ha2)
+	return params["username"] == creds.User && params["response"] == want
+}
+
+func TestRPCCallDigest(t *testing.T) {
+	creds := Credentials{"admin", "secret"}
+	const realm, nonce = "shellypro4pm-a8032ab12345", "6523ef1c"
+	for _, password := range []string{"secret", "wrong"} {
+		device, client, uri := newTestDevice(t, func(w http.ResponseWriter, r *http.Request, method string, body []byte) {
+			if !checkDigest(r, realm, nonce, creds) {
+				w.Header().Set("WWW-Authenticate", `Digest qop="auth", realm="`+realm+`", nonce="`+nonce+`", algorithm=SHA-256`)
+				w.WriteHeader(http.StatusUnauthorized)
+				io.WriteString(w, `{"code": 401, "message": "unauthorized"}`)
+				return
+			}
+			io.WriteString(w, `{"was_on": false}`)
+		})
+		client.Credentials = Credentials{"admin", password}
+		err := SwitchSet(context.Background(), client, uri, 0, true)
+		if password == creds.Password && err != nil {
+			t.Errorf("SwitchSet with digest authentication: %s", err)
+		}
+		if password != creds.Password && (err == nil || !strings.Contains(err.Error(), "authentication failed")) {
+			t.Errorf("SwitchSet with wrong password: got error %v", err)
+		}
+		if methods := device.called(); len(methods) != 2 {
+			t.Errorf("got requests %v, want request retried once with authentication", methods)
+		}
+	}
+}
+
+func TestDigestWithoutResponseRequest(t *testing.T) {
+	// Responses of a custom Doer without the request, e.g. in tests.
+	var authorization string
+	client := NewClient()
+	client.Credentials = Credentials{"admin", "secret"}
+	client.Doer = doerFunc(func(req *http.Request) (*http.Response, error) {
+		authorization = req.Header.Get("Authorization")
+		resp := response(nil, http.StatusOK, `{"was_on": false}`)
+		if authorization == "" {
+			resp.StatusCode = http.StatusUnauthorized
+			resp.Header.Set("WWW-Authenticate", `Digest qop="auth", realm="shelly", nonce="1", algorithm=SHA-256`)
+		}
+		return resp, nil
+	})
+	if err := SwitchSet(context.Background(), client, "http://device/rpc/", 0, true); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(authorization, `uri="/rpc/Switch.Set"`) {
+		t.Errorf("got Authorization %s, want uri /rpc/Switch.Set", authorization)
+	}
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/ahojukka5/shelly"
+)
+
+func usage_auto_off() {
+	fmt.Printf("Usage: %s auto-off [options] <relays> <duration>\n", appName)
+	fmt.Printf("       %s auto-off [options] --all <duration>\n\n", appName)
+	fmt.Println("  relays      Relay id or name, or list of them")
+	fmt.Println("  duration    Turn relays off this long after turned on, e.g. 30s or 2h,")
+	fmt.Println("              or 0 or off to disable the auto-off timer")
+	usage_device_options()
+	fmt.Println("  --all       Set the timer of all relays of the device instead of giving <relays>")
+	fmt.Print("\nExamples:\n\n")
+	fmt.Printf("  %s auto-off 0 30m\n", appName)
+	fmt.Printf("  %s auto-off 0,1 off\n", appName)
+	fmt.Printf("  %s auto-off --all 2h\n", appName)
+	fmt.Print("\nThe timer is kept by the device, turning the relay off after the duration\n")
+	fmt.Print("whenever the relay is turned on, also from the app or the button.\n")
+}
+
+// parseAutoOff parses the duration of auto-off command, with 0 and off
+// disabling the timer.
+func parseAutoOff(s string) (time.Duration, error) {
+	if s == "off" {
+		return 0, nil
+	}
+	d, err := time.ParseDuration(s)
+	if s == "0" {
+		d, err = 0, nil
+	}
+	if err != nil || d < 0 {
+		return 0, errors.New("invalid duration: " + s + ", expected e.g. 30s, 2h or off")
+	}
+	return d, nil
+}
+
+type autoOffFlags struct {
+	fs     *flag.FlagSet
+	device *deviceFlags
+	all    *bool
+}
+
+func newAutoOffFlags() *autoOffFlags {
+	fs := flag.NewFlagSet("auto-off", flag.ExitOnError)
+	fs.Usage = usage_auto_off
+	return &autoOffFlags{
+		fs:     fs,
+		device: addDeviceFlags(fs),
+		all:    fs.Bool("all", false, "set the timer of all relays of the device"),
+	}
+}
+
+func auto_off(ctx context.Context) int {
+	f := newAutoOffFlags()
+	device, all := f.device, f.all
+	args := parseArgs(f.fs, os.Args[2:])
+	if len(args) == 0 {
+		usage_auto_off()
+		os.Exit(exitUsage)
+	}
+	delay, err := parseAutoOff(args[len(args)-1])
+	if err != nil {
+		fatal(usageError{err})
+	}
+	args = args[:len(args)-1]
+	checkRelayArgs(args, *all, f.fs.Usage)
+	client, uri, err := device.connect(ctx)
+	if err != nil {
+		fatal(err)
+	}
+	relay_ids, err := resolveRelayArgs(ctx, client, uri, args, *all)
+	if err != nil {
+		fatal(err)
+	}
+	result := []AutoOffResult{}
+	for _, rid := range relay_ids {
+		config, err := shelly.SwitchSetAutoOff(ctx, client, uri, rid, delay)
+		if err != nil {
+			fatal(err)
+		}
+		result = append(result, AutoOffResult{rid, config.AutoOff, config.AutoOffDelay})
+		if jsonOutput {
+			continue
+		}
+		if config.AutoOff {
+			applied := time.Duration(config.AutoOffDelay * float64(time.Second))
+			fmt.Printf("relay %d: auto-off after %s\n", rid, applied)
+		} else {
+			fmt.Printf("relay %d: auto-off disabled\n", rid)
+		}
+	}
+	if jsonOutput {
+		printJSON(result)
+	}
+	return exitOK
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+)
+
+func usage_batch() {
+	fmt.Printf("Usage: %s batch [options] < <file>\n\n", appName)
+	fmt.Println("  options     Options of onoff applied to every line, see onoff")
+	fmt.Print("\nExamples:\n\n")
+	fmt.Printf("  %s batch < schedules.txt\n", appName)
+	fmt.Printf("  printf '0 today 8..9\\n1 tomorrow 17..18\\n' | %s batch --repeat weekdays\n", appName)
+	fmt.Print("\nEach line of stdin holds the arguments of onoff, e.g. 0 today 17..18, split at\n")
+	fmt.Print("whitespace without quoting. Blank lines and lines starting with # are skipped.\n")
+	fmt.Print("The lines are run in sequence, and the result of each line is reported.\n")
+	fmt.Print("Schedules created by onoff earlier are deleted by the first line as usual,\n")
+	fmt.Print("while the following lines keep the schedules, as with --keep, so that the\n")
+	fmt.Print("lines do not delete the schedules of each other.\n")
+}
+
+// inBatch is set while batch command runs the lines, so that errors in the
+// arguments of a line are returned instead of exiting.
+var inBatch bool
+
+// withoutFlags returns args without the given boolean flags, e.g. --keep or
+// -keep=true.
+func withoutFlags(args []string, names ...string) []string {
+	result := []string{}
+	for _, arg := range args {
+		name, _, _ := strings.Cut(strings.TrimLeft(arg, "-"), "=")
+		if strings.HasPrefix(arg, "-") && containsString(names, name) {
+			continue
+		}
+		result = append(result, arg)
+	}
+	return result
+}
+
+func containsString(list []string, s string) bool {
+	for _, t := range list {
+		if t == s {
+			return true
+		}
+	}
+	return false
+}
+
+func batch(ctx context.Context) int {
+	// The options are passed to onoff as such, so they are not parsed here.
+	options := os.Args[2:]
+	for _, option := range options {
+		if option == "-h" || option == "--help" || option == "-help" {
+			usage_batch()
+			return exitOK
+		}
+	}
+	inBatch = true
+	defer func() { inBatch = false }()
+	results := []BatchResult{}
+	var lastErr error
+	first := true
+	scanner := bufio.NewScanner(os.Stdin)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		args := options
+		if !first {
+			args = append(withoutFlags(options, "keep", "no-delete", "clear", "delete-all", "update"), "--keep")
+		}
+		first = false
+		slog.Info("Running line", "line", n, "args", line)
+		onoffResults, err := runOnOff(ctx, append(args, strings.Fields(line)...))
+		for _, result := range onoffResults {
+			if result.err != nil {
+				err = result.err
+			}
+		}
+		result := BatchResult{Line: n, Args: line, OK: err == nil, Results: onoffResults}
+		if err != nil {
+			lastErr = err
+			result.Error = err.Error()
+			slog.Error("Line failed", "line", n, "err", err)
+			if !jsonOutput {
+				fmt.Printf("line %d: failed: %s\n", n, err)
+			}
+		} else if !jsonOutput {
+			ids := []int{}
+			for _, r := range onoffResults {
+				ids = append(ids, r.IDs...)
+			}
+			fmt.Printf("line %d: ok, schedules %v\n", n, ids)
+		}
+		results = append(results, result)
+	}
+	if err := scanner.Err(); err != nil {
+		fatal(fmt.Errorf("reading stdin failed: %w", err))
+	}
+	if jsonOutput {
+		printJSON(results)
+	}
+	return exitCode(lastErr)
+}
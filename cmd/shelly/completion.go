@@ -0,0 +1,169 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+)
+
+func usage_completion() {
+	fmt.Printf("Usage: %s completion <shell>\n\n", appName)
+	fmt.Println("  shell       bash, zsh or fish")
+	fmt.Print("\nExamples:\n\n")
+	fmt.Printf("  source <(%s completion bash)\n", appName)
+	fmt.Printf("  %s completion zsh > \"${fpath[1]}/_%s\"\n", appName, appName)
+	fmt.Printf("  %s completion fish > ~/.config/fish/completions/%s.fish\n", appName, appName)
+	fmt.Print("\nThe script completes the commands and their options.\n")
+}
+
+// commandFlags returns the flags of the command. The flag set is the same
+// that the command parses, so the flags are always those actually accepted
+// by the command, and the command is not run.
+func commandFlags(c command) []*flag.Flag {
+	flags := []*flag.Flag{}
+	c.flags().VisitAll(func(f *flag.Flag) { flags = append(flags, f) })
+	return flags
+}
+
+// globalFlags returns the flags accepted before the command.
+func globalFlags() []*flag.Flag {
+	fs := flag.NewFlagSet(appName, flag.ContinueOnError)
+	addDeviceFlags(fs)
+	fs.Bool("version", false, "print version and exit")
+	flags := []*flag.Flag{}
+	fs.VisitAll(func(f *flag.Flag) { flags = append(flags, f) })
+	return flags
+}
+
+// shellQuote quotes the string in single quotes for shell scripts.
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// flagNames returns the flags as space separated list of --<name>.
+func flagNames(flags []*flag.Flag) string {
+	names := []string{}
+	for _, f := range flags {
+		names = append(names, "--"+f.Name)
+	}
+	return strings.Join(names, " ")
+}
+
+func bashCompletion() string {
+	var b strings.Builder
+	names := []string{}
+	for _, c := range commands {
+		names = append(names, c.name)
+	}
+	fmt.Fprintf(&b, "# bash completion for %s\n\n", appName)
+	fmt.Fprintf(&b, "_%s() {\n", appName)
+	b.WriteString("\tlocal cur=\"${COMP_WORDS[COMP_CWORD]}\" cmd=\"\" word flags\n")
+	fmt.Fprintf(&b, "\tlocal commands=%s\n", shellQuote(strings.Join(names, " ")))
+	b.WriteString("\tfor word in \"${COMP_WORDS[@]:1:COMP_CWORD-1}\"; do\n")
+	b.WriteString("\t\tcase \" $commands \" in *\" $word \"*) cmd=\"$word\"; break ;; esac\n")
+	b.WriteString("\tdone\n")
+	b.WriteString("\tcase \"$cmd\" in\n")
+	for _, c := range commands {
+		fmt.Fprintf(&b, "\t%s) flags=%s ;;\n", c.name, shellQuote(flagNames(commandFlags(c))))
+	}
+	fmt.Fprintf(&b, "\t*) flags=%s ;;\n", shellQuote(flagNames(globalFlags())))
+	b.WriteString("\tesac\n")
+	b.WriteString("\tif [[ \"$cur\" == -* ]]; then\n")
+	b.WriteString("\t\tCOMPREPLY=($(compgen -W \"$flags\" -- \"$cur\"))\n")
+	b.WriteString("\telif [[ -z \"$cmd\" ]]; then\n")
+	b.WriteString("\t\tCOMPREPLY=($(compgen -W \"$commands\" -- \"$cur\"))\n")
+	b.WriteString("\tfi\n")
+	b.WriteString("}\n\n")
+	fmt.Fprintf(&b, "complete -o default -F _%s %s\n", appName, appName)
+	return b.String()
+}
+
+// zshDescriptions returns the flags as zsh array elements --<name>:<usage>.
+func zshDescriptions(flags []*flag.Flag) string {
+	items := []string{}
+	for _, f := range flags {
+		items = append(items, shellQuote("--"+f.Name+":"+f.Usage))
+	}
+	return strings.Join(items, " ")
+}
+
+func zshCompletion() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "#compdef %s\n\n", appName)
+	fmt.Fprintf(&b, "_%s() {\n", appName)
+	b.WriteString("\tlocal -a commands flags\n")
+	b.WriteString("\tlocal cmd word\n")
+	b.WriteString("\tcommands=(\n")
+	for _, c := range commands {
+		fmt.Fprintf(&b, "\t\t%s\n", shellQuote(c.name+":"+c.summary))
+	}
+	b.WriteString("\t)\n")
+	b.WriteString("\tfor word in ${words[2,CURRENT-1]}; do\n")
+	b.WriteString("\t\tif (( ${commands[(I)$word:*]} )); then\n")
+	b.WriteString("\t\t\tcmd=$word\n")
+	b.WriteString("\t\t\tbreak\n")
+	b.WriteString("\t\tfi\n")
+	b.WriteString("\tdone\n")
+	b.WriteString("\tcase $cmd in\n")
+	for _, c := range commands {
+		fmt.Fprintf(&b, "\t%s) flags=(%s) ;;\n", c.name, zshDescriptions(commandFlags(c)))
+	}
+	fmt.Fprintf(&b, "\t*) flags=(%s) ;;\n", zshDescriptions(globalFlags()))
+	b.WriteString("\tesac\n")
+	b.WriteString("\tif [[ $PREFIX == -* ]]; then\n")
+	b.WriteString("\t\t_describe 'option' flags\n")
+	b.WriteString("\telif [[ -z $cmd ]]; then\n")
+	b.WriteString("\t\t_describe 'command' commands\n")
+	b.WriteString("\telse\n")
+	b.WriteString("\t\t_files\n")
+	b.WriteString("\tfi\n")
+	b.WriteString("}\n\n")
+	fmt.Fprintf(&b, "compdef _%s %s\n", appName, appName)
+	return b.String()
+}
+
+func fishCompletion() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "# fish completion for %s\n\n", appName)
+	fmt.Fprintf(&b, "complete -c %s -f\n", appName)
+	for _, c := range commands {
+		fmt.Fprintf(&b, "complete -c %s -n __fish_use_subcommand -a %s -d %s\n", appName, c.name, shellQuote(c.summary))
+	}
+	for _, f := range globalFlags() {
+		fmt.Fprintf(&b, "complete -c %s -n __fish_use_subcommand -l %s -d %s\n", appName, f.Name, shellQuote(f.Usage))
+	}
+	for _, c := range commands {
+		for _, f := range commandFlags(c) {
+			fmt.Fprintf(&b, "complete -c %s -n %s -l %s -d %s\n", appName,
+				shellQuote("__fish_seen_subcommand_from "+c.name), f.Name, shellQuote(f.Usage))
+		}
+	}
+	return b.String()
+}
+
+func newCompletionFlags() *flag.FlagSet {
+	fs := flag.NewFlagSet("completion", flag.ExitOnError)
+	fs.Usage = usage_completion
+	return fs
+}
+
+func completion(ctx context.Context) int {
+	args := parseArgs(newCompletionFlags(), os.Args[2:])
+	if len(args) != 1 {
+		usage_completion()
+		os.Exit(exitUsage)
+	}
+	switch args[0] {
+	case "bash":
+		fmt.Print(bashCompletion())
+	case "zsh":
+		fmt.Print(zshCompletion())
+	case "fish":
+		fmt.Print(fishCompletion())
+	default:
+		fatal(usageError{fmt.Errorf("unsupported shell: %s, expected bash, zsh or fish", args[0])})
+	}
+	return exitOK
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestCommandFlags(t *testing.T) {
+	tests := []struct {
+		command string
+		want    []string
+	}{
+		// Batch passes the options to onoff, so it accepts the same flags.
+		{"batch", []string{"host", "keep", "rate", "dry-run", "mqtt-broker"}},
+		{"onoff", []string{"host", "keep", "rate", "dry-run", "mqtt-broker"}},
+		{"off", []string{"host", "for", "toggle-after", "all"}},
+		{"disable-schedule", []string{"host", "json"}},
+		{"discover", []string{"timeout", "json", "log-level"}},
+		{"version", []string{"json"}},
+	}
+	for _, tt := range tests {
+		c, ok := lookupCommand(tt.command)
+		if !ok {
+			t.Fatalf("command %s not found", tt.command)
+		}
+		names := flagNames(commandFlags(c))
+		for _, name := range tt.want {
+			if !strings.Contains(" "+names+" ", " --"+name+" ") {
+				t.Errorf("flags of %s = %s, want --%s", tt.command, names, name)
+			}
+		}
+	}
+}
+
+func TestCompletionListsFlagsOfAllCommands(t *testing.T) {
+	script := bashCompletion()
+	for _, c := range commands {
+		if c.name == "completion" {
+			continue
+		}
+		if len(commandFlags(c)) == 0 {
+			t.Errorf("command %s has no flags", c.name)
+		}
+		if !strings.Contains(script, c.name) {
+			t.Errorf("bash completion does not contain command %s", c.name)
+		}
+	}
+}
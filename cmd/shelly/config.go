@@ -0,0 +1,75 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// DeviceConfig is a named device in the config file. Host may contain the
+// scheme, e.g. https://shelly.example.com. Lat and Lon are the coordinates of
+// the device, used for sunrise and sunset.
+type DeviceConfig struct {
+	Host     string   `json:"host"`
+	User     string   `json:"user,omitempty"`
+	Password string   `json:"password,omitempty"`
+	Lat      *float64 `json:"lat,omitempty"`
+	Lon      *float64 `json:"lon,omitempty"`
+}
+
+// Config is the content of config file, e.g.
+//
+//	{"devices": {"kitchen": {"host": "192.168.1.50", "password": "secret"}}}
+type Config struct {
+	Devices map[string]DeviceConfig `json:"devices"`
+}
+
+// configPath returns the path of config file, given by environment variable
+// SHELLY_CONFIG, or ~/.shelly.json by default.
+func configPath() (string, error) {
+	if path, ok := os.LookupEnv("SHELLY_CONFIG"); ok && path != "" {
+		return path, nil
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(home, ".shelly.json"), nil
+}
+
+// loadConfig reads the config file. Missing config file is not an error, but
+// results in an empty config.
+func loadConfig(path string) (Config, error) {
+	config := Config{Devices: map[string]DeviceConfig{}}
+	data, err := ioutil.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return config, nil
+	}
+	if err != nil {
+		return config, err
+	}
+	err = json.Unmarshal(data, &config)
+	if err != nil {
+		return config, errors.New("invalid config file " + path + ": " + err.Error())
+	}
+	return config, nil
+}
+
+// lookupDevice returns the named device from config file.
+func lookupDevice(name string) (DeviceConfig, error) {
+	path, err := configPath()
+	if err != nil {
+		return DeviceConfig{}, err
+	}
+	config, err := loadConfig(path)
+	if err != nil {
+		return DeviceConfig{}, err
+	}
+	device, ok := config.Devices[name]
+	if !ok {
+		return DeviceConfig{}, errors.New("device " + name + " not found in config file " + path)
+	}
+	return device, nil
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+
+	"github.com/ahojukka5/shelly"
+)
+
+func usage_cover(command string) {
+	fmt.Printf("Usage: %s %s [options] <covers>\n\n", appName, command)
+	fmt.Println("  covers      Cover id or list of cover ids")
+	usage_device_options()
+	fmt.Println("  --position  Move covers to position 0..100 (0 closed, 100 open)")
+	fmt.Print("\nExamples:\n\n")
+	fmt.Printf("  %s %s 0\n", appName, command)
+	fmt.Printf("  %s %s --position 50 0,1\n", appName, command)
+}
+
+func open_cover(ctx context.Context) int {
+	return coverMove(ctx, "open")
+}
+
+func close_cover(ctx context.Context) int {
+	return coverMove(ctx, "close")
+}
+
+type coverFlags struct {
+	fs       *flag.FlagSet
+	device   *deviceFlags
+	position *int
+}
+
+func newCoverFlags(command string) *coverFlags {
+	fs := flag.NewFlagSet(command, flag.ExitOnError)
+	fs.Usage = func() { usage_cover(command) }
+	return &coverFlags{
+		fs:       fs,
+		device:   addDeviceFlags(fs),
+		position: fs.Int("position", -1, "move covers to position 0..100"),
+	}
+}
+
+func coverMove(ctx context.Context, command string) int {
+	f := newCoverFlags(command)
+	device, position := f.device, f.position
+	args := parseArgs(f.fs, os.Args[2:])
+	if len(args) != 1 {
+		usage_cover(command)
+		os.Exit(exitUsage)
+	}
+	cover_ids, err := shelly.ParseInts(args[0], ",")
+	if err != nil {
+		fatal(usageError{err})
+	}
+	positionSet := false
+	f.fs.Visit(func(fl *flag.Flag) {
+		if fl.Name == "position" {
+			positionSet = true
+		}
+	})
+	if positionSet && (*position < 0 || *position > 100) {
+		fatal(usageError{errors.New("position out of range 0..100: " + strconv.Itoa(*position))})
+	}
+	client, uri, err := device.connect(ctx)
+	if err != nil {
+		fatal(err)
+	}
+	result := []CoverResult{}
+	for _, cid := range cover_ids {
+		target := *position
+		switch {
+		case positionSet:
+			err = shelly.CoverGoToPosition(ctx, client, uri, cid, *position)
+		case command == "open":
+			target = 100
+			err = shelly.CoverOpen(ctx, client, uri, cid)
+		default:
+			target = 0
+			err = shelly.CoverClose(ctx, client, uri, cid)
+		}
+		if err != nil {
+			fatal(err)
+		}
+		cover, err := shelly.CoverGetStatus(ctx, client, uri, cid)
+		if err != nil {
+			fatal(err)
+		}
+		if cover.TargetPos != nil {
+			target = *cover.TargetPos
+		}
+		result = append(result, CoverResult{cid, cover.State, target})
+		if !jsonOutput {
+			fmt.Printf("cover %d: %s, target position %d\n", cid, cover.State, target)
+		}
+	}
+	if jsonOutput {
+		printJSON(result)
+	}
+	return exitOK
+}
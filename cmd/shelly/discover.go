@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/ahojukka5/shelly"
+)
+
+func usage_discover() {
+	fmt.Printf("Usage: %s discover [options]\n", appName)
+	fmt.Print("\nOptions:\n\n")
+	fmt.Println("  --timeout   Time to listen for responses (default 3s)")
+	fmt.Println("  --json      Print output as JSON, diagnostics are logged to stderr")
+	fmt.Println("  --log-level Minimum level of logged messages: debug, info (default), warn or")
+	fmt.Println("              error")
+	fmt.Println("  --verbose   Print debug messages, same as --log-level debug")
+	fmt.Println("  --log-file  Append log to file instead of stderr")
+	fmt.Print("\nExamples:\n\n")
+	fmt.Printf("  %s discover\n", appName)
+	fmt.Printf("  %s discover --timeout 10s\n", appName)
+}
+
+type discoverFlags struct {
+	fs      *flag.FlagSet
+	timeout *time.Duration
+}
+
+func newDiscoverFlags() *discoverFlags {
+	fs := flag.NewFlagSet("discover", flag.ExitOnError)
+	fs.Usage = usage_discover
+	f := &discoverFlags{fs: fs}
+	f.timeout = fs.Duration("timeout", shelly.DefaultDiscoverTimeout, "time to listen for responses")
+	fs.BoolVar(&jsonOutput, "json", jsonOutput, "print output as JSON")
+	addLogFlags(fs)
+	return f
+}
+
+func discover(ctx context.Context) int {
+	f := newDiscoverFlags()
+	timeout := f.timeout
+	args := parseArgs(f.fs, os.Args[2:])
+	if len(args) != 0 {
+		usage_discover()
+		os.Exit(exitUsage)
+	}
+	devices, err := shelly.Discover(ctx, *timeout)
+	if err != nil {
+		fatal(err)
+	}
+	if jsonOutput {
+		printJSON(devices)
+		return exitOK
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "NAME\tHOST\tPORT\tADDRESSES")
+	for _, d := range devices {
+		fmt.Fprintf(w, "%s\t%s\t%d\t%s\n", d.Name, d.Host, d.Port, strings.Join(d.Addrs, ","))
+	}
+	w.Flush()
+	return exitOK
+}
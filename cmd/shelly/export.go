@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log/slog"
+	"os"
+	"time"
+
+	"github.com/ahojukka5/shelly"
+)
+
+func usage_export() {
+	fmt.Printf("Usage: %s export [options]\n", appName)
+	usage_device_options()
+	fmt.Println("  --output    Write schedules to file instead of stdout")
+	fmt.Print("\nExamples:\n\n")
+	fmt.Printf("  %s export > schedules.json\n", appName)
+	fmt.Printf("  %s export --output schedules.json\n", appName)
+	fmt.Print("\nThe exported file can be imported to the same or another device with import.\n")
+}
+
+// ScheduleExport is the document written by export command. It can be read
+// by import command, recreating the schedules as such.
+type ScheduleExport struct {
+	Host       string               `json:"host"`
+	ExportedAt time.Time            `json:"exported_at"`
+	Schedules  []shelly.ScheduleJob `json:"schedules"`
+}
+
+// exportSchedules returns the schedules of the device as ScheduleExport
+// document, and the number of the schedules.
+func exportSchedules(ctx context.Context, client *shelly.Client, uri string, host string) ([]byte, int, error) {
+	jobs, err := shelly.ScheduleList(ctx, client, uri)
+	if err != nil {
+		return nil, 0, err
+	}
+	data, err := json.MarshalIndent(ScheduleExport{host, time.Now(), jobs}, "", "  ")
+	return data, len(jobs), err
+}
+
+type exportFlags struct {
+	fs     *flag.FlagSet
+	device *deviceFlags
+	output *string
+}
+
+func newExportFlags() *exportFlags {
+	fs := flag.NewFlagSet("export", flag.ExitOnError)
+	fs.Usage = usage_export
+	return &exportFlags{
+		fs:     fs,
+		device: addDeviceFlags(fs),
+		output: fs.String("output", "", "write schedules to file instead of stdout"),
+	}
+}
+
+func export_schedules(ctx context.Context) int {
+	f := newExportFlags()
+	device, output := f.device, f.output
+	args := parseArgs(f.fs, os.Args[2:])
+	if len(args) != 0 {
+		usage_export()
+		os.Exit(exitUsage)
+	}
+	devices, err := device.connectAll(ctx)
+	if err != nil {
+		fatal(err)
+	}
+	if len(devices) > 1 {
+		fatal(usageError{fmt.Errorf("command supports only a single device, got %d", len(devices))})
+	}
+	d := devices[0]
+	defer d.client.Close()
+	data, count, err := exportSchedules(ctx, d.client, d.uri, d.host)
+	if err != nil {
+		fatal(err)
+	}
+	if *output == "" {
+		fmt.Println(string(data))
+		return exitOK
+	}
+	if err := ioutil.WriteFile(*output, append(data, '\n'), 0644); err != nil {
+		fatal(err)
+	}
+	slog.Info("Exported schedules", "host", d.host, "count", count, "file", *output)
+	return exitOK
+}
@@ -0,0 +1,278 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log/slog"
+	"os"
+	"time"
+
+	"github.com/ahojukka5/shelly"
+)
+
+func usage_import() {
+	fmt.Printf("Usage: %s import [options] <file>\n\n", appName)
+	fmt.Println("  file        JSON file with array of schedule definitions, or schedules")
+	fmt.Println("              exported with export command, or - for stdin")
+	usage_device_options()
+	fmt.Println("  --dry-run   Print schedules without sending them to device")
+	fmt.Println("  --tz        Time zone of dates and times as IANA name, or local (default time")
+	fmt.Println("              zone of the device)")
+	fmt.Print("\nExamples:\n\n")
+	fmt.Printf("  %s import schedules.json\n", appName)
+	fmt.Printf("  %s import --dry-run schedules.json\n", appName)
+	fmt.Print("\nEach schedule definition turns relays on and off, e.g.\n\n")
+	fmt.Println(`  [{"relays": [0, 1], "repeat": "weekdays", "on": "6:30", "off": "7:30"},`)
+	fmt.Println(`   {"relays": [2], "date": "2024-06-01", "on": "17", "off": "18", "disabled": true}]`)
+	fmt.Print("\nThe date defaults to today. Either on or off may be left out to only turn\n")
+	fmt.Println("relays on or off. The whole file is validated before any schedule is created,")
+	fmt.Println("and existing schedules are kept. Exported schedules are created as such.")
+}
+
+// ScheduleDefinition is a single schedule in the file of import command, see
+// usage_import.
+type ScheduleDefinition struct {
+	Relays   []int  `json:"relays"`
+	Date     string `json:"date,omitempty"`
+	Repeat   string `json:"repeat,omitempty"`
+	On       string `json:"on,omitempty"`
+	Off      string `json:"off,omitempty"`
+	Disabled bool   `json:"disabled,omitempty"`
+}
+
+// plannedDefinition is a schedule definition parsed for creating it.
+type plannedDefinition struct {
+	relayIDs []int
+	date     time.Time
+	offset   shelly.TimeOffset
+	opts     shelly.ScheduleOptions
+}
+
+// plan parses the schedule definition in shelly.Location.
+func (def ScheduleDefinition) plan() (plannedDefinition, error) {
+	p := plannedDefinition{relayIDs: def.Relays, opts: shelly.DefaultScheduleOptions()}
+	if len(def.Relays) == 0 {
+		return p, errors.New("relays not given")
+	}
+	for _, id := range def.Relays {
+		if id < 0 {
+			return p, fmt.Errorf("invalid relay id %d", id)
+		}
+	}
+	on, off := def.On, def.Off
+	switch {
+	case on == "" && off == "":
+		return p, errors.New("on or off time not given")
+	case on == "":
+		on, p.opts.OffOnly = off, true
+	case off == "":
+		off, p.opts.OnOnly = on, true
+	}
+	datestr := def.Date
+	if datestr == "" {
+		datestr = "today"
+	}
+	var err error
+	p.date, err = shelly.ParseDate(datestr)
+	if err != nil {
+		return p, fmt.Errorf("invalid date: %w", err)
+	}
+	p.offset, err = shelly.ParseTime(on + ".." + off)
+	if err != nil {
+		return p, fmt.Errorf("invalid time range: %w", err)
+	}
+	if p.offset.BeginEvent != "" || p.offset.EndEvent != "" {
+		return p, errors.New("sunrise and sunset are not supported by import")
+	}
+	// With only on or off time, the unused end of range is moved a second
+	// apart, so that the range is not taken as overnight.
+	if p.opts.OnOnly {
+		p.offset.End = p.offset.Begin + time.Second
+	}
+	if p.opts.OffOnly {
+		p.offset.Begin = p.offset.End - time.Second
+	}
+	if def.Repeat != "" {
+		p.opts.Repeat, err = shelly.ParseRepeat(def.Repeat)
+		if err != nil {
+			return p, fmt.Errorf("invalid repeat: %w", err)
+		}
+	}
+	p.opts.Disabled = def.Disabled
+	return p, nil
+}
+
+// scheduleFile is the content of the file of import command, either schedule
+// definitions or schedules exported with export command.
+type scheduleFile struct {
+	defs []ScheduleDefinition
+	jobs []shelly.ScheduleJob
+}
+
+// count returns the number of schedule definitions and exported schedules.
+func (f scheduleFile) count() int {
+	return len(f.defs) + len(f.jobs)
+}
+
+// loadDefinitions reads and validates the schedule definitions or exported
+// schedules from file, or from stdin if file is -.
+func loadDefinitions(file string) (scheduleFile, error) {
+	var data []byte
+	var err error
+	if file == "-" {
+		data, err = ioutil.ReadAll(os.Stdin)
+	} else {
+		data, err = ioutil.ReadFile(file)
+	}
+	if err != nil {
+		return scheduleFile{}, err
+	}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if trimmed := bytes.TrimSpace(data); len(trimmed) > 0 && trimmed[0] == '{' {
+		var exported ScheduleExport
+		if err := decoder.Decode(&exported); err != nil {
+			return scheduleFile{}, fmt.Errorf("invalid schedule file %s: %w", file, err)
+		}
+		for i, job := range exported.Schedules {
+			if len(job.Calls) == 0 {
+				return scheduleFile{}, fmt.Errorf("invalid schedule %d in %s: calls missing", i+1, file)
+			}
+			if err := shelly.ValidateTimeSpec(job.TimeSpec); err != nil {
+				return scheduleFile{}, fmt.Errorf("invalid schedule %d in %s: %w", i+1, file, err)
+			}
+		}
+		return scheduleFile{jobs: exported.Schedules}, nil
+	}
+	defs := []ScheduleDefinition{}
+	if err := decoder.Decode(&defs); err != nil {
+		return scheduleFile{}, fmt.Errorf("invalid schedule file %s: %w", file, err)
+	}
+	for i, def := range defs {
+		if _, err := def.plan(); err != nil {
+			return scheduleFile{}, fmt.Errorf("invalid schedule %d in %s: %w", i+1, file, err)
+		}
+	}
+	return scheduleFile{defs: defs}, nil
+}
+
+// importSchedules creates the schedules of all definitions and the exported
+// schedules to a single device and returns the ids of the created schedules.
+// If creating any schedule fails, the schedules already created are deleted.
+func importSchedules(ctx context.Context, client *shelly.Client, uri string, file scheduleFile) ([]int, error) {
+	deviceStatus, err := shelly.GetStatus(ctx, client, uri)
+	if err != nil {
+		return nil, err
+	}
+	planned := []plannedDefinition{}
+	for i, def := range file.defs {
+		p, err := def.plan()
+		if err != nil {
+			return nil, fmt.Errorf("invalid schedule %d: %w", i+1, err)
+		}
+		if err := shelly.ValidateRelays(deviceStatus, p.relayIDs); err != nil {
+			return nil, fmt.Errorf("invalid schedule %d: %w", i+1, err)
+		}
+		planned = append(planned, p)
+	}
+	created := []int{}
+	rollback := func() {
+		for _, id := range created {
+			if err := shelly.ScheduleDelete(context.Background(), client, uri, id); err != nil {
+				slog.Warn("Rolling back schedule failed", "id", id, "err", err)
+			}
+		}
+	}
+	for i, p := range planned {
+		ids, err := shelly.CreateOnOffSchedule(ctx, client, uri, p.relayIDs, p.date, p.offset, p.opts)
+		if err != nil {
+			rollback()
+			return nil, fmt.Errorf("creating schedule %d failed: %w", i+1, err)
+		}
+		created = append(created, ids...)
+	}
+	for i, job := range file.jobs {
+		id, err := shelly.ScheduleCreate(ctx, client, uri, shelly.Schedule{Enable: job.Enable, TimeSpec: job.TimeSpec, Calls: job.Calls})
+		if err != nil {
+			rollback()
+			return nil, fmt.Errorf("creating schedule %d failed: %w", i+1, err)
+		}
+		if !client.DryRun {
+			created = append(created, id)
+		}
+	}
+	return created, nil
+}
+
+type importFlags struct {
+	fs     *flag.FlagSet
+	device *deviceFlags
+	dryRun *bool
+	tz     *string
+}
+
+func newImportFlags() *importFlags {
+	fs := flag.NewFlagSet("import", flag.ExitOnError)
+	fs.Usage = usage_import
+	return &importFlags{
+		fs:     fs,
+		device: addDeviceFlags(fs),
+		dryRun: fs.Bool("dry-run", false, "print schedules without sending them to device"),
+		tz:     fs.String("tz", "", "time zone of dates and times, IANA name or local"),
+	}
+}
+
+func import_schedules(ctx context.Context) int {
+	f := newImportFlags()
+	device, dryRun, tz := f.device, f.dryRun, f.tz
+	args := parseArgs(f.fs, os.Args[2:])
+	if len(args) != 1 {
+		usage_import()
+		os.Exit(exitUsage)
+	}
+	// The file is validated before connecting to the device, and parsed
+	// again once the time zone of the device is known.
+	file, err := loadDefinitions(args[0])
+	if err != nil {
+		fatal(usageError{err})
+	}
+	devices, err := device.connectAll(ctx)
+	if err != nil {
+		fatal(err)
+	}
+	shelly.Location, err = lookupLocation(ctx, *tz, devices[0])
+	if err != nil {
+		fatal(err)
+	}
+	results := []ImportResult{}
+	var lastErr error
+	for _, d := range devices {
+		d.client.DryRun = *dryRun
+		ids, err := importSchedules(ctx, d.client, d.uri, file)
+		d.client.Close()
+		result := ImportResult{Host: d.host, IDs: ids, DryRun: *dryRun}
+		if err != nil {
+			slog.Error("Importing schedules failed", "host", d.host, "err", err)
+			result.Error = err.Error()
+			lastErr = err
+		} else if !*dryRun {
+			slog.Info("Imported schedules", "host", d.host, "count", file.count(), "ids", ids)
+		}
+		results = append(results, result)
+	}
+	if jsonOutput {
+		printJSON(results)
+	}
+	if lastErr != nil {
+		return exitCode(lastErr)
+	}
+	if *dryRun {
+		slog.Info("Dry run, nothing was sent to device!")
+	}
+	return exitOK
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/ahojukka5/shelly"
+)
+
+// newTestDevice starts a fake device answering RPC calls with respond, which
+// gets the method name and the request body, and returns a client and the
+// base URI of the device.
+func newTestDevice(t *testing.T, respond func(method string, body []byte) string) (*shelly.Client, string) {
+	t.Helper()
+	var mu sync.Mutex
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		mu.Lock()
+		defer mu.Unlock()
+		io.WriteString(w, respond(strings.TrimPrefix(r.URL.Path, "/rpc/"), body))
+	}))
+	t.Cleanup(server.Close)
+	return shelly.NewClient(), server.URL + "/rpc/"
+}
+
+// uiSchedules are schedules created in the web UI of the device, using the
+// cron forms of the firmware.
+const uiSchedules = `{"jobs": [
+	{"id": 1, "enable": true, "timespec": "0 0 7 * * MON-FRI", "calls": [{"method": "Switch.Set", "params": {"id": 0, "on": true}}]},
+	{"id": 2, "enable": false, "timespec": "0 */15 * * * *", "calls": [{"method": "Switch.Toggle", "params": {"id": 1}}]},
+	{"id": 3, "enable": true, "timespec": "0 30 22 * * SUN,SAT", "calls": [{"method": "Switch.Set", "params": {"id": 0, "on": false}}]},
+	{"id": 4, "enable": true, "timespec": "@sunset+0h30m * * *", "calls": [{"method": "Switch.Set", "params": {"id": 2, "on": true}}]}
+], "rev": 12}`
+
+func TestExportImportRoundTrip(t *testing.T) {
+	client, uri := newTestDevice(t, func(method string, body []byte) string {
+		return uiSchedules
+	})
+	data, count, err := exportSchedules(context.Background(), client, uri, "192.168.1.50")
+	if err != nil || count != 4 {
+		t.Fatalf("exportSchedules: got %d schedules, %v", count, err)
+	}
+	file := filepath.Join(t.TempDir(), "schedules.json")
+	if err := os.WriteFile(file, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := loadDefinitions(file)
+	if err != nil {
+		t.Fatalf("loadDefinitions: %s", err)
+	}
+
+	created := []shelly.Schedule{}
+	target, targetURI := newTestDevice(t, func(method string, body []byte) string {
+		switch method {
+		case "Shelly.GetStatus":
+			return `{"sys": {"uptime": 100}, "switch:0": {"id": 0, "output": false}, "switch:1": {"id": 1, "output": false}, "switch:2": {"id": 2, "output": false}}`
+		case "Schedule.Create":
+			var schedule shelly.Schedule
+			if err := json.Unmarshal(body, &schedule); err != nil {
+				t.Errorf("Schedule.Create: %s", err)
+			}
+			created = append(created, schedule)
+			return `{"id": ` + strconv.Itoa(len(created)) + `, "rev": 13}`
+		}
+		t.Errorf("unexpected call %s", method)
+		return `{}`
+	})
+	ids, err := importSchedules(context.Background(), target, targetURI, loaded)
+	if err != nil {
+		t.Fatalf("importSchedules: %s", err)
+	}
+	if !reflect.DeepEqual(ids, []int{1, 2, 3, 4}) {
+		t.Errorf("got ids %v", ids)
+	}
+	var listed struct {
+		Jobs []shelly.ScheduleJob `json:"jobs"`
+	}
+	json.Unmarshal([]byte(uiSchedules), &listed)
+	if len(created) != len(listed.Jobs) {
+		t.Fatalf("created %d schedules, want %d", len(created), len(listed.Jobs))
+	}
+	for i, job := range listed.Jobs {
+		want := shelly.Schedule{Enable: job.Enable, TimeSpec: job.TimeSpec, Calls: job.Calls}
+		if !reflect.DeepEqual(created[i], want) {
+			t.Errorf("schedule %d: created %+v, want %+v", i+1, created[i], want)
+		}
+	}
+}
+
+func TestImportInvalidTimeSpec(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "schedules.json")
+	data := `{"host": "x", "schedules": [{"id": 1, "enable": true, "timespec": "0 0 25 * * *", "calls": [{"method": "Switch.Set", "params": {"id": 0, "on": true}}]}]}`
+	if err := os.WriteFile(file, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadDefinitions(file); err == nil || !strings.Contains(err.Error(), "hour 25 out of range") {
+		t.Errorf("got error %v, want hour out of range", err)
+	}
+}
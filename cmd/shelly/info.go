@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strconv"
+	"text/tabwriter"
+
+	"github.com/ahojukka5/shelly"
+)
+
+func usage_info() {
+	fmt.Printf("Usage: %s info [options]\n", appName)
+	usage_device_options()
+	fmt.Print("\nExamples:\n\n")
+	fmt.Printf("  %s info\n", appName)
+	fmt.Printf("  %s info --json --host 192.168.1.50,192.168.1.51\n", appName)
+}
+
+// orNA returns s, or n/a if empty.
+func orNA(s string) string {
+	if s == "" {
+		return "n/a"
+	}
+	return s
+}
+
+func newInfoFlags() *deviceCommandFlags {
+	return newDeviceCommandFlags("info", usage_info)
+}
+
+func info(ctx context.Context) int {
+	f := newInfoFlags()
+	device := f.device
+	args := parseArgs(f.fs, os.Args[2:])
+	if len(args) != 0 {
+		usage_info()
+		os.Exit(exitUsage)
+	}
+	devices, err := device.connectAll(ctx)
+	if err != nil {
+		fatal(err)
+	}
+	results := []InfoResult{}
+	for _, d := range devices {
+		deviceInfo, err := shelly.GetDeviceInfo(ctx, d.client, d.uri)
+		d.client.Close()
+		if err != nil {
+			fatal(err)
+		}
+		results = append(results, InfoResult{d.host, deviceInfo})
+	}
+	if jsonOutput {
+		printJSON(results)
+		return exitOK
+	}
+	for i, result := range results {
+		if i > 0 {
+			fmt.Println()
+		}
+		firmware := orNA(result.Version)
+		if result.FirmwareID != "" {
+			firmware += " (" + result.FirmwareID + ")"
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintf(w, "host:\t%s\n", result.Host)
+		fmt.Fprintf(w, "name:\t%s\n", orNA(result.Name))
+		fmt.Fprintf(w, "id:\t%s\n", orNA(result.ID))
+		fmt.Fprintf(w, "model:\t%s\n", orNA(result.Model))
+		fmt.Fprintf(w, "gen:\t%s\n", strconv.Itoa(result.Gen))
+		fmt.Fprintf(w, "firmware:\t%s\n", firmware)
+		fmt.Fprintf(w, "mac:\t%s\n", orNA(result.MAC))
+		w.Flush()
+	}
+	return exitOK
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/ahojukka5/shelly"
+)
+
+func usage_dim() {
+	fmt.Printf("Usage: %s dim [options] <light> <percent>\n\n", appName)
+	fmt.Println("  light       Light id")
+	fmt.Println("  percent     Brightness 0..100")
+	usage_device_options()
+	fmt.Print("\nExamples:\n\n")
+	fmt.Printf("  %s dim 0 50\n", appName)
+}
+
+func newDimFlags() *deviceCommandFlags {
+	return newDeviceCommandFlags("dim", usage_dim)
+}
+
+func dim(ctx context.Context) int {
+	f := newDimFlags()
+	device := f.device
+	args := parseArgs(f.fs, os.Args[2:])
+	if len(args) != 2 {
+		usage_dim()
+		os.Exit(exitUsage)
+	}
+	light_ids, err := shelly.ParseInts(args[0], ",")
+	if err != nil {
+		fatal(usageError{err})
+	}
+	if len(light_ids) != 1 {
+		fatal(usageError{errors.New("invalid light id: " + args[0] + ", expected single integer")})
+	}
+	percents, err := shelly.ParseInts(args[1], ",")
+	if err != nil {
+		fatal(usageError{err})
+	}
+	if len(percents) != 1 || percents[0] < 0 || percents[0] > 100 {
+		fatal(usageError{errors.New("invalid brightness: " + args[1] + ", expected integer 0..100")})
+	}
+	lid, brightness := light_ids[0], percents[0]
+	client, uri, err := device.connect(ctx)
+	if err != nil {
+		fatal(err)
+	}
+	err = shelly.LightSet(ctx, client, uri, lid, brightness)
+	if err != nil {
+		fatal(err)
+	}
+	light, err := shelly.LightGetStatus(ctx, client, uri, lid)
+	if err != nil {
+		fatal(err)
+	}
+	if jsonOutput {
+		printJSON(LightResult{lid, light.Output, light.Brightness})
+		return exitOK
+	}
+	fmt.Printf("light %d: brightness %.0f%%\n", lid, light.Brightness)
+	return exitOK
+}
+
+func usage_color() {
+	fmt.Printf("Usage: %s color [options] <light> <color>\n\n", appName)
+	fmt.Println("  light       RGB light id")
+	fmt.Println("  color       Color as hex RRGGBB, with optional # prefix")
+	usage_device_options()
+	fmt.Print("\nExamples:\n\n")
+	fmt.Printf("  %s color 0 ff8000\n", appName)
+	fmt.Printf("  %s color --gen 1 0 '#00ff00'\n", appName)
+}
+
+func newColorFlags() *deviceCommandFlags {
+	return newDeviceCommandFlags("color", usage_color)
+}
+
+func color(ctx context.Context) int {
+	f := newColorFlags()
+	device := f.device
+	args := parseArgs(f.fs, os.Args[2:])
+	if len(args) != 2 {
+		usage_color()
+		os.Exit(exitUsage)
+	}
+	light_ids, err := shelly.ParseInts(args[0], ",")
+	if err != nil {
+		fatal(usageError{err})
+	}
+	if len(light_ids) != 1 {
+		fatal(usageError{errors.New("invalid light id: " + args[0] + ", expected single integer")})
+	}
+	c, err := shelly.ParseColor(args[1])
+	if err != nil {
+		fatal(usageError{err})
+	}
+	lid := light_ids[0]
+	client, uri, err := device.connect(ctx)
+	if err != nil {
+		fatal(err)
+	}
+	err = shelly.ColorSet(ctx, client, uri, lid, c)
+	if err != nil {
+		fatal(err)
+	}
+	if jsonOutput {
+		printJSON(ColorResult{lid, c.String(), int(c.Red), int(c.Green), int(c.Blue)})
+		return exitOK
+	}
+	fmt.Printf("light %d: color %s\n", lid, c)
+	return exitOK
+}
@@ -0,0 +1,521 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/ahojukka5/shelly"
+)
+
+const appName = "shelly"
+
+// parseArgs parses flags which may be interspersed with positional
+// arguments and returns the positional arguments. Arguments split by shell
+// after a comma are joined, so that list 0, 1, 2 can be given unquoted.
+func parseArgs(fs *flag.FlagSet, args []string) []string {
+	positional, _ := parseArgsErr(fs, args)
+	return positional
+}
+
+// parseArgsErr is parseArgs returning the error of parsing the flags, for
+// flag sets not exiting on errors.
+func parseArgsErr(fs *flag.FlagSet, args []string) ([]string, error) {
+	positional := []string{}
+	for {
+		if err := fs.Parse(args); err != nil {
+			return positional, err
+		}
+		args = fs.Args()
+		if len(args) == 0 {
+			return positional, nil
+		}
+		last := len(positional) - 1
+		if last >= 0 && strings.HasSuffix(positional[last], ",") {
+			positional[last] += args[0]
+		} else {
+			positional = append(positional, args[0])
+		}
+		args = args[1:]
+	}
+}
+
+// lookupHost returns the device address given with --host flag, falling back
+// to environment variable SHELLY_IP and then to the config file value. The
+// source of the address is returned for error messages.
+func lookupHost(host string, config string) (string, string, error) {
+	if host != "" {
+		return host, "--host", nil
+	}
+	ip, ok := os.LookupEnv("SHELLY_IP")
+	if ok && ip != "" {
+		return ip, "SHELLY_IP", nil
+	}
+	if config != "" {
+		return config, "config file", nil
+	}
+	return "", "", errors.New("device address not set: use --host or --device flag or environment variable SHELLY_IP")
+}
+
+// lookupCredentials returns the credentials given with flags, falling back to
+// environment variables SHELLY_USER and SHELLY_PASS and then to the config
+// file values.
+func lookupCredentials(user string, password string, config DeviceConfig) shelly.Credentials {
+	if user == "" {
+		user = os.Getenv("SHELLY_USER")
+	}
+	if user == "" {
+		user = config.User
+	}
+	if user == "" {
+		user = "admin"
+	}
+	if password == "" {
+		password = os.Getenv("SHELLY_PASS")
+	}
+	if password == "" {
+		password = config.Password
+	}
+	return shelly.Credentials{User: user, Password: password}
+}
+
+type deviceFlags struct {
+	device    *string
+	host      *string
+	scheme    *string
+	user      *string
+	password  *string
+	timeout   *time.Duration
+	retries   *int
+	transport *string
+	gen       *string
+}
+
+// globalDevice holds the device flags given before the command, e.g.
+// shelly --host 192.168.1.50 onoff ..., which are the defaults of the device
+// flags of the command.
+var globalDevice *deviceFlags
+
+// addDeviceFlags adds flags common to all commands communicating with the
+// device. The defaults are taken from the flags given before the command.
+func addDeviceFlags(fs *flag.FlagSet) *deviceFlags {
+	device, host, scheme, user, password := "", "", "http", "", ""
+	timeout, retries, transport, gen := shelly.DefaultTimeout, shelly.DefaultRetries, "http", "auto"
+	if g := globalDevice; g != nil {
+		device, host, scheme, user, password = *g.device, *g.host, *g.scheme, *g.user, *g.password
+		timeout, retries, transport, gen = *g.timeout, *g.retries, *g.transport, *g.gen
+	}
+	f := &deviceFlags{
+		device:    fs.String("device", device, "name of device in config file"),
+		host:      fs.String("host", host, "device address as <ip> or <host>:<port>"),
+		scheme:    fs.String("scheme", scheme, "URI scheme, http or https"),
+		user:      fs.String("user", user, "user name for authentication"),
+		password:  fs.String("password", password, "password for authentication"),
+		timeout:   fs.Duration("timeout", timeout, "timeout for each request to device"),
+		retries:   fs.Int("retries", retries, "number of retries of failed requests"),
+		transport: fs.String("transport", transport, "transport of RPC calls, http or ws"),
+		gen:       fs.String("gen", gen, "generation of the device, auto, 1 or 2"),
+	}
+	fs.BoolVar(&jsonOutput, "json", jsonOutput, "print output as JSON")
+	addLogFlags(fs)
+	return f
+}
+
+// verbose and quiet are set by --verbose and --quiet, which are mutually
+// exclusive, also when given before and after the command.
+var verbose, quiet bool
+
+// errVerboseQuiet is returned when both --verbose and --quiet are given.
+var errVerboseQuiet = errors.New("flags --verbose and --quiet are mutually exclusive")
+
+// verboseFlag sets the log level to debug, as shorthand for --log-level debug.
+type verboseFlag struct{}
+
+func (verboseFlag) String() string { return "false" }
+
+func (verboseFlag) IsBoolFlag() bool { return true }
+
+func (verboseFlag) Set(s string) error {
+	on, err := strconv.ParseBool(s)
+	if err != nil {
+		return err
+	}
+	if on && quiet {
+		return errVerboseQuiet
+	}
+	if on {
+		verbose = true
+		shelly.LogLevel.Set(slog.LevelDebug)
+	}
+	return nil
+}
+
+// quietFlag sets the log level to error, as shorthand for --log-level error,
+// so that only failures are logged, e.g. for runs from cron.
+type quietFlag struct{}
+
+func (quietFlag) String() string { return "false" }
+
+func (quietFlag) IsBoolFlag() bool { return true }
+
+func (quietFlag) Set(s string) error {
+	on, err := strconv.ParseBool(s)
+	if err != nil {
+		return err
+	}
+	if on && verbose {
+		return errVerboseQuiet
+	}
+	if on {
+		quiet = true
+		shelly.LogLevel.Set(slog.LevelError)
+	}
+	return nil
+}
+
+// logFile is the file given with --log-file, closed on exit.
+var logFile *os.File
+
+// logFileFlag directs the log to the file given with --log-file, appending to
+// it, so that the file of repeated runs, e.g. from cron, can be rotated.
+type logFileFlag struct{}
+
+func (logFileFlag) String() string {
+	if logFile == nil {
+		return ""
+	}
+	return logFile.Name()
+}
+
+func (logFileFlag) Set(path string) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	closeLogFile()
+	logFile = f
+	shelly.SetLogOutput(f)
+	slog.SetDefault(shelly.Log)
+	return nil
+}
+
+// closeLogFile closes the file given with --log-file, if any.
+func closeLogFile() {
+	if logFile != nil {
+		logFile.Close()
+		logFile = nil
+	}
+}
+
+// addLogFlags adds flags controlling the diagnostic messages, logged to stderr
+// by default.
+func addLogFlags(fs *flag.FlagSet) {
+	fs.TextVar(shelly.LogLevel, "log-level", shelly.LogLevel, "minimum level of logged messages: debug, info, warn or error")
+	fs.Var(verboseFlag{}, "verbose", "print debug messages, same as --log-level debug")
+	fs.Var(quietFlag{}, "quiet", "log only errors, same as --log-level error")
+	fs.Var(logFileFlag{}, "log-file", "append log to file instead of stderr")
+}
+
+// parseGlobalFlags parses the device flags given before the command and
+// returns the command and its arguments. With --version, the version is
+// printed and the program exits.
+func parseGlobalFlags(args []string) []string {
+	fs := flag.NewFlagSet(appName, flag.ExitOnError)
+	fs.Usage = usage
+	globalDevice = addDeviceFlags(fs)
+	showVersion := fs.Bool("version", false, "print version and exit")
+	fs.Parse(args)
+	if *showVersion {
+		printVersion()
+		os.Exit(exitOK)
+	}
+	return fs.Args()
+}
+
+// generations caches the generations of devices detected with --gen auto
+// during the run, by RPC base URI.
+var generations = map[string]int{}
+
+// detectGeneration returns the generation of the device, falling back to
+// Gen2 if the detection fails. The device is asked only once, without
+// retries, so that an unreachable device is retried only by the requests of
+// the command, which then report the failure of the device.
+func detectGeneration(ctx context.Context, client *shelly.Client, uri string) int {
+	if gen, ok := generations[uri]; ok {
+		return gen
+	}
+	retries := client.Retries
+	client.Retries = 0
+	gen, err := shelly.DetectGeneration(ctx, client, uri)
+	client.Retries = retries
+	if err != nil {
+		slog.Warn("Detecting generation failed, assuming Gen2", "uri", uri, "err", err)
+		return shelly.Gen2
+	}
+	generations[uri] = gen
+	return gen
+}
+
+// connection is a single device given with --host flag or SHELLY_IP.
+type connection struct {
+	host   string
+	client *shelly.Client
+	uri    string
+	config DeviceConfig
+}
+
+// connectAll returns the clients and the RPC base URIs of all devices. The
+// devices are given as comma separated list of hosts. With --transport ws, a
+// WebSocket connection is opened to each device, falling back to HTTP if that
+// fails.
+func (f *deviceFlags) connectAll(ctx context.Context) ([]connection, error) {
+	if *f.transport != "http" && *f.transport != "ws" {
+		return nil, usageError{errors.New("unsupported transport: " + *f.transport + ", expected http or ws")}
+	}
+	if *f.gen != "1" && *f.gen != "2" && *f.gen != "auto" {
+		return nil, usageError{errors.New("unsupported generation: " + *f.gen + ", expected 1, 2 or auto")}
+	}
+	config := DeviceConfig{}
+	if *f.device != "" {
+		var err error
+		config, err = lookupDevice(*f.device)
+		if err != nil {
+			return nil, usageError{err}
+		}
+	}
+	hosts, source, err := lookupHost(*f.host, config.Host)
+	if err != nil {
+		return nil, usageError{err}
+	}
+	devices := []connection{}
+	for _, host := range strings.Split(hosts, ",") {
+		host = strings.TrimSpace(host)
+		if host == "" {
+			continue
+		}
+		uri, err := shelly.BuildBaseURI(host, *f.scheme)
+		if err != nil {
+			return nil, usageError{fmt.Errorf("%s: %w", source, err)}
+		}
+		client := shelly.NewClient()
+		client.Credentials = lookupCredentials(*f.user, *f.password, config)
+		client.HTTPClient.Timeout = *f.timeout
+		client.Retries = *f.retries
+		switch *f.gen {
+		case "1":
+			client.Gen = shelly.Gen1
+		case "auto":
+			client.Gen = detectGeneration(ctx, client, uri)
+		}
+		if *f.transport == "ws" && client.Gen != shelly.Gen1 {
+			err = client.DialWebSocket(ctx, uri)
+			if err != nil {
+				slog.Warn("WebSocket connection failed, using HTTP", "host", host, "err", err)
+			}
+		}
+		devices = append(devices, connection{host, client, uri, config})
+	}
+	if len(devices) == 0 {
+		return nil, usageError{errors.New("device address not set: use --host or --device flag or environment variable SHELLY_IP")}
+	}
+	return devices, nil
+}
+
+// connect returns the client and the RPC base URI of the device, for commands
+// supporting only a single device.
+func (f *deviceFlags) connect(ctx context.Context) (*shelly.Client, string, error) {
+	devices, err := f.connectAll(ctx)
+	if err != nil {
+		return nil, "", err
+	}
+	if len(devices) > 1 {
+		return nil, "", usageError{errors.New("command supports only a single device, got " + *f.host)}
+	}
+	return devices[0].client, devices[0].uri, nil
+}
+
+func usage_device_options() {
+	fmt.Print("\nOptions:\n\n")
+	fmt.Println("  --device    Name of device in config file ~/.shelly.json (or SHELLY_CONFIG)")
+	fmt.Println("  --host      Device address as <ip> or <host>:<port>, overrides SHELLY_IP;")
+	fmt.Println("              IPv6 address with port in brackets, e.g. [fe80::1]:8080;")
+	fmt.Println("              onoff accepts comma separated list of devices")
+	fmt.Println("  --scheme    URI scheme, http (default) or https")
+	fmt.Println("  --user      User name for authentication, overrides SHELLY_USER (default admin)")
+	fmt.Println("  --password  Password for authentication, overrides SHELLY_PASS")
+	fmt.Println("  --timeout   Timeout for each request to device (default 10s)")
+	fmt.Println("  --retries   Number of retries of requests failing with network error or")
+	fmt.Println("              server error, with exponential backoff (default 2)")
+	fmt.Println("  --transport Transport of RPC calls: http (default), or ws for a single")
+	fmt.Println("              WebSocket connection, falling back to http if it fails")
+	fmt.Println("  --gen       Generation of the device: auto (default) to detect it from")
+	fmt.Println("              Shelly.GetDeviceInfo, 2 for RPC API of Gen2 and later devices,")
+	fmt.Println("              or 1 for REST API of Gen1 devices supporting on, off, toggle,")
+	fmt.Println("              auto-off, onoff and info")
+	fmt.Println("  --json      Print output as JSON, diagnostics are logged to stderr")
+	fmt.Println("  --log-level Minimum level of logged messages: debug, info (default), warn or")
+	fmt.Println("              error")
+	fmt.Println("  --verbose   Print debug messages, e.g. request payloads and responses, same")
+	fmt.Println("              as --log-level debug")
+	fmt.Println("  --quiet     Log only errors, same as --log-level error; results printed by")
+	fmt.Println("              the commands, e.g. status, are not affected")
+	fmt.Println("  --log-file  Append log to file instead of stderr, e.g. for runs from cron")
+}
+
+func usage() {
+	fmt.Printf("Usage: %s [options] <command> [<args>]\n\n", appName)
+	fmt.Println("Command to easily turn relays on and off:")
+	for _, c := range commands {
+		if len(c.name) > 10 {
+			fmt.Printf("  %s\n             %s\n", c.name, c.summary)
+		} else {
+			fmt.Printf("  %-10s %s\n", c.name, c.summary)
+		}
+	}
+	fmt.Print("\nExamples:\n\n")
+	fmt.Printf("  %s onoff 0,1,2 today 17..18\n", appName)
+	fmt.Printf("  %s onoff 0 tomorrow 2..3\n", appName)
+	fmt.Printf("  %s --host 192.168.1.50 onoff 0 today 17..18\n", appName)
+	fmt.Print("\n\n")
+	fmt.Println("Note 1: by default, schedules created earlier by onoff are deleted before setting")
+	fmt.Println("        new ones, see --keep and --clear of onoff.")
+	fmt.Println("Note 2: an offset to time is set according to formula <relay_id>*<offset>, where")
+	fmt.Println("        <offset> is 2s by default.")
+	fmt.Println("Note 3: device options, e.g. --host, may be given before the command, see")
+	fmt.Println("        options of the commands. Options after the command override them.")
+	fmt.Println("        Use --version to print the version.")
+	fmt.Print("\nExit codes:\n\n")
+	fmt.Println("  0  success")
+	fmt.Println("  1  other error, e.g. relay not found")
+	fmt.Println("  2  invalid arguments or flags")
+	fmt.Println("  3  device could not be reached")
+	fmt.Println("  4  device returned an error")
+}
+
+// command is a subcommand of the command line tool. The flags are defined
+// apart from running the command, so that shell completion lists the same
+// flags that run parses, see completion.
+type command struct {
+	name    string
+	summary string
+	run     func(context.Context) int
+	flags   func() *flag.FlagSet
+}
+
+// deviceCommandFlags are the flags of a command taking only the device flags.
+type deviceCommandFlags struct {
+	fs     *flag.FlagSet
+	device *deviceFlags
+}
+
+// newDeviceCommandFlags defines the flags of a command taking only the device
+// flags.
+func newDeviceCommandFlags(name string, usage func()) *deviceCommandFlags {
+	fs := flag.NewFlagSet(name, flag.ExitOnError)
+	fs.Usage = usage
+	return &deviceCommandFlags{fs, addDeviceFlags(fs)}
+}
+
+// commands are the subcommands in the order listed by usage. Shell completion
+// is generated from them, see completion.
+var commands []command
+
+func init() {
+	commands = []command{
+		{"onoff", "turn relay of list of relays on and off at certain time", onoff, func() *flag.FlagSet { return newOnOffFlags().fs }},
+		{"batch", "run onoff for each line of stdin", batch, func() *flag.FlagSet { return newOnOffFlags().fs }},
+		{"on", "turn relay or list of relays on immediately", on, func() *flag.FlagSet { return newSwitchFlags("on").fs }},
+		{"off", "turn relay or list of relays off immediately", off, func() *flag.FlagSet { return newSwitchFlags("off").fs }},
+		{"dim", "set brightness of dimmable light", dim, func() *flag.FlagSet { return newDimFlags().fs }},
+		{"color", "set color of RGB light", color, func() *flag.FlagSet { return newColorFlags().fs }},
+		{"open", "open cover or list of covers", open_cover, func() *flag.FlagSet { return newCoverFlags("open").fs }},
+		{"close", "close cover or list of covers", close_cover, func() *flag.FlagSet { return newCoverFlags("close").fs }},
+		{"status", "show the state of relays", status, func() *flag.FlagSet { return newStatusFlags().fs }},
+		{"power", "show power, voltage, current and energy of relays", power, func() *flag.FlagSet { return newPowerFlags().fs }},
+		{"watch", "poll the state of relays and print changes", watch, func() *flag.FlagSet { return newWatchFlags().fs }},
+		{"metrics", "serve the state and power of relays as Prometheus metrics", metrics, func() *flag.FlagSet { return newMetricsFlags().fs }},
+		{"list-schedules", "list schedules existing on the device", list_schedules, func() *flag.FlagSet { return newListSchedulesFlags().fs }},
+		{"delete-schedule", "delete single schedule from the device", delete_schedule, func() *flag.FlagSet { return newDeleteScheduleFlags().fs }},
+		{"import", "create schedules defined in JSON file", import_schedules, func() *flag.FlagSet { return newImportFlags().fs }},
+		{"export", "write schedules of the device to JSON file", export_schedules, func() *flag.FlagSet { return newExportFlags().fs }},
+		{"enable-schedule", "enable single schedule on the device", enable_schedule, func() *flag.FlagSet { return newScheduleEnabledFlags("enable").fs }},
+		{"disable-schedule", "disable single schedule on the device", disable_schedule, func() *flag.FlagSet { return newScheduleEnabledFlags("disable").fs }},
+		{"toggle", "toggle relay or list of relays immediately", toggle, func() *flag.FlagSet { return newToggleFlags().fs }},
+		{"auto-off", "set relays to turn off automatically after duration", auto_off, func() *flag.FlagSet { return newAutoOffFlags().fs }},
+		{"ping", "check that the device responds and print the latency", ping, func() *flag.FlagSet { return newPingFlags().fs }},
+		{"info", "show model, generation and firmware of the device", info, func() *flag.FlagSet { return newInfoFlags().fs }},
+		{"discover", "find devices in local network with mDNS", discover, func() *flag.FlagSet { return newDiscoverFlags().fs }},
+		{"reboot", "reboot the device", reboot, func() *flag.FlagSet { return newRebootFlags().fs }},
+		{"completion", "print shell completion script for bash, zsh or fish", completion, func() *flag.FlagSet { return newCompletionFlags() }},
+		{"version", "print version, git commit and build date", print_version, func() *flag.FlagSet { return newVersionFlags() }},
+	}
+}
+
+// lookupCommand returns the subcommand with given name.
+func lookupCommand(name string) (command, bool) {
+	for _, c := range commands {
+		if c.name == name {
+			return c, true
+		}
+	}
+	return command{}, false
+}
+
+// confirm asks user to confirm the action from stdin and returns true if the
+// answer is yes.
+func confirm(question string) bool {
+	fmt.Fprintf(os.Stderr, "%s [y/N] ", question)
+	answer, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && answer == "" {
+		return false
+	}
+	answer = strings.ToLower(strings.TrimSpace(answer))
+	return answer == "y" || answer == "yes"
+}
+
+// signalContext returns a context which is cancelled on SIGINT or SIGTERM.
+func signalContext() (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(context.Background())
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		select {
+		case sig := <-signals:
+			slog.Info("Received signal, cancelling", "signal", sig)
+			cancel()
+		case <-ctx.Done():
+		}
+		signal.Stop(signals)
+	}()
+	return ctx, cancel
+}
+
+func main() {
+	slog.SetDefault(shelly.Log)
+	args := parseGlobalFlags(os.Args[1:])
+	if len(args) < 1 {
+		usage()
+		os.Exit(exitUsage)
+	}
+	// The commands parse their arguments from os.Args[2:].
+	os.Args = append([]string{os.Args[0]}, args...)
+	command, ok := lookupCommand(args[0])
+	if !ok {
+		usage()
+		os.Exit(exitUsage)
+	}
+	ctx, cancel := signalContext()
+	code := command.run(ctx)
+	cancel()
+	closeLogFile()
+	os.Exit(code)
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/ahojukka5/shelly"
+)
+
+func TestParseArgsJoinsList(t *testing.T) {
+	tests := []struct {
+		args []string
+		want []string
+	}{
+		// List 0, 1, 2 given unquoted is split by shell after the commas.
+		{[]string{"0,", "1,", "2", "17..18"}, []string{"0,1,2", "17..18"}},
+		{[]string{"0,1,2", "17..18"}, []string{"0,1,2", "17..18"}},
+		{[]string{"0,", "--dry-run", "1", "17..18"}, []string{"0,1", "17..18"}},
+		{[]string{"0", "1"}, []string{"0", "1"}},
+	}
+	for _, tt := range tests {
+		fs := flag.NewFlagSet("test", flag.ContinueOnError)
+		fs.SetOutput(io.Discard)
+		fs.Bool("dry-run", false, "")
+		got, err := parseArgsErr(fs, tt.args)
+		if err != nil || !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("parseArgsErr(%q) = %q, %v, want %q", tt.args, got, err, tt.want)
+		}
+	}
+}
+
+func TestDetectGeneration(t *testing.T) {
+	tests := []struct {
+		name   string
+		status int
+		body   string
+		want   int
+	}{
+		{"gen2", http.StatusOK, `{"gen":2}`, shelly.Gen2},
+		{"gen3", http.StatusOK, `{"gen":3}`, shelly.Gen2},
+		{"gen1", http.StatusNotFound, "", shelly.Gen1},
+		// The device replies, so the unknown reply falls back to Gen2.
+		{"server error", http.StatusInternalServerError, "", shelly.Gen2},
+		{"not JSON", http.StatusOK, "<html>", shelly.Gen2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(tt.status)
+				io.WriteString(w, tt.body)
+			}))
+			defer server.Close()
+			client := shelly.NewClient()
+			client.Retries = 0
+			if got := detectGeneration(context.Background(), client, server.URL+"/rpc/"); got != tt.want {
+				t.Errorf("detectGeneration() = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+// refusingDoer fails every request as an unreachable device, counting the
+// requests.
+type refusingDoer struct {
+	requests int
+}
+
+func (d *refusingDoer) Do(req *http.Request) (*http.Response, error) {
+	d.requests++
+	return nil, errors.New("connection refused")
+}
+
+func TestDetectGenerationUnreachable(t *testing.T) {
+	doer := &refusingDoer{}
+	client := shelly.NewClient()
+	client.Doer = doer
+	client.Retries = 2
+	uri := "http://192.0.2.1/rpc/"
+	// The device is assumed Gen2, so that the command reports the failure
+	// of the device, but it is asked only once.
+	if gen := detectGeneration(context.Background(), client, uri); gen != shelly.Gen2 {
+		t.Errorf("detectGeneration() = %d, want %d", gen, shelly.Gen2)
+	}
+	if doer.requests != 1 {
+		t.Errorf("detectGeneration() sent %d requests, want 1", doer.requests)
+	}
+	if client.Retries != 2 {
+		t.Errorf("retries of client changed to %d", client.Retries)
+	}
+	if _, ok := generations[uri]; ok {
+		t.Errorf("generation of unreachable device cached")
+	}
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/ahojukka5/shelly"
+)
+
+// DefaultMetricsListen is the default address of metrics server.
+const DefaultMetricsListen = ":9100"
+
+func usage_metrics() {
+	fmt.Printf("Usage: %s metrics [options]\n", appName)
+	usage_device_options()
+	fmt.Println("  --listen    Address of the metrics server (default :9100)")
+	fmt.Print("\nExamples:\n\n")
+	fmt.Printf("  %s metrics\n", appName)
+	fmt.Printf("  %s metrics --listen 127.0.0.1:9200\n", appName)
+	fmt.Print("\nNote: metrics runs until interrupted with Ctrl-C. The status of the device is\n")
+	fmt.Println("      fetched on each scrape of /metrics, e.g. by Prometheus.")
+}
+
+// metric is a single gauge or counter of Prometheus text format.
+type metric struct {
+	name string
+	kind string
+	help string
+	// value returns the value of the metric for the relay, or false if the
+	// device does not report it.
+	value func(sw shelly.SwitchStatus) (float64, bool)
+}
+
+var relayMetrics = []metric{
+	{"shelly_relay_on", "gauge", "Whether the relay is on (1) or off (0).",
+		func(sw shelly.SwitchStatus) (float64, bool) {
+			if sw.Output {
+				return 1, true
+			}
+			return 0, true
+		}},
+	{"shelly_relay_power_watts", "gauge", "Active power of the relay in watts.",
+		func(sw shelly.SwitchStatus) (float64, bool) { return optional(sw.APower) }},
+	{"shelly_relay_voltage_volts", "gauge", "Voltage of the relay in volts.",
+		func(sw shelly.SwitchStatus) (float64, bool) { return optional(sw.Voltage) }},
+	{"shelly_relay_current_amperes", "gauge", "Current of the relay in amperes.",
+		func(sw shelly.SwitchStatus) (float64, bool) { return optional(sw.Current) }},
+	{"shelly_relay_energy_watt_hours_total", "counter", "Total energy of the relay in watt hours.",
+		func(sw shelly.SwitchStatus) (float64, bool) {
+			if sw.AEnergy == nil {
+				return 0, false
+			}
+			return sw.AEnergy.Total, true
+		}},
+}
+
+func optional(value *float64) (float64, bool) {
+	if value == nil {
+		return 0, false
+	}
+	return *value, true
+}
+
+// escapeLabel escapes label value of Prometheus text format.
+func escapeLabel(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(s)
+}
+
+// writeMetrics writes the metrics of the device in Prometheus text format.
+// Metric shelly_up tells whether the status could be fetched.
+func writeMetrics(w io.Writer, deviceStatus shelly.Status, names map[int]string, up bool) {
+	fmt.Fprintln(w, "# HELP shelly_up Whether the status of the device could be fetched.")
+	fmt.Fprintln(w, "# TYPE shelly_up gauge")
+	if up {
+		fmt.Fprintln(w, "shelly_up 1")
+	} else {
+		fmt.Fprintln(w, "shelly_up 0")
+	}
+	for _, m := range relayMetrics {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", m.name, m.help, m.name, m.kind)
+		for _, sw := range deviceStatus.Switches {
+			value, ok := m.value(sw)
+			if !ok {
+				continue
+			}
+			fmt.Fprintf(w, "%s{id=\"%d\",name=\"%s\"} %g\n", m.name, sw.ID, escapeLabel(names[sw.ID]), value)
+		}
+	}
+}
+
+type metricsFlags struct {
+	fs     *flag.FlagSet
+	device *deviceFlags
+	listen *string
+}
+
+func newMetricsFlags() *metricsFlags {
+	fs := flag.NewFlagSet("metrics", flag.ExitOnError)
+	fs.Usage = usage_metrics
+	return &metricsFlags{
+		fs:     fs,
+		device: addDeviceFlags(fs),
+		listen: fs.String("listen", DefaultMetricsListen, "address of the metrics server"),
+	}
+}
+
+func metrics(ctx context.Context) int {
+	f := newMetricsFlags()
+	device, listen := f.device, f.listen
+	args := parseArgs(f.fs, os.Args[2:])
+	if len(args) != 0 {
+		usage_metrics()
+		os.Exit(exitUsage)
+	}
+	client, uri, err := device.connect(ctx)
+	if err != nil {
+		fatal(err)
+	}
+	defer client.Close()
+
+	// Names of relays rarely change, so they are fetched only once.
+	deviceStatus, err := shelly.GetStatus(ctx, client, uri)
+	if err != nil {
+		fatal(err)
+	}
+	names := relayNames(ctx, client, uri, deviceStatus)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		deviceStatus, err := shelly.GetStatus(r.Context(), client, uri)
+		if err != nil {
+			slog.Warn("Fetching status failed", "err", err)
+		}
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		writeMetrics(w, deviceStatus, names, err == nil)
+	})
+	server := &http.Server{Addr: *listen, Handler: mux}
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		server.Shutdown(shutdownCtx)
+	}()
+	slog.Info("Serving metrics", "url", "http://"+*listen+"/metrics")
+	err = server.ListenAndServe()
+	if err != nil && err != http.ErrServerClosed {
+		fatal(err)
+	}
+	return exitOK
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+// DefaultMQTTTopic is the default topic of the summary published by onoff.
+const DefaultMQTTTopic = "shelly/schedules"
+
+type mqttFlags struct {
+	broker   *string
+	topic    *string
+	user     *string
+	password *string
+}
+
+// addMQTTFlags adds flags for publishing summary to MQTT broker.
+func addMQTTFlags(fs *flag.FlagSet) *mqttFlags {
+	return &mqttFlags{
+		broker:   fs.String("mqtt-broker", "", "MQTT broker as <host>[:<port>] to publish summary to"),
+		topic:    fs.String("mqtt-topic", DefaultMQTTTopic, "MQTT topic of the summary"),
+		user:     fs.String("mqtt-user", "", "user name for MQTT broker"),
+		password: fs.String("mqtt-password", "", "password for MQTT broker"),
+	}
+}
+
+func usage_mqtt_options() {
+	fmt.Println("  --mqtt-broker")
+	fmt.Println("              Publish summary to MQTT broker <host>[:<port>], overrides")
+	fmt.Println("              SHELLY_MQTT_BROKER")
+	fmt.Println("  --mqtt-topic")
+	fmt.Println("              MQTT topic of the summary (default " + DefaultMQTTTopic + ")")
+	fmt.Println("  --mqtt-user, --mqtt-password")
+	fmt.Println("              Credentials for MQTT broker, override SHELLY_MQTT_USER and")
+	fmt.Println("              SHELLY_MQTT_PASS")
+}
+
+// OnOffSummary is the summary of onoff command published to MQTT.
+type OnOffSummary struct {
+	Time    time.Time     `json:"time"`
+	Results []OnOffResult `json:"results"`
+}
+
+// publish publishes the message to the broker, if given with flags or
+// environment variables. Does nothing if the broker is not set.
+func (f *mqttFlags) publish(message interface{}) error {
+	broker := *f.broker
+	if broker == "" {
+		broker = os.Getenv("SHELLY_MQTT_BROKER")
+	}
+	if broker == "" {
+		return nil
+	}
+	user := *f.user
+	if user == "" {
+		user = os.Getenv("SHELLY_MQTT_USER")
+	}
+	password := *f.password
+	if password == "" {
+		password = os.Getenv("SHELLY_MQTT_PASS")
+	}
+	payload, err := json.Marshal(message)
+	if err != nil {
+		return err
+	}
+	return mqttPublish(broker, user, password, *f.topic, payload)
+}
+
+// mqttString encodes string as MQTT UTF-8 string, prefixed with its length.
+func mqttString(s string) []byte {
+	return append([]byte{byte(len(s) >> 8), byte(len(s))}, s...)
+}
+
+// mqttPacket returns the packet with fixed header of given type and flags.
+func mqttPacket(header byte, body []byte) []byte {
+	packet := []byte{header}
+	n := len(body)
+	for {
+		b := byte(n % 128)
+		n /= 128
+		if n > 0 {
+			b |= 0x80
+		}
+		packet = append(packet, b)
+		if n == 0 {
+			break
+		}
+	}
+	return append(packet, body...)
+}
+
+// mqttPublish connects to the broker with MQTT 3.1.1, publishes the payload
+// to topic with QoS 0 and disconnects.
+func mqttPublish(broker string, user string, password string, topic string, payload []byte) error {
+	broker = strings.TrimPrefix(broker, "tcp://")
+	if _, _, err := net.SplitHostPort(broker); err != nil {
+		broker = net.JoinHostPort(broker, "1883")
+	}
+	conn, err := net.DialTimeout("tcp", broker, 10*time.Second)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+
+	flags := byte(0x02) // clean session
+	body := append(mqttString("MQTT"), 4, 0, 0, 60)
+	body = append(body, mqttString(fmt.Sprintf("shelly-%d", time.Now().UnixNano()%1000000))...)
+	if user != "" {
+		flags |= 0x80
+		body = append(body, mqttString(user)...)
+		if password != "" {
+			flags |= 0x40
+			body = append(body, mqttString(password)...)
+		}
+	}
+	body[7] = flags
+	if _, err := conn.Write(mqttPacket(0x10, body)); err != nil {
+		return err
+	}
+	connack := make([]byte, 4)
+	if _, err := io.ReadFull(conn, connack); err != nil {
+		return err
+	}
+	if connack[0] != 0x20 {
+		return errors.New("unexpected response from MQTT broker " + broker)
+	}
+	if connack[3] != 0 {
+		return fmt.Errorf("MQTT broker %s refused connection with code %d", broker, connack[3])
+	}
+	publish := append(mqttString(topic), payload...)
+	if _, err := conn.Write(mqttPacket(0x30, publish)); err != nil {
+		return err
+	}
+	_, err = conn.Write([]byte{0xe0, 0})
+	return err
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"testing"
+)
+
+// readMQTTPacket reads a packet and returns its fixed header and body.
+func readMQTTPacket(r *bufio.Reader) (byte, []byte, error) {
+	header, err := r.ReadByte()
+	if err != nil {
+		return 0, nil, err
+	}
+	length, multiplier := 0, 1
+	for i := 0; ; i++ {
+		b, err := r.ReadByte()
+		if err != nil {
+			return 0, nil, err
+		}
+		if i == 4 {
+			return 0, nil, errors.New("remaining length too long")
+		}
+		length += int(b&0x7f) * multiplier
+		multiplier *= 128
+		if b&0x80 == 0 {
+			break
+		}
+	}
+	body := make([]byte, length)
+	_, err = io.ReadFull(r, body)
+	return header, body, err
+}
+
+func TestMQTTRemainingLength(t *testing.T) {
+	tests := []struct {
+		length int
+		want   []byte
+	}{
+		{0, []byte{0x00}},
+		{127, []byte{0x7f}},
+		{128, []byte{0x80, 0x01}},
+		{321, []byte{0xc1, 0x02}},
+		{16383, []byte{0xff, 0x7f}},
+		{16384, []byte{0x80, 0x80, 0x01}},
+		{2097151, []byte{0xff, 0xff, 0x7f}},
+		{2097152, []byte{0x80, 0x80, 0x80, 0x01}},
+	}
+	for _, tt := range tests {
+		body := bytes.Repeat([]byte{'x'}, tt.length)
+		packet := mqttPacket(0x30, body)
+		if packet[0] != 0x30 {
+			t.Errorf("length %d: got header %#x", tt.length, packet[0])
+		}
+		if got := packet[1 : 1+len(tt.want)]; !bytes.Equal(got, tt.want) {
+			t.Errorf("length %d: got remaining length % x, want % x", tt.length, got, tt.want)
+		}
+		if len(packet) != 1+len(tt.want)+tt.length {
+			t.Errorf("length %d: got packet of %d bytes", tt.length, len(packet))
+		}
+		header, decoded, err := readMQTTPacket(bufio.NewReader(bytes.NewReader(packet)))
+		if err != nil || header != 0x30 || !bytes.Equal(decoded, body) {
+			t.Errorf("length %d: packet does not decode: %v", tt.length, err)
+		}
+	}
+}
+
+func TestMQTTString(t *testing.T) {
+	if got := mqttString("MQTT"); !bytes.Equal(got, []byte{0, 4, 'M', 'Q', 'T', 'T'}) {
+		t.Errorf("got % x", got)
+	}
+	if got := mqttString(strings.Repeat("a", 300)); got[0] != 1 || got[1] != 44 || len(got) != 302 {
+		t.Errorf("got length prefix % x of %d bytes", got[:2], len(got))
+	}
+}
+
+// mqttBroker is a fake broker answering CONNECT with connack and recording
+// the packets received from a single client.
+type mqttBroker struct {
+	listener net.Listener
+	packets  chan []byte
+}
+
+func newMQTTBroker(t *testing.T, connack []byte) *mqttBroker {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	broker := &mqttBroker{listener, make(chan []byte, 10)}
+	go func() {
+		defer close(broker.packets)
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		r := bufio.NewReader(conn)
+		for {
+			header, body, err := readMQTTPacket(r)
+			if err != nil {
+				return
+			}
+			broker.packets <- append([]byte{header}, body...)
+			if header == 0x10 {
+				conn.Write(connack)
+			}
+		}
+	}()
+	return broker
+}
+
+func (b *mqttBroker) received() [][]byte {
+	packets := [][]byte{}
+	for packet := range b.packets {
+		packets = append(packets, packet)
+	}
+	return packets
+}
+
+func TestMQTTPublish(t *testing.T) {
+	broker := newMQTTBroker(t, []byte{0x20, 0x02, 0x00, 0x00})
+	err := mqttPublish("tcp://"+broker.listener.Addr().String(), "user", "secret", "shelly/schedules", []byte(`{"results": []}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	packets := broker.received()
+	if len(packets) != 3 {
+		t.Fatalf("got %d packets, want CONNECT, PUBLISH and DISCONNECT", len(packets))
+	}
+	connect := packets[0]
+	if connect[0] != 0x10 || !bytes.HasPrefix(connect[1:], append(mqttString("MQTT"), 4, 0xc2, 0, 60)) {
+		t.Errorf("got CONNECT % x, want protocol MQTT 3.1.1 with user, password and clean session", connect)
+	}
+	if !bytes.HasSuffix(connect, append(mqttString("user"), mqttString("secret")...)) {
+		t.Errorf("got CONNECT % x, want credentials at end", connect)
+	}
+	if want := append([]byte{0x30}, append(mqttString("shelly/schedules"), `{"results": []}`...)...); !bytes.Equal(packets[1], want) {
+		t.Errorf("got PUBLISH %q, want %q", packets[1], want)
+	}
+	if !bytes.Equal(packets[2], []byte{0xe0}) {
+		t.Errorf("got DISCONNECT % x", packets[2])
+	}
+}
+
+func TestMQTTConnackError(t *testing.T) {
+	tests := []struct {
+		connack []byte
+		err     string
+	}{
+		{[]byte{0x20, 0x02, 0x00, 0x01}, "refused connection with code 1"},
+		{[]byte{0x20, 0x02, 0x00, 0x04}, "refused connection with code 4"},
+		{[]byte{0x20, 0x02, 0x00, 0x05}, "refused connection with code 5"},
+		{[]byte{0x30, 0x02, 0x00, 0x00}, "unexpected response"},
+	}
+	for _, tt := range tests {
+		broker := newMQTTBroker(t, tt.connack)
+		addr := broker.listener.Addr().String()
+		err := mqttPublish(addr, "", "", DefaultMQTTTopic, []byte("{}"))
+		if err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("CONNACK % x: got error %v, want %s", tt.connack, err, tt.err)
+		}
+		// Nothing is published after a refused connection.
+		for _, packet := range broker.received() {
+			if packet[0] == 0x30 {
+				t.Errorf("CONNACK % x: published %q", tt.connack, packet)
+			}
+		}
+	}
+}
@@ -0,0 +1,986 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/ahojukka5/shelly"
+)
+
+func usage_onoff() {
+	fmt.Printf("Usage: %s onoff [options] <relays> <timerange>\n", appName)
+	fmt.Printf("       %s onoff [options] [date] <relays>=<timerange>...\n", appName)
+	fmt.Printf("       %s onoff [options] --all <timerange>\n", appName)
+	fmt.Printf("       %s onoff [options] --at <datetime> --duration <duration> <relays>\n\n", appName)
+	fmt.Println("  relays      Relay id or name, or list of them")
+	fmt.Println("  timerange   Date/time range, or comma separated list of ranges which do not")
+	fmt.Println("              overlap or touch")
+	fmt.Println("  date        Date of the ranges given per relay (default today)")
+	usage_device_options()
+	fmt.Println("  --all       Schedule all relays of the device instead of giving <relays>")
+	fmt.Println("  --keep, --no-delete")
+	fmt.Println("              Keep existing schedules instead of deleting them")
+	fmt.Println("  --clear, --delete-all")
+	fmt.Println("              Delete all existing schedules, not only those created by onoff")
+	fmt.Println("  --update    Update schedules created earlier by onoff in place instead of")
+	fmt.Println("              deleting them, keeping the ids of schedules with the same calls")
+	fmt.Println("  --dry-run   Print schedules without sending them to device")
+	fmt.Println("  --confirm   Print the schedules to be deleted and created, and ask for")
+	fmt.Println("              confirmation before changing each device")
+	fmt.Println("  --yes       Do not ask for confirmation with --confirm, e.g. in scripts")
+	fmt.Println("  --offset    Time between schedules of relays with consecutive ids (default 2s)")
+	fmt.Println("  --repeat    Repeat schedules weekly: daily, weekdays, weekends or list of")
+	fmt.Println("              weekday abbreviations, e.g. mon,wed,fri")
+	fmt.Println("  --disabled  Create schedules disabled, see enable-schedule")
+	fmt.Println("  --method    RPC method switching the relays, called with params id and on,")
+	fmt.Println("              e.g. Light.Set (default Switch.Set); ids are validated only for")
+	fmt.Println("              Switch.Set")
+	fmt.Println("  --params    Extra params of the calls as JSON object, e.g. '{\"brightness\":50}'")
+	fmt.Println("  --jitter    Shift each on and off time by a random duration up to the given")
+	fmt.Println("              bound, e.g. 10m, in addition to --offset")
+	fmt.Println("  --seed      Seed of the random shifts of --jitter, giving the same times on")
+	fmt.Println("              every run (default random, logged for repeating the run)")
+	fmt.Println("  --strict    Fail instead of warning if a schedule is in the past and would")
+	fmt.Println("              never fire; schedules repeating with --repeat are not checked")
+	fmt.Println("  --overnight Accept ranges ending before they start, e.g. 22..6, turning relays")
+	fmt.Println("              off on the following day")
+	fmt.Println("  --on-only   Only turn relays on at the start of the range")
+	fmt.Println("  --off-only  Only turn relays off at the end of the range")
+	fmt.Println("  --no-validate")
+	fmt.Println("              Do not check that relays exist on the device")
+	fmt.Println("  --lat, --lon")
+	fmt.Println("              Coordinates of the device for sunrise and sunset, override the")
+	fmt.Println("              lat and lon of config file (default location of the device)")
+	fmt.Println("  --tz        Time zone of dates and times as IANA name, e.g. Europe/Helsinki,")
+	fmt.Println("              or local for the time zone of this computer (default time zone")
+	fmt.Println("              of the first device, or local if not available)")
+	fmt.Println("  --at        Turn relays on at date and time YYYY-MM-DD HH:MM[:SS] instead of")
+	fmt.Println("              giving <timerange>")
+	fmt.Println("  --duration  Turn relays off after duration, used with --at")
+	fmt.Println("  --no-rollback")
+	fmt.Println("              Leave the schedules already created if creating the rest fails")
+	fmt.Println("  --rate      Maximum number of requests per second when creating schedules,")
+	fmt.Println("              e.g. 2 for slow devices (default 5, 0 disables the limit)")
+	fmt.Println("  --concurrency")
+	fmt.Println("              Number of schedules created in parallel (default 1)")
+	fmt.Println("  --max-schedules")
+	fmt.Println("              Abort if the device would have more schedules, including kept")
+	fmt.Println("              ones (default 20, 0 disables the check)")
+	fmt.Println("  --label     Label the created schedules, shown by list-schedules; labels are")
+	fmt.Println("              stored locally in state files in shelly of user cache directory")
+	fmt.Println("              (or SHELLY_STATE_DIR)")
+	usage_mqtt_options()
+	fmt.Print("\nExamples:\n\n")
+	fmt.Printf("  %s onoff 0,1,2 today 17..18\n", appName)
+	fmt.Printf("  %s onoff 0 tomorrow 2..3\n", appName)
+	fmt.Printf("  %s onoff --all today 17..18\n", appName)
+	fmt.Printf("  %s onoff boiler,pump today 17..18\n", appName)
+	fmt.Printf("  %s onoff 1 today 17:30..18:15\n", appName)
+	fmt.Printf("  %s onoff 0 today 8..9,17..18\n", appName)
+	fmt.Printf("  %s onoff 0=8..9 1=17..18\n", appName)
+	fmt.Printf("  %s onoff tomorrow boiler=5..7 pump,2=17..18\n", appName)
+	fmt.Printf("  %s onoff 1 today 09:00:05..09:00:20\n", appName)
+	fmt.Printf("  %s onoff 0 2024-06-01 17..18\n", appName)
+	fmt.Printf("  %s onoff 0 saturday 8..9\n", appName)
+	fmt.Printf("  %s onoff 0 today +2h..+4h\n", appName)
+	fmt.Printf("  %s onoff 0 now +1h..+2h\n", appName)
+	fmt.Printf("  %s onoff --gen 1 0 now now..+30m\n", appName)
+	fmt.Printf("  %s onoff --overnight 0 today 22..6\n", appName)
+	fmt.Printf("  %s onoff 0 today sunset-30m..sunrise+30m\n", appName)
+	fmt.Printf("  %s onoff --lat 60.17 --lon 24.94 0 today sunset..23\n", appName)
+	fmt.Printf("  %s onoff --repeat weekdays 0 today 6:30..7:30\n", appName)
+	fmt.Printf("  %s onoff --off-only 0 today 17..23\n", appName)
+	fmt.Printf("  %s onoff --keep --label heating 0 today 5..7\n", appName)
+	fmt.Printf("  %s onoff --confirm 0 today 17..18\n", appName)
+	fmt.Printf("  %s onoff --method Light.Set --params '{\"brightness\":50}' 0 today 17..23\n", appName)
+	fmt.Printf("  %s onoff 0 --at \"2024-06-01 17:00:00\" --duration 1h\n", appName)
+	fmt.Printf("  %s onoff --host 192.168.1.50,192.168.1.51 0 today 17..18\n", appName)
+	fmt.Printf("  %s onoff --device kitchen 0 today 17..18\n", appName)
+	fmt.Print("\n\n")
+	fmt.Println("Note 1: by default, schedules created earlier by onoff are deleted before setting")
+	fmt.Println("        new ones, use --keep to append new schedules to existing ones, or")
+	fmt.Println("        --clear to delete all schedules of the device. Schedules identical to")
+	fmt.Println("        the new ones are kept as such, so running the same command twice")
+	fmt.Println("        changes nothing.")
+	fmt.Println("Note 2: an offset to time is set according to formula <relay_id>*<offset>, where")
+	fmt.Println("        <offset> is 2s by default. With --offset 0, relays switched at the same time")
+	fmt.Println("        share a single schedule on the device.")
+	fmt.Println("Note 3: with several hosts, the same schedules are set to each of them.")
+	fmt.Println("Note 4: sunrise and sunset are computed for the given date from the coordinates of")
+	fmt.Println("        the device, which are required. With --repeat, the same times are used")
+	fmt.Println("        every week. A range ending at sunrise before its start, e.g.")
+	fmt.Println("        sunset..sunrise, ends on the following day without --overnight.")
+	fmt.Println("Note 5: relay names, and relays with --all, are resolved to ids on the first")
+	fmt.Println("        device.")
+	fmt.Println("Note 6: on Gen1 devices, a range starting now turns relays on with a")
+	fmt.Println("        timer. Other ranges need --repeat, replacing the weekly schedule rules")
+	fmt.Println("        of the relays, with the precision of a minute.")
+	fmt.Println("Note 7: with <relays>=<timerange>, each relay gets its own ranges, while the")
+	fmt.Println("        offset of Note 2 still applies. The same relay may be given several times.")
+}
+
+// onoffJob holds the parsed arguments of onoff command.
+type onoffJob struct {
+	relayIDs     []int
+	date         time.Time
+	offsets      []shelly.TimeOffset
+	relayOffsets map[int][]shelly.TimeOffset
+	opts         shelly.ScheduleOptions
+	jitter       time.Duration
+	seed         int64
+	strict       bool
+	keep         bool
+	deleteAll    bool
+	update       bool
+	confirm      bool
+	yes          bool
+	dryRun       bool
+	noValidate   bool
+	maxSchedules int
+	label        string
+	mqtt         *mqttFlags
+}
+
+// createdSchedules returns the ids of existing schedules created by onoff
+// earlier, i.e. schedules recorded in the state whose calls all switch a relay
+// with params id and on. The calls are checked in case the device has reused
+// the id of a deleted schedule for a schedule created by other means.
+func createdSchedules(jobs []shelly.ScheduleJob, recorded map[int]string) []int {
+	ids := []int{}
+	for _, existing := range jobs {
+		if _, ok := recorded[existing.ID]; !ok || len(existing.Calls) == 0 {
+			continue
+		}
+		matches := true
+		for _, call := range existing.Calls {
+			_, hasID := call.Params["id"].(float64)
+			_, hasOn := call.Params["on"].(bool)
+			if !hasID || !hasOn {
+				matches = false
+			}
+		}
+		if matches {
+			ids = append(ids, existing.ID)
+		}
+	}
+	return ids
+}
+
+// run sets the schedules to a single device and returns the schedules set,
+// see appliedSchedules. Unless --keep or --delete-all is given, schedules created by onoff
+// earlier are kept if identical to the new ones, or with --update, updated in
+// place where possible, and the rest of them are deleted, see
+// shelly.SyncPlannedSchedules. The state of the device is updated to match the
+// deleted and created schedules.
+func (job onoffJob) run(ctx context.Context, client *shelly.Client, uri string, state *State) ([]shelly.ScheduleJob, error) {
+	// The status is fetched once, serving both as connection check and for
+	// validating the relays.
+	deviceStatus, err := shelly.GetStatus(ctx, client, uri)
+	if err != nil {
+		return nil, err
+	}
+
+	if !job.noValidate && job.opts.Method == shelly.DefaultMethod {
+		err = shelly.ValidateRelays(deviceStatus, job.relayIDs)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	plan := job.plan()
+	count := shelly.ScheduleCount(plan, job.opts)
+	reused := []shelly.ScheduleJob{}
+	if !job.deleteAll {
+		jobs, err := shelly.ScheduleList(ctx, client, uri)
+		if err != nil {
+			return nil, err
+		}
+		if !job.keep {
+			created := createdSchedules(jobs, state.Schedules)
+			remaining := []shelly.ScheduleJob{}
+			for _, existing := range jobs {
+				if containsInt(created, existing.ID) {
+					reused = append(reused, existing)
+				} else {
+					remaining = append(remaining, existing)
+				}
+			}
+			jobs = remaining
+		}
+		for _, existing := range shelly.ScheduleCollisions(jobs, plan, job.opts) {
+			slog.Warn("Existing schedule has the same timespec", "id", existing.ID, "timespec", existing.TimeSpec)
+		}
+		count += len(jobs)
+	}
+	if job.maxSchedules > 0 && count > job.maxSchedules {
+		return nil, fmt.Errorf("device would have %d schedules, which exceeds the maximum %d, see --max-schedules", count, job.maxSchedules)
+	}
+	changes := shelly.ScheduleChanges{Deleted: []shelly.ScheduleJob{}, Created: shelly.PlanSchedules(plan, job.opts)}
+	if !job.keep && !job.deleteAll {
+		changes = shelly.DiffSchedules(changes.Created, reused, job.update)
+	}
+	if job.confirm && !job.dryRun {
+		if job.deleteAll {
+			changes.Deleted, err = shelly.ScheduleList(ctx, client, uri)
+			if err != nil {
+				return nil, err
+			}
+		}
+		if err := job.approve(uri, job.describe(plan, changes)); err != nil {
+			return nil, err
+		}
+	}
+	if job.deleteAll {
+		err = shelly.ScheduleDeleteAll(ctx, client, uri)
+		if err != nil {
+			return nil, err
+		}
+		state.Schedules = map[int]string{}
+	}
+	if !job.keep && !job.deleteAll {
+		ids, deleted, err := shelly.SyncPlannedSchedules(ctx, client, uri, job.date, plan, job.opts, reused, job.update)
+		state.remove(deleted)
+		state.set(ids, job.label)
+		if err != nil {
+			return nil, err
+		}
+		return appliedSchedules(ids, changes, reused), nil
+	}
+
+	ids, err := shelly.CreatePlannedSchedules(ctx, client, uri, job.date, plan, job.opts)
+	if err != nil {
+		return nil, err
+	}
+	state.set(ids, job.label)
+	return appliedSchedules(ids, shelly.ScheduleChanges{Created: changes.Created}, nil), nil
+}
+
+// appliedSchedules pairs the ids returned by shelly.SyncPlannedSchedules or
+// shelly.CreatePlannedSchedules with the changes, giving the schedules set to
+// the device: the kept, updated and created ones in this order. Returns an
+// empty list in dry run, when there are no ids.
+func appliedSchedules(ids []int, changes shelly.ScheduleChanges, existing []shelly.ScheduleJob) []shelly.ScheduleJob {
+	applied := []shelly.ScheduleJob{}
+	n := len(changes.Kept) + len(changes.Updated)
+	if len(ids) != n+len(changes.Created) {
+		return applied
+	}
+	for _, id := range changes.Kept {
+		for _, existing := range existing {
+			if existing.ID == id {
+				applied = append(applied, existing)
+			}
+		}
+	}
+	applied = append(applied, changes.Updated...)
+	for i, schedule := range changes.Created {
+		applied = append(applied, shelly.ScheduleJob{ID: ids[n+i], Enable: schedule.Enable, TimeSpec: schedule.TimeSpec, Calls: schedule.Calls})
+	}
+	return applied
+}
+
+// callID returns param id of the call, which is int in planned calls and
+// float64 in calls listed by the device.
+func callID(call shelly.Call) (int, bool) {
+	switch id := call.Params["id"].(type) {
+	case int:
+		return id, true
+	case float64:
+		return int(id), true
+	}
+	return 0, false
+}
+
+// relayResults returns the planned times of each relay, together with the
+// ids of the applied schedules calling the relay.
+func (job onoffJob) relayResults(plan []shelly.OnOffSchedule, applied []shelly.ScheduleJob) []RelaySchedulesResult {
+	results := []RelaySchedulesResult{}
+	index := map[int]int{}
+	for _, p := range plan {
+		i, ok := index[p.Relay]
+		if !ok {
+			i = len(results)
+			index[p.Relay] = i
+			results = append(results, RelaySchedulesResult{ID: p.Relay, Ranges: []RangeResult{}, ScheduleIDs: []int{}})
+		}
+		on, off := p.On, p.Off
+		r := RangeResult{On: &on, Off: &off}
+		if job.opts.OnOnly {
+			r.Off = nil
+		}
+		if job.opts.OffOnly {
+			r.On = nil
+		}
+		results[i].Ranges = append(results[i].Ranges, r)
+	}
+	for _, schedule := range applied {
+		for _, call := range schedule.Calls {
+			id, ok := callID(call)
+			if i, found := index[id]; ok && found && !containsInt(results[i].ScheduleIDs, schedule.ID) {
+				results[i].ScheduleIDs = append(results[i].ScheduleIDs, schedule.ID)
+			}
+		}
+	}
+	return results
+}
+
+// describe returns the planned times of relays and the changes to the
+// schedules of device, shown for confirmation.
+func (job onoffJob) describe(plan []shelly.OnOffSchedule, changes shelly.ScheduleChanges) []string {
+	const format = "2006-01-02 15:04:05"
+	lines := []string{}
+	for _, p := range plan {
+		switch {
+		case job.opts.OnOnly:
+			lines = append(lines, fmt.Sprintf("relay %d on at %s", p.Relay, p.On.Format(format)))
+		case job.opts.OffOnly:
+			lines = append(lines, fmt.Sprintf("relay %d off at %s", p.Relay, p.Off.Format(format)))
+		default:
+			lines = append(lines, fmt.Sprintf("relay %d on between %s ... %s", p.Relay, p.On.Format(format), p.Off.Format(format)))
+		}
+	}
+	for _, existing := range changes.Deleted {
+		lines = append(lines, fmt.Sprintf("delete schedule %d at %q: %s", existing.ID, existing.TimeSpec, formatCalls(existing.Calls, nil)))
+	}
+	for _, updated := range changes.Updated {
+		lines = append(lines, fmt.Sprintf("update schedule %d to %q: %s", updated.ID, updated.TimeSpec, formatCalls(updated.Calls, nil)))
+	}
+	for _, schedule := range changes.Created {
+		lines = append(lines, fmt.Sprintf("create schedule at %q: %s", schedule.TimeSpec, formatCalls(schedule.Calls, nil)))
+	}
+	if len(changes.Kept) > 0 {
+		lines = append(lines, fmt.Sprintf("keep identical schedules %v", changes.Kept))
+	}
+	return lines
+}
+
+// approve prints the changes to the device and asks for confirmation, unless
+// --yes is given. Returns an error if not confirmed.
+func (job onoffJob) approve(uri string, lines []string) error {
+	fmt.Fprintf(os.Stderr, "Changes to %s:\n", uri)
+	for _, line := range lines {
+		fmt.Fprintf(os.Stderr, "  %s\n", line)
+	}
+	if !job.yes && !confirm("Apply the changes?") {
+		return errors.New("changes cancelled")
+	}
+	return nil
+}
+
+// plan plans the schedules of all time ranges, either shared by all relays
+// or given per relay. With --jitter, the times are shifted randomly, giving
+// the same times on every call with the seed of the job.
+func (job onoffJob) plan() []shelly.OnOffSchedule {
+	if job.relayOffsets == nil {
+		plan := shelly.PlanOnOffSchedules(job.relayIDs, job.date, job.offsets, job.opts)
+		return shelly.JitterPlan(plan, job.jitter, job.seed)
+	}
+	plan := []shelly.OnOffSchedule{}
+	for _, id := range job.relayIDs {
+		plan = append(plan, shelly.PlanOnOffSchedules([]int{id}, job.date, job.relayOffsets[id], job.opts)...)
+	}
+	return shelly.JitterPlan(plan, job.jitter, job.seed)
+}
+
+// gen1TimerWindow is how far from now a range may start to be set with the
+// timer of Gen1 relays.
+const gen1TimerWindow = time.Minute
+
+// checkGen1Timer checks that the plan can be set with the timer of Gen1
+// relays, which turns a relay on now and off after a duration. The schedule
+// rules of Gen1 devices always repeat weekly, so one-shot ranges are possible
+// only as a single range per relay starting now and not yet over.
+func checkGen1Timer(plan []shelly.OnOffSchedule, opts shelly.ScheduleOptions, now time.Time) error {
+	const hint = "Gen1 devices support one-shot ranges only starting now, use --repeat for weekly schedule rules"
+	if opts.OnOnly || opts.OffOnly {
+		return errors.New("flags --on-only and --off-only need --repeat: " + hint)
+	}
+	relays := map[int]bool{}
+	for _, p := range plan {
+		if relays[p.Relay] {
+			return fmt.Errorf("relay %d has several ranges: %s", p.Relay, hint)
+		}
+		relays[p.Relay] = true
+		if d := p.On.Sub(now); d < -gen1TimerWindow || d > gen1TimerWindow {
+			return fmt.Errorf("relay %d turns on at %s: %s", p.Relay, p.On.Format("2006-01-02 15:04:05"), hint)
+		}
+		if !p.Off.After(now) {
+			return fmt.Errorf("relay %d turns off at %s, which is already over", p.Relay, p.Off.Format("2006-01-02 15:04:05"))
+		}
+	}
+	return nil
+}
+
+// runGen1 sets the schedules to a single Gen1 device. Without --repeat, a
+// range starting now is set with the timer of the relay, turning it on now
+// and off after the duration, see checkGen1Timer. With --repeat, the schedule
+// rules of the relays are replaced, or appended to with --keep. Gen1 devices
+// have no schedule ids.
+func (job onoffJob) runGen1(ctx context.Context, client *shelly.Client, uri string) error {
+	plan := job.plan()
+	now := time.Now()
+	if len(job.opts.Repeat) == 0 {
+		if err := checkGen1Timer(plan, job.opts, now); err != nil {
+			return usageError{err}
+		}
+		if job.confirm && !job.dryRun {
+			lines := []string{}
+			for _, p := range plan {
+				lines = append(lines, fmt.Sprintf("turn relay %d on for %s with timer", p.Relay, p.Off.Sub(now).Round(time.Second)))
+			}
+			if err := job.approve(uri, lines); err != nil {
+				return err
+			}
+		}
+		for _, p := range plan {
+			slog.Info("Turning relay on with timer", "relay", p.Relay, "duration", p.Off.Sub(now).Round(time.Second))
+			if job.dryRun {
+				continue
+			}
+			if _, err := shelly.Gen1RelaySet(ctx, client, uri, p.Relay, "on", p.Off.Sub(now)); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	rules, err := shelly.Gen1ScheduleRules(plan, job.opts)
+	if err != nil {
+		return err
+	}
+	relayRules := map[int][]string{}
+	for _, id := range job.relayIDs {
+		relayRules[id] = rules[id]
+		if job.keep {
+			settings, err := shelly.Gen1GetRelaySettings(ctx, client, uri, id)
+			if err != nil {
+				return err
+			}
+			relayRules[id] = append(settings.ScheduleRules, rules[id]...)
+		}
+	}
+	if job.confirm && !job.dryRun {
+		lines := []string{}
+		for _, id := range job.relayIDs {
+			lines = append(lines, fmt.Sprintf("replace schedule rules of relay %d with %s", id, strings.Join(relayRules[id], ",")))
+		}
+		if err := job.approve(uri, lines); err != nil {
+			return err
+		}
+	}
+	for _, id := range job.relayIDs {
+		if err := shelly.Gen1SetScheduleRules(ctx, client, uri, id, relayRules[id], job.opts.Disabled); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func containsInt(list []int, x int) bool {
+	for _, y := range list {
+		if y == x {
+			return true
+		}
+	}
+	return false
+}
+
+// lookupLocation returns the time zone given with --tz flag, falling back to
+// the time zone configured to the device and then to the local time zone.
+func lookupLocation(ctx context.Context, tz string, d connection) (*time.Location, error) {
+	switch tz {
+	case "local":
+		return time.Local, nil
+	case "":
+		loc, err := shelly.DeviceTimezone(ctx, d.client, d.uri)
+		if err != nil {
+			slog.Warn("Time zone of device not available, using local time zone", "host", d.host, "err", err)
+			return time.Local, nil
+		}
+		if loc.String() != time.Local.String() {
+			slog.Info("Using time zone of device", "tz", loc, "host", d.host)
+		}
+		return loc, nil
+	}
+	loc, err := time.LoadLocation(tz)
+	if err != nil {
+		return nil, usageError{fmt.Errorf("invalid time zone: %w", err)}
+	}
+	return loc, nil
+}
+
+// lookupCoordinates returns the coordinates given with --lat and --lon flags,
+// falling back to the config file values and then to the location configured
+// to the device. Returns nil if the coordinates are not available.
+func lookupCoordinates(ctx context.Context, lat float64, lon float64, d connection) (*shelly.Coordinates, error) {
+	if math.IsNaN(lat) != math.IsNaN(lon) {
+		return nil, usageError{errors.New("flags --lat and --lon must be given together")}
+	}
+	if !math.IsNaN(lat) {
+		return &shelly.Coordinates{Lat: lat, Lon: lon}, nil
+	}
+	if d.config.Lat != nil && d.config.Lon != nil {
+		return &shelly.Coordinates{Lat: *d.config.Lat, Lon: *d.config.Lon}, nil
+	}
+	config, err := shelly.SysGetConfig(ctx, d.client, d.uri)
+	if err != nil {
+		return nil, err
+	}
+	if config.Location.Lat == nil || config.Location.Lon == nil {
+		return nil, usageError{errors.New("sunrise and sunset require the coordinates of the device: use --lat and --lon flags or set lat and lon in config file")}
+	}
+	return &shelly.Coordinates{Lat: *config.Location.Lat, Lon: *config.Location.Lon}, nil
+}
+
+// parseOnOffDate parses the date of onoff command.
+func parseOnOffDate(datestr string) (time.Time, error) {
+	date, err := shelly.ParseDate(datestr)
+	if err != nil {
+		return date, fmt.Errorf("invalid date: %w", err)
+	}
+	extraInfo := ""
+	if datestr == "now" {
+		extraInfo += " (now)"
+	}
+	if date == shelly.Yesterday() {
+		extraInfo += " (yesterday)"
+	}
+	if date == shelly.Today() {
+		extraInfo += " (today)"
+	}
+	if date == shelly.Tomorrow() {
+		extraInfo += " (tomorrow)"
+	}
+	slog.Info("Settings relays for date " + date.Format("2006-01-02") + extraInfo)
+	return date, nil
+}
+
+// parseDateRange parses the date and the time ranges of onoff command.
+func parseDateRange(datestr string, rangestr string) (time.Time, []shelly.TimeOffset, error) {
+	date, err := parseOnOffDate(datestr)
+	if err != nil {
+		return date, nil, err
+	}
+	offsets, err := shelly.ParseTimeRanges(rangestr)
+	if err != nil {
+		return date, nil, fmt.Errorf("invalid time range: %w", err)
+	}
+	return date, offsets, nil
+}
+
+// isRelayRange returns true if the argument is of the form
+// <relays>=<timerange>.
+func isRelayRange(arg string) bool {
+	return strings.Contains(arg, "=")
+}
+
+// parseRelayRanges parses the time ranges given per relay, e.g. 0=8..9 and
+// boiler,1=17..18, and returns the relay ids in the order given and the time
+// ranges of each relay. Relay names are resolved on the given device.
+func parseRelayRanges(ctx context.Context, d connection, args []string) ([]int, map[int][]shelly.TimeOffset, error) {
+	relayIDs := []int{}
+	ranges := map[int][]shelly.TimeOffset{}
+	for _, arg := range args {
+		i := strings.Index(arg, "=")
+		if i < 0 {
+			return nil, nil, usageError{fmt.Errorf("expected <relays>=<timerange>, got %q", arg)}
+		}
+		ids, err := shelly.ResolveRelays(ctx, d.client, d.uri, arg[:i])
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid relays: %w", err)
+		}
+		offsets, err := shelly.ParseTimeRanges(arg[i+1:])
+		if err != nil {
+			return nil, nil, usageError{fmt.Errorf("invalid time range of relays %s: %w", arg[:i], err)}
+		}
+		for _, id := range ids {
+			if !containsInt(relayIDs, id) {
+				relayIDs = append(relayIDs, id)
+			}
+			ranges[id] = append(ranges[id], offsets...)
+		}
+	}
+	return relayIDs, ranges, nil
+}
+
+// onoffFlags are the flags of onoff command, also accepted by batch command.
+type onoffFlags struct {
+	fs     *flag.FlagSet
+	device *deviceFlags
+	mqtt   *mqttFlags
+
+	keep, deleteAll, update, confirmChanges, yes, dryRun *bool
+	disabled, onOnly, offOnly, strict, overnight         *bool
+	noValidate, noRollback, all                          *bool
+	stagger, jitter, duration                            *time.Duration
+	repeat, method, params, tz, at, label                *string
+	seed                                                 *int64
+	concurrency, maxSchedules                            *int
+	rate, lat, lon                                       *float64
+}
+
+// newOnOffFlags defines the flags of onoff command. In batch, errors are
+// returned instead of exiting, and nothing is printed.
+func newOnOffFlags() *onoffFlags {
+	fs := flag.NewFlagSet("onoff", flag.ExitOnError)
+	f := &onoffFlags{fs: fs}
+	fs.Usage = usage_onoff
+	if inBatch {
+		fs.Init("onoff", flag.ContinueOnError)
+		fs.SetOutput(io.Discard)
+		fs.Usage = func() {}
+	}
+	f.device = addDeviceFlags(fs)
+	f.keep = fs.Bool("keep", false, "keep existing schedules instead of deleting them")
+	fs.BoolVar(f.keep, "no-delete", false, "alias of --keep")
+	f.deleteAll = fs.Bool("delete-all", false, "delete all existing schedules, not only those created by onoff")
+	fs.BoolVar(f.deleteAll, "clear", false, "alias of --delete-all")
+	f.update = fs.Bool("update", false, "update schedules created earlier in place instead of deleting them")
+	f.confirmChanges = fs.Bool("confirm", false, "print the changes and ask for confirmation")
+	f.yes = fs.Bool("yes", false, "do not ask for confirmation with --confirm")
+	f.dryRun = fs.Bool("dry-run", false, "print schedules without sending them to device")
+	f.stagger = fs.Duration("offset", shelly.DefaultStagger, "time between schedules of relays with consecutive ids")
+	f.repeat = fs.String("repeat", "", "repeat schedules weekly: daily, weekdays, weekends or list of weekdays")
+	f.disabled = fs.Bool("disabled", false, "create schedules disabled")
+	f.method = fs.String("method", shelly.DefaultMethod, "RPC method switching the relays")
+	f.params = fs.String("params", "", "extra params of the calls as JSON object")
+	f.onOnly = fs.Bool("on-only", false, "only turn relays on at the start of the range")
+	f.offOnly = fs.Bool("off-only", false, "only turn relays off at the end of the range")
+	f.jitter = fs.Duration("jitter", 0, "shift each on and off time by a random duration up to the given bound")
+	f.seed = fs.Int64("seed", 0, "seed of the random shifts of --jitter (default random)")
+	f.strict = fs.Bool("strict", false, "fail instead of warning if a schedule is in the past")
+	f.overnight = fs.Bool("overnight", false, "accept ranges ending before they start, turning relays off on the following day")
+	f.noValidate = fs.Bool("no-validate", false, "do not check that relays exist on the device")
+	f.noRollback = fs.Bool("no-rollback", false, "leave the schedules already created if creating the rest fails")
+	f.concurrency = fs.Int("concurrency", 1, "number of schedules created in parallel")
+	f.rate = fs.Float64("rate", shelly.DefaultRate, "maximum number of requests per second when creating schedules, 0 disables the limit")
+	f.lat = fs.Float64("lat", math.NaN(), "latitude of the device for sunrise and sunset")
+	f.lon = fs.Float64("lon", math.NaN(), "longitude of the device for sunrise and sunset")
+	f.tz = fs.String("tz", "", "time zone of dates and times, IANA name or local")
+	f.at = fs.String("at", "", "turn relays on at date and time YYYY-MM-DD HH:MM[:SS]")
+	f.duration = fs.Duration("duration", 0, "turn relays off after duration, used with --at")
+	f.maxSchedules = fs.Int("max-schedules", shelly.DefaultMaxSchedules, "maximum number of schedules on the device, 0 disables the check")
+	f.label = fs.String("label", "", "label of the created schedules")
+	f.all = fs.Bool("all", false, "schedule all relays of the device")
+	f.mqtt = addMQTTFlags(fs)
+	return f
+}
+
+// parseOnOff parses the arguments of onoff command and returns the job and
+// the devices to which the schedules are set.
+func parseOnOff(ctx context.Context, args []string) (onoffJob, []connection, error) {
+	f := newOnOffFlags()
+	args, err := parseArgsErr(f.fs, args)
+	if err != nil {
+		return onoffJob{}, nil, usageError{err}
+	}
+	if inBatch && *f.confirmChanges && !*f.yes {
+		return onoffJob{}, nil, usageError{errors.New("flag --confirm cannot be used in batch without --yes, the lines are read from stdin")}
+	}
+	perRelay := *f.at == "" && len(args) > 0 && (isRelayRange(args[0]) || (len(args) > 1 && isRelayRange(args[1])))
+	job := onoffJob{strict: *f.strict, keep: *f.keep, deleteAll: *f.deleteAll, update: *f.update, confirm: *f.confirmChanges, yes: *f.yes, dryRun: *f.dryRun, noValidate: *f.noValidate, maxSchedules: *f.maxSchedules, label: *f.label, mqtt: f.mqtt}
+	if *f.all {
+		// With --all, the relays are not given, so the arguments are
+		// shifted to keep their positions.
+		switch {
+		case perRelay:
+			return job, nil, usageError{errors.New("flag --all cannot be used with time ranges per relay")}
+		case (*f.at == "" && len(args) == 3) || (*f.at != "" && len(args) == 1):
+			return job, nil, usageError{errors.New("flag --all cannot be used with a list of relays")}
+		}
+		args = append([]string{""}, args...)
+	}
+	if *f.at != "" && len(args) != 1 {
+		if !inBatch {
+			usage_onoff()
+		}
+		return job, nil, usageError{fmt.Errorf("expected <relays> with --at, got %d arguments", len(args))}
+	}
+	if *f.at == "" && !perRelay && len(args) < 3 {
+		if !inBatch {
+			usage_onoff()
+		}
+		return job, nil, usageError{fmt.Errorf("expected <relays> <timerange>, got %d arguments", len(args))}
+	}
+	// The flags are checked before connecting to the devices, so that
+	// mistakes are reported without waiting for unreachable devices.
+	if *f.at != "" && *f.duration <= 0 {
+		return job, nil, usageError{errors.New("--at requires positive --duration")}
+	}
+	if *f.keep && *f.deleteAll {
+		return job, nil, usageError{errors.New("flags --keep and --clear are mutually exclusive")}
+	}
+	if *f.update && (*f.keep || *f.deleteAll) {
+		return job, nil, usageError{errors.New("flag --update cannot be used with --keep or --clear")}
+	}
+	if *f.onOnly && *f.offOnly {
+		return job, nil, usageError{errors.New("flags --on-only and --off-only are mutually exclusive")}
+	}
+	if *f.stagger < 0 {
+		return job, nil, usageError{errors.New("offset must not be negative: " + f.stagger.String())}
+	}
+	if *f.rate < 0 || math.IsNaN(*f.rate) {
+		return job, nil, usageError{fmt.Errorf("rate must not be negative: %g", *f.rate)}
+	}
+	if *f.concurrency < 1 {
+		return job, nil, usageError{fmt.Errorf("concurrency must be at least 1: %d", *f.concurrency)}
+	}
+	if *f.jitter < 0 {
+		return job, nil, usageError{errors.New("jitter must not be negative: " + f.jitter.String())}
+	}
+	job.opts = shelly.DefaultScheduleOptions()
+	job.opts.Stagger = *f.stagger
+	job.opts.Rate = *f.rate
+	job.opts.Concurrency = *f.concurrency
+	job.opts.Disabled = *f.disabled
+	job.opts.Method = *f.method
+	if *f.params != "" {
+		err = json.Unmarshal([]byte(*f.params), &job.opts.Params)
+		if err != nil {
+			return job, nil, usageError{errors.New("invalid params: " + *f.params + ", expected JSON object")}
+		}
+	}
+	job.opts.NoRollback = *f.noRollback
+	job.opts.OnOnly = *f.onOnly
+	job.opts.OffOnly = *f.offOnly
+	if *f.repeat != "" {
+		job.opts.Repeat, err = shelly.ParseRepeat(*f.repeat)
+		if err != nil {
+			return job, nil, usageError{fmt.Errorf("invalid repeat: %w", err)}
+		}
+	}
+	devices, err := f.device.connectAll(ctx)
+	if err != nil {
+		return job, nil, err
+	}
+	if *f.all {
+		job.relayIDs, err = shelly.AllRelays(ctx, devices[0].client, devices[0].uri)
+		if err != nil {
+			return job, nil, err
+		}
+	} else if !perRelay {
+		job.relayIDs, err = shelly.ResolveRelays(ctx, devices[0].client, devices[0].uri, args[0])
+		if err != nil {
+			return job, nil, fmt.Errorf("invalid relays: %w", err)
+		}
+	}
+	shelly.Location, err = lookupLocation(ctx, *f.tz, devices[0])
+	if err != nil {
+		return job, nil, err
+	}
+
+	// resolveRanges resolves the solar events of the time ranges, looking up
+	// the coordinates once when first needed, and validates the ranges. A
+	// range ending before its start is most likely reversed by accident, so
+	// overnight ranges are accepted only with --overnight.
+	var coords *shelly.Coordinates
+	resolveRanges := func(offsets []shelly.TimeOffset) error {
+		for i, offset := range offsets {
+			if offset.BeginEvent == "" && offset.EndEvent == "" {
+				continue
+			}
+			if coords == nil {
+				coords, err = lookupCoordinates(ctx, *f.lat, *f.lon, devices[0])
+				if err != nil {
+					return err
+				}
+			}
+			offsets[i], err = shelly.ResolveSolar(offset, job.date, coords)
+			if err != nil {
+				return err
+			}
+		}
+		for _, offset := range offsets {
+			if offset.Overnight() && !*f.overnight {
+				return usageError{fmt.Errorf("time range %s does not end after it starts: swap the times, or use --overnight to turn relays off on the following day", offset)}
+			}
+		}
+		if err := shelly.ValidateRanges(offsets); err != nil {
+			return usageError{err}
+		}
+		return nil
+	}
+
+	if *f.at != "" {
+		start, err := shelly.ParseDateTime(*f.at)
+		if err != nil {
+			return job, nil, usageError{fmt.Errorf("invalid --at: %w", err)}
+		}
+		date, offset := shelly.RangeAt(start, *f.duration)
+		job.date, job.offsets = date, []shelly.TimeOffset{offset}
+	} else if perRelay {
+		datestr, pairs := "today", args
+		if !isRelayRange(args[0]) {
+			datestr, pairs = args[0], args[1:]
+		}
+		job.date, err = parseOnOffDate(datestr)
+		if err != nil {
+			return job, nil, usageError{err}
+		}
+		job.relayIDs, job.relayOffsets, err = parseRelayRanges(ctx, devices[0], pairs)
+		if err != nil {
+			return job, nil, err
+		}
+		for _, id := range job.relayIDs {
+			if err := resolveRanges(job.relayOffsets[id]); err != nil {
+				return job, nil, fmt.Errorf("relay %d: %w", id, err)
+			}
+		}
+	} else {
+		job.date, job.offsets, err = parseDateRange(args[1], args[2])
+		if err != nil {
+			return job, nil, usageError{err}
+		}
+		if err := resolveRanges(job.offsets); err != nil {
+			return job, nil, err
+		}
+	}
+	job.jitter, job.seed = *f.jitter, *f.seed
+	if job.jitter > 0 {
+		seedSet := false
+		f.fs.Visit(func(fl *flag.Flag) {
+			if fl.Name == "seed" {
+				seedSet = true
+			}
+		})
+		if !seedSet {
+			job.seed = time.Now().UnixNano()
+		}
+		slog.Info("Shifting times randomly", "jitter", job.jitter, "seed", job.seed)
+	}
+	return job, devices, nil
+}
+
+// pastSchedules returns the planned on and off times before now, e.g. relay 0
+// on at 2024-06-01 08:00:00, which would never fire. Repeating schedules fire
+// again next week, so they are not checked.
+func (job onoffJob) pastSchedules(now time.Time) []string {
+	const format = "2006-01-02 15:04:05"
+	past := []string{}
+	if len(job.opts.Repeat) > 0 {
+		return past
+	}
+	for _, p := range job.plan() {
+		if !job.opts.OffOnly && p.On.Before(now) {
+			past = append(past, fmt.Sprintf("relay %d on at %s", p.Relay, p.On.Format(format)))
+		}
+		if !job.opts.OnOnly && p.Off.Before(now) {
+			past = append(past, fmt.Sprintf("relay %d off at %s", p.Relay, p.Off.Format(format)))
+		}
+	}
+	return past
+}
+
+// checkPast warns about the planned on and off times before now, see
+// pastSchedules. With --strict, an error is returned instead.
+func (job onoffJob) checkPast(now time.Time) error {
+	past := job.pastSchedules(now)
+	if len(past) > 0 && job.strict {
+		return usageError{fmt.Errorf("schedules in the past would never fire: %s", strings.Join(past, ", "))}
+	}
+	for _, schedule := range past {
+		slog.Warn("Schedule is in the past and will not fire: " + schedule)
+	}
+	return nil
+}
+
+// runOnOff sets the schedules to all devices and returns the results of each
+// device. Failures of single devices are reported in the results, while the
+// returned error is set only if the job could not be started at all.
+func runOnOff(ctx context.Context, args []string) ([]OnOffResult, error) {
+	job, devices, err := parseOnOff(ctx, args)
+	if err != nil {
+		return nil, err
+	}
+	if err := job.checkPast(time.Now()); err != nil {
+		return nil, err
+	}
+	// The warning is shown only once, so it is shown only once the job is
+	// known to be valid, see warnDefaultDelete.
+	if !job.keep && !job.deleteAll && !job.update {
+		warnDefaultDelete()
+	}
+
+	results := []OnOffResult{}
+	for _, d := range devices {
+		if len(devices) > 1 {
+			slog.Info("Setting schedules", "host", d.host)
+		}
+		d.client.DryRun = job.dryRun
+		if d.client.Gen == shelly.Gen1 {
+			err := job.runGen1(ctx, d.client, d.uri)
+			result := OnOffResult{Host: d.host, IDs: []int{}, Relays: job.relayResults(job.plan(), nil), DryRun: job.dryRun, err: err}
+			if err != nil {
+				slog.Error("Setting schedules failed", "host", d.host, "err", err)
+				result.Error = err.Error()
+			}
+			results = append(results, result)
+			continue
+		}
+		state, err := loadState(d.uri)
+		if err != nil {
+			slog.Warn("Schedules created earlier not known, starting with empty state", "host", d.host, "err", err)
+		}
+		applied, err := job.run(ctx, d.client, d.uri, state)
+		d.client.Close()
+		ids := []int{}
+		for _, schedule := range applied {
+			ids = append(ids, schedule.ID)
+		}
+		result := OnOffResult{Host: d.host, IDs: ids, Relays: job.relayResults(job.plan(), applied), Label: job.label, DryRun: job.dryRun, err: err}
+		if err != nil {
+			slog.Error("Setting schedules failed", "host", d.host, "err", err)
+			result.Error = err.Error()
+		} else if !job.dryRun {
+			slog.Info("Schedules set", "host", d.host, "ids", ids)
+		}
+		if !job.dryRun {
+			if err := state.save(); err != nil {
+				slog.Warn("Saving state failed", "host", d.host, "err", err)
+			}
+		}
+		results = append(results, result)
+	}
+	if !job.dryRun {
+		if err := job.mqtt.publish(OnOffSummary{time.Now(), results}); err != nil {
+			slog.Warn("Publishing summary to MQTT failed", "err", err)
+		}
+	}
+	return results, nil
+}
+
+func onoff(ctx context.Context) int {
+	results, err := runOnOff(ctx, os.Args[2:])
+	if err != nil {
+		return reportError(err)
+	}
+	failed := 0
+	var lastErr error
+	for _, result := range results {
+		if result.err != nil {
+			failed++
+			lastErr = result.err
+		}
+	}
+	if jsonOutput {
+		printJSON(OnOffOutput{Success: failed == 0, Results: results})
+	}
+	if failed > 0 {
+		slog.Error("Setting schedules failed", "failed", failed, "devices", len(results))
+		return exitCode(lastErr)
+	}
+	if len(results) > 0 && results[0].DryRun {
+		slog.Info("Dry run, nothing was sent to device!")
+		return exitOK
+	}
+	slog.Info("Everything done!")
+	return exitOK
+}
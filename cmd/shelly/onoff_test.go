@@ -0,0 +1,163 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ahojukka5/shelly"
+)
+
+// listedJobs are schedules as listed by Schedule.List, with numbers decoded
+// as float64.
+const listedJobs = `[
+	{"id": 1, "enable": true, "timespec": "0 0 17 * * *", "calls": [{"method": "Switch.Set", "params": {"id": 0, "on": true}}]},
+	{"id": 2, "enable": true, "timespec": "0 0 18 * * *", "calls": [{"method": "Switch.Set", "params": {"id": 0, "on": false}}, {"method": "Switch.Set", "params": {"id": 1, "on": false}}]},
+	{"id": 3, "enable": true, "timespec": "0 0 7 * * MON", "calls": [{"method": "Switch.Set", "params": {"id": 0, "on": true}}]},
+	{"id": 4, "enable": true, "timespec": "0 0 8 * * *", "calls": [{"method": "Light.Set", "params": {"id": 0, "brightness": 50}}]},
+	{"id": 5, "enable": true, "timespec": "0 0 9 * * *", "calls": [{"method": "Switch.Set", "params": {"id": 0, "on": true}}, {"method": "Script.Start", "params": {"id": 1}}]},
+	{"id": 6, "enable": false, "timespec": "0 0 10 * * *", "calls": []},
+	{"id": 7, "enable": true, "timespec": "0 0 19 * * *", "calls": [{"method": "Light.Set", "params": {"id": 2, "on": true, "brightness": 50}}]}
+]`
+
+func TestCreatedSchedules(t *testing.T) {
+	var jobs []shelly.ScheduleJob
+	if err := json.Unmarshal([]byte(listedJobs), &jobs); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name     string
+		recorded map[int]string
+		want     []int
+	}{
+		{"nothing recorded", map[int]string{}, []int{}},
+		// Schedule 3 was created by other means, so it is not recorded.
+		{"recorded switch schedules", map[int]string{1: "", 2: "boiler"}, []int{1, 2}},
+		// Ids of deleted schedules reused by the device for schedules
+		// not switching relays are not taken.
+		{"reused ids", map[int]string{4: "", 5: "", 6: ""}, []int{}},
+		{"recorded light schedule", map[int]string{7: "lights"}, []int{7}},
+		{"ids not on device", map[int]string{1: "", 42: ""}, []int{1}},
+	}
+	for _, tt := range tests {
+		if got := createdSchedules(jobs, tt.recorded); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: got %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestAppliedSchedules(t *testing.T) {
+	var existing []shelly.ScheduleJob
+	if err := json.Unmarshal([]byte(listedJobs), &existing); err != nil {
+		t.Fatal(err)
+	}
+	created := shelly.Schedule{Enable: true, TimeSpec: "0 0 20 * * *", Calls: existing[0].Calls}
+	updated := shelly.ScheduleJob{ID: 2, Enable: true, TimeSpec: "0 0 21 * * *", Calls: existing[1].Calls}
+	changes := shelly.ScheduleChanges{Kept: []int{1}, Updated: []shelly.ScheduleJob{updated}, Created: []shelly.Schedule{created}}
+	applied := appliedSchedules([]int{1, 2, 8}, changes, existing)
+	want := []shelly.ScheduleJob{existing[0], updated, {ID: 8, Enable: true, TimeSpec: "0 0 20 * * *", Calls: existing[0].Calls}}
+	if !reflect.DeepEqual(applied, want) {
+		t.Errorf("got %+v, want %+v", applied, want)
+	}
+	// In dry run, there are no ids.
+	if applied := appliedSchedules([]int{}, changes, existing); len(applied) != 0 {
+		t.Errorf("got %+v in dry run, want none", applied)
+	}
+}
+
+func TestCheckGen1Timer(t *testing.T) {
+	now := time.Date(2024, 6, 1, 10, 0, 0, 0, time.UTC)
+	at := func(hour, min int) time.Time { return time.Date(2024, 6, 1, hour, min, 0, 0, time.UTC) }
+	relay := func(id int, on, off time.Time) shelly.OnOffSchedule {
+		return shelly.OnOffSchedule{Relay: id, On: on, Off: off}
+	}
+	tests := []struct {
+		name string
+		plan []shelly.OnOffSchedule
+		opts shelly.ScheduleOptions
+		err  string
+	}{
+		{"starting now", []shelly.OnOffSchedule{relay(0, now, at(11, 0))}, shelly.ScheduleOptions{}, ""},
+		{"staggered relays", []shelly.OnOffSchedule{relay(0, now, at(11, 0)), relay(1, now.Add(2*time.Second), at(11, 0))}, shelly.ScheduleOptions{}, ""},
+		{"started within a minute", []shelly.OnOffSchedule{relay(0, now.Add(-time.Minute), at(11, 0))}, shelly.ScheduleOptions{}, ""},
+		// A range already over would turn the relay on without timer.
+		{"over", []shelly.OnOffSchedule{relay(0, at(8, 0), at(9, 0))}, shelly.ScheduleOptions{}, "turns on at 2024-06-01 08:00:00"},
+		{"ending now", []shelly.OnOffSchedule{relay(0, now, now)}, shelly.ScheduleOptions{}, "already over"},
+		{"later today", []shelly.OnOffSchedule{relay(0, at(17, 0), at(18, 0))}, shelly.ScheduleOptions{}, "use --repeat"},
+		{"several ranges", []shelly.OnOffSchedule{relay(0, now, at(11, 0)), relay(0, now, at(12, 0))}, shelly.ScheduleOptions{}, "several ranges"},
+		{"on only", []shelly.OnOffSchedule{relay(0, now, at(11, 0))}, shelly.ScheduleOptions{OnOnly: true}, "need --repeat"},
+	}
+	for _, tt := range tests {
+		err := checkGen1Timer(tt.plan, tt.opts, now)
+		if tt.err == "" && err != nil {
+			t.Errorf("%s: %s", tt.name, err)
+		} else if tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)) {
+			t.Errorf("%s: got error %v, want error containing %q", tt.name, err, tt.err)
+		}
+	}
+}
+
+func TestCheckPast(t *testing.T) {
+	loc := time.UTC
+	now := time.Date(2024, 6, 1, 10, 0, 0, 0, loc)
+	date := time.Date(2024, 6, 1, 0, 0, 0, 0, loc)
+	ranges := func(s string) []shelly.TimeOffset {
+		offsets, err := shelly.ParseTimeRanges(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return offsets
+	}
+	tests := []struct {
+		name    string
+		offsets []shelly.TimeOffset
+		opts    shelly.ScheduleOptions
+		past    []string
+	}{
+		{"future", ranges("17..18"), shelly.ScheduleOptions{}, []string{}},
+		{"over", ranges("8..9"), shelly.ScheduleOptions{}, []string{"relay 0 on at 2024-06-01 08:00:00", "relay 0 off at 2024-06-01 09:00:00"}},
+		{"started", ranges("9..11"), shelly.ScheduleOptions{}, []string{"relay 0 on at 2024-06-01 09:00:00"}},
+		{"one of several", ranges("8..9,17..18"), shelly.ScheduleOptions{}, []string{"relay 0 on at 2024-06-01 08:00:00", "relay 0 off at 2024-06-01 09:00:00"}},
+		{"off only", ranges("9..11"), shelly.ScheduleOptions{OffOnly: true}, []string{}},
+		{"on only", ranges("8..9"), shelly.ScheduleOptions{OnOnly: true}, []string{"relay 0 on at 2024-06-01 08:00:00"}},
+		// Repeating schedules fire again next week.
+		{"repeat", ranges("8..9"), shelly.ScheduleOptions{Repeat: []time.Weekday{time.Saturday}}, []string{}},
+	}
+	var logs bytes.Buffer
+	defer slog.SetDefault(slog.Default())
+	slog.SetDefault(slog.New(slog.NewTextHandler(&logs, nil)))
+	for _, tt := range tests {
+		job := onoffJob{relayIDs: []int{0}, date: date, offsets: tt.offsets, opts: tt.opts}
+		if past := job.pastSchedules(now); !reflect.DeepEqual(past, tt.past) {
+			t.Errorf("%s: past schedules %q, want %q", tt.name, past, tt.past)
+		}
+
+		logs.Reset()
+		if err := job.checkPast(now); err != nil {
+			t.Errorf("%s: %s", tt.name, err)
+		}
+		if warnings := strings.Count(logs.String(), "Schedule is in the past"); warnings != len(tt.past) {
+			t.Errorf("%s: %d warnings, want %d: %s", tt.name, warnings, len(tt.past), logs.String())
+		}
+
+		job.strict = true
+		logs.Reset()
+		err := job.checkPast(now)
+		if len(tt.past) == 0 && err != nil {
+			t.Errorf("%s: with --strict: %s", tt.name, err)
+		}
+		if len(tt.past) > 0 {
+			if !errors.As(err, &usageError{}) || !strings.Contains(err.Error(), tt.past[0]) {
+				t.Errorf("%s: with --strict got error %v, want usage error listing %s", tt.name, err, tt.past[0])
+			}
+			if logs.Len() != 0 {
+				t.Errorf("%s: with --strict logged %s", tt.name, logs.String())
+			}
+		}
+	}
+}
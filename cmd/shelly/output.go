@@ -0,0 +1,239 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"time"
+
+	"github.com/ahojukka5/shelly"
+)
+
+// jsonOutput is set by --json flag. In JSON mode, commands print their
+// results as JSON to stdout, while diagnostics are logged to stderr.
+var jsonOutput bool
+
+// ErrorResult is printed in JSON mode when command fails.
+type ErrorResult struct {
+	Error string `json:"error"`
+}
+
+func printJSON(v interface{}) {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		slog.Error(err.Error())
+		os.Exit(exitFailure)
+	}
+	fmt.Println(string(data))
+}
+
+// Exit codes of the commands.
+const (
+	exitOK         = 0
+	exitFailure    = 1 // other errors, e.g. relay not found
+	exitUsage      = 2 // invalid arguments or flags
+	exitConnection = 3 // device could not be reached
+	exitDevice     = 4 // device returned an error
+)
+
+// usageError is an error in the arguments given by user.
+type usageError struct {
+	error
+}
+
+func (e usageError) Unwrap() error {
+	return e.error
+}
+
+// exitCode returns the exit code corresponding to the error.
+func exitCode(err error) int {
+	var connErr *shelly.ConnectionError
+	var rpcErr *shelly.RPCError
+	switch {
+	case err == nil:
+		return exitOK
+	case errors.As(err, &usageError{}):
+		return exitUsage
+	case errors.As(err, &connErr):
+		return exitConnection
+	case errors.As(err, &rpcErr):
+		return exitDevice
+	}
+	return exitFailure
+}
+
+// reportError logs the error and returns the exit code of the error. In JSON
+// mode, the error is printed also to stdout.
+func reportError(err error) int {
+	if jsonOutput {
+		printJSON(ErrorResult{err.Error()})
+	}
+	slog.Error(err.Error())
+	return exitCode(err)
+}
+
+// fatal reports the error and exits, see reportError.
+func fatal(err error) {
+	code := reportError(err)
+	closeLogFile()
+	os.Exit(code)
+}
+
+// RelayResult is the state of a relay after on, off or toggle command.
+type RelayResult struct {
+	ID    int        `json:"id"`
+	On    bool       `json:"on"`
+	Until *time.Time `json:"until,omitempty"`
+}
+
+// StatusResult is the output of status command.
+type StatusResult struct {
+	ID     int      `json:"id"`
+	Name   string   `json:"name,omitempty"`
+	On     bool     `json:"on"`
+	APower *float64 `json:"apower,omitempty"`
+}
+
+// AutoOffResult is the auto-off configuration of a relay after auto-off
+// command, as applied by the device.
+type AutoOffResult struct {
+	ID      int     `json:"id"`
+	AutoOff bool    `json:"auto_off"`
+	Delay   float64 `json:"auto_off_delay"`
+}
+
+// CoverResult is the output of open and close commands.
+type CoverResult struct {
+	ID        int    `json:"id"`
+	State     string `json:"state"`
+	TargetPos int    `json:"target_pos"`
+}
+
+// LightResult is the output of dim command.
+type LightResult struct {
+	ID         int     `json:"id"`
+	On         bool    `json:"on"`
+	Brightness float64 `json:"brightness"`
+}
+
+// ColorResult is the output of color command.
+type ColorResult struct {
+	ID    int    `json:"id"`
+	Color string `json:"color"`
+	Red   int    `json:"red"`
+	Green int    `json:"green"`
+	Blue  int    `json:"blue"`
+}
+
+// PowerResult is the output of power command.
+type PowerResult struct {
+	ID      int      `json:"id"`
+	APower  *float64 `json:"apower"`
+	Voltage *float64 `json:"voltage"`
+	Current *float64 `json:"current"`
+	Energy  *float64 `json:"energy"`
+}
+
+// OnOffOutput is the output of onoff command. Success is true if the
+// schedules were set to all devices.
+type OnOffOutput struct {
+	Success bool          `json:"success"`
+	Results []OnOffResult `json:"results"`
+}
+
+// OnOffResult is the result of onoff command for a single device. IDs are the
+// ids of all schedules set, while Relays tells the schedules of each relay.
+type OnOffResult struct {
+	Host   string                 `json:"host"`
+	IDs    []int                  `json:"ids"`
+	Relays []RelaySchedulesResult `json:"relays"`
+	Label  string                 `json:"label,omitempty"`
+	DryRun bool                   `json:"dry_run"`
+	Error  string                 `json:"error,omitempty"`
+	err    error
+}
+
+// RelaySchedulesResult is the planned time ranges of a relay set by onoff
+// command, and the ids of the schedules switching the relay. The ids are
+// empty in dry run and for Gen1 devices.
+type RelaySchedulesResult struct {
+	ID          int           `json:"id"`
+	Ranges      []RangeResult `json:"ranges"`
+	ScheduleIDs []int         `json:"schedule_ids"`
+}
+
+// RangeResult is a time range of a relay. On is omitted with --off-only and
+// Off with --on-only.
+type RangeResult struct {
+	On  *time.Time `json:"on,omitempty"`
+	Off *time.Time `json:"off,omitempty"`
+}
+
+// BatchResult is the output of batch command for a single line, with the
+// results of onoff on each device.
+type BatchResult struct {
+	Line    int           `json:"line"`
+	Args    string        `json:"args"`
+	OK      bool          `json:"ok"`
+	Results []OnOffResult `json:"results"`
+	Error   string        `json:"error,omitempty"`
+}
+
+// ImportResult is the output of import command for a single device.
+type ImportResult struct {
+	Host   string `json:"host"`
+	IDs    []int  `json:"ids"`
+	DryRun bool   `json:"dry_run"`
+	Error  string `json:"error,omitempty"`
+}
+
+// ScheduleResult is the output of list-schedules command for a single
+// schedule.
+type ScheduleResult struct {
+	shelly.ScheduleJob
+	Label string `json:"label,omitempty"`
+}
+
+// DeleteScheduleResult is the output of delete-schedule command.
+type DeleteScheduleResult struct {
+	ID      int  `json:"id"`
+	Deleted bool `json:"deleted"`
+}
+
+// RebootResult is the output of reboot command.
+type RebootResult struct {
+	Host     string `json:"host"`
+	Rebooted bool   `json:"rebooted"`
+}
+
+// EnableScheduleResult is the output of enable-schedule and disable-schedule
+// commands.
+type EnableScheduleResult struct {
+	ID     int  `json:"id"`
+	Enable bool `json:"enable"`
+}
+
+// VersionResult is the output of version command.
+type VersionResult struct {
+	Version   string `json:"version"`
+	Commit    string `json:"commit,omitempty"`
+	Date      string `json:"date,omitempty"`
+	GoVersion string `json:"go_version"`
+}
+
+// PingResult is the output of ping command for a single device. Latency is
+// the round-trip time in milliseconds.
+type PingResult struct {
+	Host    string  `json:"host"`
+	OK      bool    `json:"ok"`
+	Latency float64 `json:"latency_ms"`
+	Error   string  `json:"error,omitempty"`
+}
+
+// InfoResult is the output of info command for a single device.
+type InfoResult struct {
+	Host string `json:"host"`
+	shelly.DeviceInfo
+}
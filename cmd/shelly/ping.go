@@ -0,0 +1,65 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"time"
+
+	"github.com/ahojukka5/shelly"
+)
+
+func usage_ping() {
+	fmt.Printf("Usage: %s ping [options]\n", appName)
+	usage_device_options()
+	fmt.Print("\nExamples:\n\n")
+	fmt.Printf("  %s ping\n", appName)
+	fmt.Printf("  %s ping --timeout 2s --retries 0 --host 192.168.1.50,192.168.1.51\n", appName)
+	fmt.Print("\nThe status of each device is requested without changing anything, and the\n")
+	fmt.Print("round-trip time is printed. The exit code is non-zero if any device fails,\n")
+	fmt.Print("see exit codes in the usage of the command.\n")
+}
+
+func newPingFlags() *deviceCommandFlags {
+	return newDeviceCommandFlags("ping", usage_ping)
+}
+
+func ping(ctx context.Context) int {
+	f := newPingFlags()
+	device := f.device
+	args := parseArgs(f.fs, os.Args[2:])
+	if len(args) != 0 {
+		usage_ping()
+		os.Exit(exitUsage)
+	}
+	devices, err := device.connectAll(ctx)
+	if err != nil {
+		fatal(err)
+	}
+	results := []PingResult{}
+	var lastErr error
+	for _, d := range devices {
+		latency, err := shelly.CheckConnection(ctx, d.client, d.uri)
+		d.client.Close()
+		result := PingResult{Host: d.host, OK: err == nil}
+		if err != nil {
+			lastErr = err
+			result.Error = err.Error()
+			slog.Error("Device not responding", "host", d.host, "err", err)
+			if !jsonOutput {
+				fmt.Printf("%s: failed\n", d.host)
+			}
+		} else {
+			result.Latency = float64(latency) / float64(time.Millisecond)
+			if !jsonOutput {
+				fmt.Printf("%s: ok, %s\n", d.host, latency.Round(100*time.Microsecond))
+			}
+		}
+		results = append(results, result)
+	}
+	if jsonOutput {
+		printJSON(results)
+	}
+	return exitCode(lastErr)
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"github.com/ahojukka5/shelly"
+)
+
+func usage_power() {
+	fmt.Printf("Usage: %s power [options] <relays>\n\n", appName)
+	fmt.Println("  relays      Relay id or name, or list of them")
+	usage_device_options()
+	fmt.Print("\nExamples:\n\n")
+	fmt.Printf("  %s power 0\n", appName)
+	fmt.Printf("  %s power 0,1\n", appName)
+}
+
+func formatMeasurement(value *float64, format string) string {
+	if value == nil {
+		return "n/a"
+	}
+	return fmt.Sprintf(format, *value)
+}
+
+func newPowerFlags() *deviceCommandFlags {
+	return newDeviceCommandFlags("power", usage_power)
+}
+
+func power(ctx context.Context) int {
+	f := newPowerFlags()
+	device := f.device
+	args := parseArgs(f.fs, os.Args[2:])
+	if len(args) != 1 {
+		usage_power()
+		os.Exit(exitUsage)
+	}
+	client, uri, err := device.connect(ctx)
+	if err != nil {
+		fatal(err)
+	}
+	relay_ids, err := shelly.ResolveRelays(ctx, client, uri, args[0])
+	if err != nil {
+		fatal(err)
+	}
+	result := []PowerResult{}
+	for _, rid := range relay_ids {
+		sw, err := shelly.SwitchGetStatus(ctx, client, uri, rid)
+		if err != nil {
+			fatal(err)
+		}
+		var energy *float64
+		if sw.AEnergy != nil {
+			energy = &sw.AEnergy.Total
+		}
+		result = append(result, PowerResult{rid, sw.APower, sw.Voltage, sw.Current, energy})
+		if !jsonOutput {
+			fmt.Printf("relay %d: %s, %s, %s, %s\n", rid,
+				formatMeasurement(sw.APower, "%.1f W"),
+				formatMeasurement(sw.Voltage, "%.1f V"),
+				formatMeasurement(sw.Current, "%.3f A"),
+				formatMeasurement(energy, "%.1f Wh"))
+		}
+	}
+	if jsonOutput {
+		printJSON(result)
+	}
+	return exitOK
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/ahojukka5/shelly"
+)
+
+func usage_reboot() {
+	fmt.Printf("Usage: %s reboot [options]\n", appName)
+	usage_device_options()
+	fmt.Println("  --yes       Do not ask for confirmation")
+	fmt.Print("\nExamples:\n\n")
+	fmt.Printf("  %s reboot\n", appName)
+	fmt.Printf("  %s reboot --yes --host 192.168.1.50\n", appName)
+}
+
+type rebootFlags struct {
+	fs     *flag.FlagSet
+	device *deviceFlags
+	yes    *bool
+}
+
+func newRebootFlags() *rebootFlags {
+	fs := flag.NewFlagSet("reboot", flag.ExitOnError)
+	fs.Usage = usage_reboot
+	return &rebootFlags{
+		fs:     fs,
+		device: addDeviceFlags(fs),
+		yes:    fs.Bool("yes", false, "do not ask for confirmation"),
+	}
+}
+
+func reboot(ctx context.Context) int {
+	f := newRebootFlags()
+	device, yes := f.device, f.yes
+	args := parseArgs(f.fs, os.Args[2:])
+	if len(args) != 0 {
+		usage_reboot()
+		os.Exit(exitUsage)
+	}
+	devices, err := device.connectAll(ctx)
+	if err != nil {
+		fatal(err)
+	}
+	if len(devices) > 1 {
+		fatal(usageError{errors.New("command supports only a single device, got " + *device.host)})
+	}
+	d := devices[0]
+	if !*yes && !confirm("Reboot device "+d.host+"?") {
+		fatal(errors.New("reboot cancelled"))
+	}
+	err = shelly.Reboot(ctx, d.client, d.uri)
+	if err != nil {
+		fatal(err)
+	}
+	if jsonOutput {
+		printJSON(RebootResult{d.host, true})
+	} else {
+		fmt.Printf("device %s is rebooting\n", d.host)
+	}
+	return exitOK
+}
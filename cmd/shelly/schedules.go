@@ -0,0 +1,214 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/ahojukka5/shelly"
+)
+
+func usage_list_schedules() {
+	fmt.Printf("Usage: %s list-schedules [options]\n", appName)
+	usage_device_options()
+	fmt.Print("\nExamples:\n\n")
+	fmt.Printf("  %s list-schedules\n", appName)
+	fmt.Printf("  %s list-schedules --json\n", appName)
+}
+
+// callRelay returns the relay id of Switch call, if any.
+func callRelay(call shelly.Call) (int, bool) {
+	id, ok := call.Params["id"].(float64)
+	if !ok || !strings.HasPrefix(call.Method, "Switch.") {
+		return 0, false
+	}
+	return int(id), true
+}
+
+// scheduleRelayNames returns the names of the relays switched by schedules.
+// Names are shown only for convenience, so failing to get them is not an
+// error.
+func scheduleRelayNames(ctx context.Context, client *shelly.Client, uri string, jobs []shelly.ScheduleJob) map[int]string {
+	ids := []int{}
+	seen := map[int]bool{}
+	for _, job := range jobs {
+		for _, call := range job.Calls {
+			if id, ok := callRelay(call); ok && !seen[id] {
+				seen[id] = true
+				ids = append(ids, id)
+			}
+		}
+	}
+	names, err := shelly.RelayNames(ctx, client, uri, ids)
+	if err != nil {
+		slog.Warn("Relay names not available", "err", err)
+	}
+	return names
+}
+
+func formatCalls(calls []shelly.Call, names map[int]string) string {
+	strs := []string{}
+	for _, call := range calls {
+		params, err := json.Marshal(call.Params)
+		if err != nil {
+			params = []byte("?")
+		}
+		str := call.Method + " " + string(params)
+		if id, ok := callRelay(call); ok && names[id] != "" {
+			str += " (" + names[id] + ")"
+		}
+		strs = append(strs, str)
+	}
+	return strings.Join(strs, ", ")
+}
+
+func newListSchedulesFlags() *deviceCommandFlags {
+	return newDeviceCommandFlags("list-schedules", usage_list_schedules)
+}
+
+func list_schedules(ctx context.Context) int {
+	f := newListSchedulesFlags()
+	device := f.device
+	args := parseArgs(f.fs, os.Args[2:])
+	if len(args) != 0 {
+		usage_list_schedules()
+		os.Exit(exitUsage)
+	}
+	client, uri, err := device.connect(ctx)
+	if err != nil {
+		fatal(err)
+	}
+	jobs, err := shelly.ScheduleList(ctx, client, uri)
+	if err != nil {
+		fatal(err)
+	}
+	state, err := loadState(uri)
+	if err != nil {
+		slog.Warn("Labels of schedules not available", "err", err)
+	}
+	if jsonOutput {
+		result := []ScheduleResult{}
+		for _, job := range jobs {
+			result = append(result, ScheduleResult{job, state.Schedules[job.ID]})
+		}
+		printJSON(result)
+		return exitOK
+	}
+	names := scheduleRelayNames(ctx, client, uri, jobs)
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tENABLED\tLABEL\tTIMESPEC\tCALLS")
+	for _, job := range jobs {
+		fmt.Fprintf(w, "%d\t%t\t%s\t%s\t%s\n", job.ID, job.Enable, state.Schedules[job.ID], job.TimeSpec, formatCalls(job.Calls, names))
+	}
+	w.Flush()
+	return exitOK
+}
+
+func usage_delete_schedule() {
+	fmt.Printf("Usage: %s delete-schedule [options] <id>\n\n", appName)
+	fmt.Println("  id          Schedule id, see list-schedules")
+	usage_device_options()
+	fmt.Print("\nExamples:\n\n")
+	fmt.Printf("  %s delete-schedule 3\n", appName)
+}
+
+func newDeleteScheduleFlags() *deviceCommandFlags {
+	return newDeviceCommandFlags("delete-schedule", usage_delete_schedule)
+}
+
+func delete_schedule(ctx context.Context) int {
+	f := newDeleteScheduleFlags()
+	device := f.device
+	args := parseArgs(f.fs, os.Args[2:])
+	if len(args) != 1 {
+		usage_delete_schedule()
+		os.Exit(exitUsage)
+	}
+	ids, err := shelly.ParseInts(args[0], ",")
+	if err != nil {
+		fatal(usageError{err})
+	}
+	if len(ids) != 1 || ids[0] < 0 {
+		fatal(usageError{errors.New("invalid schedule id: " + args[0] + ", expected non-negative integer")})
+	}
+	client, uri, err := device.connect(ctx)
+	if err != nil {
+		fatal(err)
+	}
+	err = shelly.ScheduleDelete(ctx, client, uri, ids[0])
+	if err != nil {
+		fatal(err)
+	}
+	if state, err := loadState(uri); err == nil && state.has(ids[0]) {
+		state.remove(ids)
+		if err := state.save(); err != nil {
+			slog.Warn("Removing label of schedule failed", "err", err)
+		}
+	}
+	if jsonOutput {
+		printJSON(DeleteScheduleResult{ids[0], true})
+	} else {
+		fmt.Printf("schedule %d deleted\n", ids[0])
+	}
+	return exitOK
+}
+
+func usage_enable_schedule(name string) func() {
+	return func() {
+		fmt.Printf("Usage: %s %s-schedule [options] <id>\n\n", appName, name)
+		fmt.Println("  id          Schedule id, see list-schedules")
+		usage_device_options()
+		fmt.Print("\nExamples:\n\n")
+		fmt.Printf("  %s %s-schedule 3\n", appName, name)
+	}
+}
+
+func enable_schedule(ctx context.Context) int {
+	return setScheduleEnabled(ctx, "enable", true)
+}
+
+func disable_schedule(ctx context.Context) int {
+	return setScheduleEnabled(ctx, "disable", false)
+}
+
+func newScheduleEnabledFlags(name string) *deviceCommandFlags {
+	return newDeviceCommandFlags(name+"-schedule", usage_enable_schedule(name))
+}
+
+// setScheduleEnabled implements enable-schedule and disable-schedule
+// commands.
+func setScheduleEnabled(ctx context.Context, name string, enable bool) int {
+	f := newScheduleEnabledFlags(name)
+	device := f.device
+	args := parseArgs(f.fs, os.Args[2:])
+	if len(args) != 1 {
+		f.fs.Usage()
+		os.Exit(exitUsage)
+	}
+	ids, err := shelly.ParseInts(args[0], ",")
+	if err != nil {
+		fatal(usageError{err})
+	}
+	if len(ids) != 1 || ids[0] < 0 {
+		fatal(usageError{errors.New("invalid schedule id: " + args[0] + ", expected non-negative integer")})
+	}
+	client, uri, err := device.connect(ctx)
+	if err != nil {
+		fatal(err)
+	}
+	err = shelly.ScheduleSetEnabled(ctx, client, uri, ids[0], enable)
+	if err != nil {
+		fatal(err)
+	}
+	if jsonOutput {
+		printJSON(EnableScheduleResult{ids[0], enable})
+	} else {
+		fmt.Printf("schedule %d %sd\n", ids[0], name)
+	}
+	return exitOK
+}
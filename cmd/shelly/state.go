@@ -0,0 +1,142 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"log/slog"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// State is the local state of a single device, stored in a state file per
+// device. It records the ids of schedules created by onoff with their labels
+// given with --label, so that onoff can later delete only its own schedules.
+// Schedules of the device have no field for a name, so the labels are stored
+// here too, e.g.
+//
+//	{"uri": "http://192.168.1.50/rpc/", "schedules": {"5": "heating", "6": ""}}
+type State struct {
+	URI       string         `json:"uri"`
+	Schedules map[int]string `json:"schedules"`
+	path      string
+}
+
+// stateDir returns the directory of state files, given by environment
+// variable SHELLY_STATE_DIR, or shelly in the user cache directory by default.
+func stateDir() (string, error) {
+	if dir, ok := os.LookupEnv("SHELLY_STATE_DIR"); ok && dir != "" {
+		return dir, nil
+	}
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "shelly"), nil
+}
+
+// statePath returns the path of the state file of the device. The file name
+// contains the scheme, host and port of the device, e.g. http_192.168.1.50.json
+// so that several devices do not collide.
+func statePath(uri string) (string, error) {
+	dir, err := stateDir()
+	if err != nil {
+		return "", err
+	}
+	u, err := url.Parse(uri)
+	if err != nil {
+		return "", err
+	}
+	name := strings.NewReplacer(":", "_", "/", "_", "[", "", "]", "").Replace(u.Scheme + "_" + u.Host)
+	return filepath.Join(dir, name+".json"), nil
+}
+
+// loadState reads the state file of the device. Missing state file is not an
+// error, but results in an empty state. If the state file is corrupt, the
+// error is returned together with an empty state, which replaces the corrupt
+// file when saved.
+func loadState(uri string) (*State, error) {
+	state := &State{URI: uri, Schedules: map[int]string{}}
+	path, err := statePath(uri)
+	if err != nil {
+		return state, err
+	}
+	state.path = path
+	data, err := ioutil.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return state, nil
+	}
+	if err != nil {
+		return state, err
+	}
+	loaded := State{}
+	if err := json.Unmarshal(data, &loaded); err != nil {
+		return state, errors.New("invalid state file " + path + ": " + err.Error())
+	}
+	if loaded.Schedules != nil {
+		state.Schedules = loaded.Schedules
+	}
+	return state, nil
+}
+
+// save writes the state file, creating the directory if needed. The file is
+// written to a temporary file first and then renamed, so that an interrupted
+// write does not leave a corrupt state file.
+func (state *State) save() error {
+	if state.path == "" {
+		return errors.New("path of state file not known")
+	}
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(state.path), 0755); err != nil {
+		return err
+	}
+	tmp := state.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, state.path)
+}
+
+// warnDefaultDelete explains which schedules onoff deletes by default, when
+// neither --keep nor --clear is given. The warning is printed only once, which
+// is recorded with a marker file in the state directory.
+func warnDefaultDelete() {
+	dir, err := stateDir()
+	if err != nil {
+		return
+	}
+	marker := filepath.Join(dir, "default-delete-warned")
+	if _, err := os.Stat(marker); err == nil {
+		return
+	}
+	slog.Warn("Schedules created earlier by onoff are deleted before creating new ones, " +
+		"use --keep to keep them or --clear to delete all schedules of the device (shown only once)")
+	if err := os.MkdirAll(dir, 0755); err == nil {
+		ioutil.WriteFile(marker, nil, 0644)
+	}
+}
+
+// set records the created schedules with label.
+func (state *State) set(ids []int, label string) {
+	for _, id := range ids {
+		state.Schedules[id] = label
+	}
+}
+
+// has returns true if the schedule is recorded.
+func (state *State) has(id int) bool {
+	_, ok := state.Schedules[id]
+	return ok
+}
+
+// remove removes the schedules from the state.
+func (state *State) remove(ids []int) {
+	for _, id := range ids {
+		delete(state.Schedules, id)
+	}
+}
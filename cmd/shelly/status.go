@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"strconv"
+	"text/tabwriter"
+
+	"github.com/ahojukka5/shelly"
+)
+
+func usage_status() {
+	fmt.Printf("Usage: %s status [options]\n", appName)
+	usage_device_options()
+	fmt.Println("  --pretty    Print status as table with power and energy of relays")
+	fmt.Print("\nExamples:\n\n")
+	fmt.Printf("  %s status\n", appName)
+	fmt.Printf("  %s status --pretty\n", appName)
+	fmt.Printf("  %s status --host 192.168.1.50\n", appName)
+}
+
+// alignRight pads the strings to the same width, aligning them to the right.
+func alignRight(strs []string) []string {
+	width := 0
+	for _, s := range strs {
+		if len(s) > width {
+			width = len(s)
+		}
+	}
+	aligned := []string{}
+	for _, s := range strs {
+		aligned = append(aligned, fmt.Sprintf("%*s", width, s))
+	}
+	return aligned
+}
+
+// printStatusTable prints the status of relays as table, numeric columns
+// aligned to the right.
+func printStatusTable(switches []shelly.SwitchStatus, names map[int]string) {
+	ids := []string{"ID"}
+	relayNames := []string{"NAME"}
+	states := []string{"STATE"}
+	powers := []string{"POWER"}
+	energies := []string{"ENERGY"}
+	for _, sw := range switches {
+		state := "off"
+		if sw.Output {
+			state = "on"
+		}
+		var energy *float64
+		if sw.AEnergy != nil {
+			energy = &sw.AEnergy.Total
+		}
+		ids = append(ids, strconv.Itoa(sw.ID))
+		relayNames = append(relayNames, names[sw.ID])
+		states = append(states, state)
+		powers = append(powers, formatMeasurement(sw.APower, "%.1f W"))
+		energies = append(energies, formatMeasurement(energy, "%.1f Wh"))
+	}
+	ids, powers, energies = alignRight(ids), alignRight(powers), alignRight(energies)
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	for i := range ids {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", ids[i], relayNames[i], states[i], powers[i], energies[i])
+	}
+	w.Flush()
+}
+
+// relayNames returns the names of all relays of the device. Names are shown
+// only for convenience, so failing to get them is not an error.
+func relayNames(ctx context.Context, client *shelly.Client, uri string, deviceStatus shelly.Status) map[int]string {
+	ids := []int{}
+	for _, sw := range deviceStatus.Switches {
+		ids = append(ids, sw.ID)
+	}
+	names, err := shelly.RelayNames(ctx, client, uri, ids)
+	if err != nil {
+		slog.Warn("Relay names not available", "err", err)
+	}
+	return names
+}
+
+type statusFlags struct {
+	fs     *flag.FlagSet
+	device *deviceFlags
+	pretty *bool
+}
+
+func newStatusFlags() *statusFlags {
+	fs := flag.NewFlagSet("status", flag.ExitOnError)
+	fs.Usage = usage_status
+	return &statusFlags{
+		fs:     fs,
+		device: addDeviceFlags(fs),
+		pretty: fs.Bool("pretty", false, "print status as table"),
+	}
+}
+
+func status(ctx context.Context) int {
+	f := newStatusFlags()
+	device, pretty := f.device, f.pretty
+	args := parseArgs(f.fs, os.Args[2:])
+	if len(args) != 0 {
+		usage_status()
+		os.Exit(exitUsage)
+	}
+	client, uri, err := device.connect(ctx)
+	if err != nil {
+		fatal(err)
+	}
+	deviceStatus, err := shelly.GetStatus(ctx, client, uri)
+	if err != nil {
+		fatal(err)
+	}
+	names := relayNames(ctx, client, uri, deviceStatus)
+	if jsonOutput {
+		result := []StatusResult{}
+		for _, sw := range deviceStatus.Switches {
+			result = append(result, StatusResult{sw.ID, names[sw.ID], sw.Output, sw.APower})
+		}
+		printJSON(result)
+		return exitOK
+	}
+	if *pretty {
+		printStatusTable(deviceStatus.Switches, names)
+		return exitOK
+	}
+	for _, sw := range deviceStatus.Switches {
+		state := "off"
+		if sw.Output {
+			state = "on"
+		}
+		relay := strconv.Itoa(sw.ID)
+		if name, ok := names[sw.ID]; ok {
+			relay += " (" + name + ")"
+		}
+		if sw.APower != nil {
+			fmt.Printf("relay %s: %s, %.1f W\n", relay, state, *sw.APower)
+		} else {
+			fmt.Printf("relay %s: %s\n", relay, state)
+		}
+	}
+	return exitOK
+}
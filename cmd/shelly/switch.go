@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/ahojukka5/shelly"
+)
+
+func usage_switch(command string) {
+	fmt.Printf("Usage: %s %s [options] <relays>\n", appName, command)
+	fmt.Printf("       %s %s [options] --all\n\n", appName, command)
+	fmt.Println("  relays      Relay id or name, or list of them")
+	usage_device_options()
+	fmt.Println("  --all       Switch all relays of the device instead of giving <relays>")
+	fmt.Println("  --for       Switch relays back after duration, with a schedule created to")
+	fmt.Println("              the device, or timer of Gen1 devices")
+	fmt.Println("  --toggle-after")
+	fmt.Println("              Switch relays back after duration with the timer of the device,")
+	fmt.Println("              toggle_after of Switch.Set, instead of a schedule")
+	fmt.Print("\nExamples:\n\n")
+	fmt.Printf("  %s %s 0\n", appName, command)
+	fmt.Printf("  %s %s 0,1\n", appName, command)
+	fmt.Printf("  %s %s 0 --for 30m\n", appName, command)
+	fmt.Printf("  %s %s 0 --toggle-after 90s\n", appName, command)
+	fmt.Printf("  %s %s --all\n", appName, command)
+}
+
+// resolveRelayArgs returns the relays given as the single argument, or all
+// relays of the device with --all.
+func resolveRelayArgs(ctx context.Context, client *shelly.Client, uri string, args []string, all bool) ([]int, error) {
+	if all {
+		return shelly.AllRelays(ctx, client, uri)
+	}
+	return shelly.ResolveRelays(ctx, client, uri, args[0])
+}
+
+// checkRelayArgs exits with usage error unless either a single argument with
+// relays or --all is given.
+func checkRelayArgs(args []string, all bool, usage func()) {
+	if all && len(args) != 0 {
+		fatal(usageError{errors.New("flag --all cannot be used with a list of relays")})
+	}
+	if !all && len(args) != 1 {
+		usage()
+		os.Exit(exitUsage)
+	}
+}
+
+func on(ctx context.Context) int {
+	return switchSet(ctx, "on", true)
+}
+
+func off(ctx context.Context) int {
+	return switchSet(ctx, "off", false)
+}
+
+// opposite returns off for on and vice versa.
+func opposite(command string) string {
+	if command == "on" {
+		return "off"
+	}
+	return "on"
+}
+
+type switchFlags struct {
+	fs                    *flag.FlagSet
+	device                *deviceFlags
+	duration, toggleAfter *time.Duration
+	all                   *bool
+}
+
+func newSwitchFlags(command string) *switchFlags {
+	fs := flag.NewFlagSet(command, flag.ExitOnError)
+	fs.Usage = func() { usage_switch(command) }
+	return &switchFlags{
+		fs:          fs,
+		device:      addDeviceFlags(fs),
+		duration:    fs.Duration("for", 0, "switch relays back after duration"),
+		toggleAfter: fs.Duration("toggle-after", 0, "switch relays back after duration with the timer of the device"),
+		all:         fs.Bool("all", false, "switch all relays of the device"),
+	}
+}
+
+func switchSet(ctx context.Context, command string, state bool) int {
+	f := newSwitchFlags(command)
+	device, duration, toggleAfter, all := f.device, f.duration, f.toggleAfter, f.all
+	args := parseArgs(f.fs, os.Args[2:])
+	checkRelayArgs(args, *all, f.fs.Usage)
+	if *duration < 0 {
+		fatal(usageError{errors.New("duration must not be negative: " + duration.String())})
+	}
+	if *toggleAfter < 0 {
+		fatal(usageError{errors.New("duration must not be negative: " + toggleAfter.String())})
+	}
+	if *duration > 0 && *toggleAfter > 0 {
+		fatal(usageError{errors.New("flags --for and --toggle-after are mutually exclusive")})
+	}
+	client, uri, err := device.connect(ctx)
+	if err != nil {
+		fatal(err)
+	}
+	relay_ids, err := resolveRelayArgs(ctx, client, uri, args, *all)
+	if err != nil {
+		fatal(err)
+	}
+	var until *time.Time
+	if *toggleAfter > 0 {
+		*duration = *toggleAfter
+	}
+	if *duration > 0 {
+		loc, err := lookupLocation(ctx, "", connection{host: uri, client: client, uri: uri})
+		if err != nil {
+			fatal(err)
+		}
+		t := time.Now().In(loc).Add(*duration).Truncate(time.Second)
+		until = &t
+	}
+	result := []RelayResult{}
+	for _, rid := range relay_ids {
+		if *toggleAfter > 0 {
+			err = shelly.SwitchSetToggleAfter(ctx, client, uri, rid, state, *toggleAfter)
+		} else if client.Gen == shelly.Gen1 {
+			turn := "off"
+			if state {
+				turn = "on"
+			}
+			_, err = shelly.Gen1RelaySet(ctx, client, uri, rid, turn, *duration)
+		} else {
+			err = shelly.SwitchSet(ctx, client, uri, rid, state)
+		}
+		if err != nil {
+			fatal(err)
+		}
+		result = append(result, RelayResult{ID: rid, On: state, Until: until})
+		if !jsonOutput {
+			fmt.Printf("relay %d: %s\n", rid, command)
+		}
+	}
+	if until != nil && client.Gen != shelly.Gen1 && *toggleAfter == 0 {
+		ids, err := shelly.ScheduleSwitchAt(ctx, client, uri, relay_ids, *until, !state)
+		if err != nil {
+			fatal(err)
+		}
+		if !jsonOutput {
+			fmt.Printf("relays %s at %s with schedule %v\n", opposite(command), until.Format("2006-01-02 15:04:05"), ids)
+		}
+	} else if until != nil && !jsonOutput {
+		fmt.Printf("relays %s at %s with timer\n", opposite(command), until.Format("2006-01-02 15:04:05"))
+	}
+	if jsonOutput {
+		printJSON(result)
+	}
+	return exitOK
+}
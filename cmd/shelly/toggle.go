@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/ahojukka5/shelly"
+)
+
+func usage_toggle() {
+	fmt.Printf("Usage: %s toggle [options] <relays>\n", appName)
+	fmt.Printf("       %s toggle [options] --all\n\n", appName)
+	fmt.Println("  relays      Relay id or name, or list of them")
+	usage_device_options()
+	fmt.Println("  --all       Toggle all relays of the device instead of giving <relays>")
+	fmt.Print("\nExamples:\n\n")
+	fmt.Printf("  %s toggle 0\n", appName)
+	fmt.Printf("  %s toggle 0,1\n", appName)
+	fmt.Printf("  %s toggle --all\n", appName)
+}
+
+type toggleFlags struct {
+	fs     *flag.FlagSet
+	device *deviceFlags
+	all    *bool
+}
+
+func newToggleFlags() *toggleFlags {
+	fs := flag.NewFlagSet("toggle", flag.ExitOnError)
+	fs.Usage = usage_toggle
+	return &toggleFlags{
+		fs:     fs,
+		device: addDeviceFlags(fs),
+		all:    fs.Bool("all", false, "toggle all relays of the device"),
+	}
+}
+
+func toggle(ctx context.Context) int {
+	f := newToggleFlags()
+	device, all := f.device, f.all
+	args := parseArgs(f.fs, os.Args[2:])
+	checkRelayArgs(args, *all, usage_toggle)
+	client, uri, err := device.connect(ctx)
+	if err != nil {
+		fatal(err)
+	}
+	relay_ids, err := resolveRelayArgs(ctx, client, uri, args, *all)
+	if err != nil {
+		fatal(err)
+	}
+	result := []RelayResult{}
+	for _, rid := range relay_ids {
+		on, err := shelly.SwitchToggle(ctx, client, uri, rid)
+		if err != nil {
+			fatal(err)
+		}
+		result = append(result, RelayResult{ID: rid, On: on})
+		if jsonOutput {
+			continue
+		}
+		state := "off"
+		if on {
+			state = "on"
+		}
+		fmt.Printf("relay %d: %s\n", rid, state)
+	}
+	if jsonOutput {
+		printJSON(result)
+	}
+	return exitOK
+}
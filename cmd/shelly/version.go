@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"runtime"
+	"runtime/debug"
+)
+
+// Version, commit and build date, injected at build time, e.g.
+//
+//	go build -ldflags "-X main.version=1.2.0 -X main.commit=$(git rev-parse HEAD) -X main.date=$(date -u +%FT%TZ)" ./cmd/shelly
+//
+// If not injected, they are read from the build info of the binary.
+var (
+	version = ""
+	commit  = ""
+	date    = ""
+)
+
+func usage_version() {
+	fmt.Printf("Usage: %s version [options]\n", appName)
+	fmt.Print("\nOptions:\n\n")
+	fmt.Println("  --json      Print output as JSON")
+	fmt.Print("\nPrints the version, git commit and build date, also with --version.\n")
+}
+
+// buildInfo returns the version, git commit and build date, falling back to
+// the build info embedded by the go tool when not injected with ldflags.
+func buildInfo() VersionResult {
+	result := VersionResult{Version: version, Commit: commit, Date: date, GoVersion: runtime.Version()}
+	if info, ok := debug.ReadBuildInfo(); ok {
+		if result.Version == "" {
+			result.Version = info.Main.Version
+		}
+		for _, setting := range info.Settings {
+			switch {
+			case setting.Key == "vcs.revision" && result.Commit == "":
+				result.Commit = setting.Value
+			case setting.Key == "vcs.time" && result.Date == "":
+				result.Date = setting.Value
+			}
+		}
+	}
+	if result.Version == "" || result.Version == "(devel)" {
+		result.Version = "dev"
+	}
+	return result
+}
+
+// printVersion prints the build info, as JSON with --json.
+func printVersion() {
+	info := buildInfo()
+	if jsonOutput {
+		printJSON(info)
+		return
+	}
+	fmt.Printf("%s %s", appName, info.Version)
+	if info.Commit != "" {
+		fmt.Printf(", commit %s", info.Commit)
+	}
+	if info.Date != "" {
+		fmt.Printf(", built %s", info.Date)
+	}
+	fmt.Printf(" (%s)\n", info.GoVersion)
+}
+
+func newVersionFlags() *flag.FlagSet {
+	fs := flag.NewFlagSet("version", flag.ExitOnError)
+	fs.Usage = usage_version
+	fs.BoolVar(&jsonOutput, "json", jsonOutput, "print output as JSON")
+	return fs
+}
+
+func print_version(ctx context.Context) int {
+	args := parseArgs(newVersionFlags(), os.Args[2:])
+	if len(args) != 0 {
+		usage_version()
+		os.Exit(exitUsage)
+	}
+	printVersion()
+	return exitOK
+}
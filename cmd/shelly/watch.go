@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/ahojukka5/shelly"
+)
+
+// DefaultWatchInterval is the default time between polls of watch command.
+const DefaultWatchInterval = 5 * time.Second
+
+func usage_watch() {
+	fmt.Printf("Usage: %s watch [options]\n", appName)
+	usage_device_options()
+	fmt.Println("  --interval  Time between polls of the status (default 5s)")
+	fmt.Println("  --all       Print the state of relays at every poll, not only on change")
+	fmt.Print("\nExamples:\n\n")
+	fmt.Printf("  %s watch\n", appName)
+	fmt.Printf("  %s watch --interval 1m --all\n", appName)
+	fmt.Print("\nNote: watch runs until interrupted with Ctrl-C. With --json, each change is\n")
+	fmt.Println("      printed as JSON object on a single line.")
+}
+
+// WatchEvent is the output of watch command for a single relay at a single
+// poll.
+type WatchEvent struct {
+	Time   time.Time `json:"time"`
+	ID     int       `json:"id"`
+	Name   string    `json:"name,omitempty"`
+	On     bool      `json:"on"`
+	APower *float64  `json:"apower"`
+}
+
+// changed returns true if the state or power of relay differs from the
+// previous poll.
+func changed(sw shelly.SwitchStatus, prev shelly.SwitchStatus) bool {
+	if sw.Output != prev.Output || (sw.APower == nil) != (prev.APower == nil) {
+		return true
+	}
+	return sw.APower != nil && *sw.APower != *prev.APower
+}
+
+func printWatchEvent(event WatchEvent) {
+	if jsonOutput {
+		data, err := json.Marshal(event)
+		if err != nil {
+			fatal(err)
+		}
+		fmt.Println(string(data))
+		return
+	}
+	state := "off"
+	if event.On {
+		state = "on"
+	}
+	relay := strconv.Itoa(event.ID)
+	if event.Name != "" {
+		relay += " (" + event.Name + ")"
+	}
+	timestamp := event.Time.Format("2006-01-02 15:04:05")
+	if event.APower != nil {
+		fmt.Printf("%s relay %s: %s, %.1f W\n", timestamp, relay, state, *event.APower)
+	} else {
+		fmt.Printf("%s relay %s: %s\n", timestamp, relay, state)
+	}
+}
+
+type watchFlags struct {
+	fs       *flag.FlagSet
+	device   *deviceFlags
+	interval *time.Duration
+	all      *bool
+}
+
+func newWatchFlags() *watchFlags {
+	fs := flag.NewFlagSet("watch", flag.ExitOnError)
+	fs.Usage = usage_watch
+	return &watchFlags{
+		fs:       fs,
+		device:   addDeviceFlags(fs),
+		interval: fs.Duration("interval", DefaultWatchInterval, "time between polls of the status"),
+		all:      fs.Bool("all", false, "print the state of relays at every poll"),
+	}
+}
+
+func watch(ctx context.Context) int {
+	f := newWatchFlags()
+	device, interval, all := f.device, f.interval, f.all
+	args := parseArgs(f.fs, os.Args[2:])
+	if len(args) != 0 {
+		usage_watch()
+		os.Exit(exitUsage)
+	}
+	if *interval <= 0 {
+		fatal(usageError{errors.New("interval must be positive: " + interval.String())})
+	}
+	client, uri, err := device.connect(ctx)
+	if err != nil {
+		fatal(err)
+	}
+	defer client.Close()
+
+	// The first poll must succeed, so that wrong address or credentials are
+	// reported at once. Later failures are only logged, as the device may
+	// be temporarily unreachable.
+	deviceStatus, err := shelly.GetStatus(ctx, client, uri)
+	if err != nil {
+		fatal(err)
+	}
+	names := relayNames(ctx, client, uri, deviceStatus)
+	previous := map[int]shelly.SwitchStatus{}
+	ticker := time.NewTicker(*interval)
+	defer ticker.Stop()
+	for {
+		for _, sw := range deviceStatus.Switches {
+			prev, seen := previous[sw.ID]
+			if *all || !seen || changed(sw, prev) {
+				printWatchEvent(WatchEvent{time.Now(), sw.ID, names[sw.ID], sw.Output, sw.APower})
+			}
+			previous[sw.ID] = sw
+		}
+		select {
+		case <-ctx.Done():
+			return exitOK
+		case <-ticker.C:
+		}
+		next, err := shelly.GetStatus(ctx, client, uri)
+		if ctx.Err() != nil {
+			return exitOK
+		}
+		if err != nil {
+			slog.Warn("Polling status failed", "err", err)
+			deviceStatus = shelly.Status{}
+			continue
+		}
+		deviceStatus = next
+	}
+}
@@ -0,0 +1,35 @@
+package shelly
+
+import "context"
+
+// CoverStatus is the status of a single cover component cover:<id>. The
+// positions are nil if the cover is not calibrated.
+type CoverStatus struct {
+	ID         int    `json:"id"`
+	State      string `json:"state"`
+	CurrentPos *int   `json:"current_pos"`
+	TargetPos  *int   `json:"target_pos"`
+}
+
+// CoverOpen calls Cover.Open starting to open the cover.
+func CoverOpen(ctx context.Context, client *Client, uri string, id int) error {
+	return rpcCall(ctx, client, uri, "Cover.Open", map[string]int{"id": id}, nil)
+}
+
+// CoverClose calls Cover.Close starting to close the cover.
+func CoverClose(ctx context.Context, client *Client, uri string, id int) error {
+	return rpcCall(ctx, client, uri, "Cover.Close", map[string]int{"id": id}, nil)
+}
+
+// CoverGoToPosition calls Cover.GoToPosition moving the cover to position
+// given in percents, 0 being fully closed and 100 fully open.
+func CoverGoToPosition(ctx context.Context, client *Client, uri string, id int, pos int) error {
+	return rpcCall(ctx, client, uri, "Cover.GoToPosition", map[string]int{"id": id, "pos": pos}, nil)
+}
+
+// CoverGetStatus calls Cover.GetStatus and returns the status of the cover.
+func CoverGetStatus(ctx context.Context, client *Client, uri string, id int) (CoverStatus, error) {
+	var result CoverStatus
+	err := rpcCall(ctx, client, uri, "Cover.GetStatus", map[string]int{"id": id}, &result)
+	return result, err
+}
@@ -0,0 +1,118 @@
+package shelly
+
+import (
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"strings"
+)
+
+// Credentials used to authenticate against devices having authentication
+// enabled. Gen2 devices always use user name admin.
+type Credentials struct {
+	User     string
+	Password string
+}
+
+// parseDigestChallenge parses the parameters of WWW-Authenticate header, e.g.
+// Digest qop="auth", realm="shellyplus1-abc", nonce="60dc59c6", algorithm=SHA-256
+func parseDigestChallenge(header string) (map[string]string, error) {
+	if !strings.HasPrefix(header, "Digest ") {
+		return nil, errors.New("unsupported authentication challenge: " + header)
+	}
+	params := map[string]string{}
+	rest := strings.TrimPrefix(header, "Digest ")
+	for rest != "" {
+		rest = strings.TrimLeft(rest, " ,")
+		eq := strings.Index(rest, "=")
+		if eq < 0 {
+			break
+		}
+		key := strings.TrimSpace(rest[:eq])
+		rest = rest[eq+1:]
+		var val string
+		if strings.HasPrefix(rest, "\"") {
+			end := strings.Index(rest[1:], "\"")
+			if end < 0 {
+				return nil, errors.New("malformed authentication challenge: " + header)
+			}
+			val = rest[1 : end+1]
+			rest = rest[end+2:]
+		} else {
+			end := strings.Index(rest, ",")
+			if end < 0 {
+				end = len(rest)
+			}
+			val = strings.TrimSpace(rest[:end])
+			rest = rest[end:]
+		}
+		params[key] = val
+	}
+	if params["nonce"] == "" || params["realm"] == "" {
+		return nil, errors.New("malformed authentication challenge: " + header)
+	}
+	return params, nil
+}
+
+func digestHash(algorithm string, s string) (string, error) {
+	var h hash.Hash
+	switch strings.ToUpper(algorithm) {
+	case "", "MD5":
+		h = md5.New()
+	case "SHA-256":
+		h = sha256.New()
+	default:
+		return "", errors.New("unsupported digest algorithm: " + algorithm)
+	}
+	h.Write([]byte(s))
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// digestAuthorization computes the Authorization header answering to digest
+// challenge for the request with given method and request uri.
+func digestAuthorization(challenge string, method string, uri string, creds Credentials) (string, error) {
+	params, err := parseDigestChallenge(challenge)
+	if err != nil {
+		return "", err
+	}
+	algorithm := params["algorithm"]
+	ha1, err := digestHash(algorithm, creds.User+":"+params["realm"]+":"+creds.Password)
+	if err != nil {
+		return "", err
+	}
+	ha2, err := digestHash(algorithm, method+":"+uri)
+	if err != nil {
+		return "", err
+	}
+	nonce := params["nonce"]
+	header := fmt.Sprintf(`Digest username="%s", realm="%s", nonce="%s", uri="%s"`,
+		creds.User, params["realm"], nonce, uri)
+	var response string
+	if params["qop"] == "" {
+		response, err = digestHash(algorithm, ha1+":"+nonce+":"+ha2)
+	} else {
+		cnonceBytes := make([]byte, 8)
+		if _, err := rand.Read(cnonceBytes); err != nil {
+			return "", err
+		}
+		cnonce := hex.EncodeToString(cnonceBytes)
+		nc := "00000001"
+		response, err = digestHash(algorithm, ha1+":"+nonce+":"+nc+":"+cnonce+":auth:"+ha2)
+		header += fmt.Sprintf(`, qop=auth, nc=%s, cnonce="%s"`, nc, cnonce)
+	}
+	if err != nil {
+		return "", err
+	}
+	header += fmt.Sprintf(`, response="%s"`, response)
+	if algorithm != "" {
+		header += ", algorithm=" + algorithm
+	}
+	if opaque, ok := params["opaque"]; ok {
+		header += fmt.Sprintf(`, opaque="%s"`, opaque)
+	}
+	return header, nil
+}
@@ -0,0 +1,194 @@
+package shelly
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Generations of devices. Gen1 devices have a REST API, e.g.
+// /relay/0?turn=on, while Gen2 and later devices have the RPC API.
+const (
+	Gen1 = 1
+	Gen2 = 2
+)
+
+// gen1Root returns the root URI of Gen1 device from the RPC base URI, e.g.
+// http://192.168.1.50/rpc/ gives http://192.168.1.50/.
+func gen1Root(uri string) string {
+	return strings.TrimSuffix(uri, "rpc/")
+}
+
+// gen1Get sends GET request to path of Gen1 device with query, and decodes
+// the response into result unless nil.
+func gen1Get(ctx context.Context, client *Client, uri string, path string, query url.Values, result interface{}) error {
+	endpoint := gen1Root(uri) + path
+	if len(query) > 0 {
+		endpoint += "?" + query.Encode()
+	}
+	resp, err := httpDo(ctx, client, "GET", endpoint, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	bodyBytes, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	debugf("Response from %s (status code %d): %s", path, resp.StatusCode, bodyBytes)
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s: status code %d != 200: %s", path, resp.StatusCode, strings.TrimSpace(string(bodyBytes)))
+	}
+	if result == nil {
+		return nil
+	}
+	if err := json.Unmarshal(bodyBytes, result); err != nil {
+		return fmt.Errorf("%s: unexpected response: %s", path, string(bodyBytes))
+	}
+	return nil
+}
+
+// DetectGeneration returns the generation of the device from the gen field of
+// Shelly.GetDeviceInfo. Gen1 devices do not have the RPC API, so the method is
+// not found on them. Gen3 and later devices have the same RPC API as Gen2
+// devices, so Gen2 is returned for them.
+func DetectGeneration(ctx context.Context, client *Client, uri string) (int, error) {
+	resp, err := httpDo(ctx, client, "GET", uri+"Shelly.GetDeviceInfo", nil)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	bodyBytes, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return 0, err
+	}
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return Gen1, nil
+	default:
+		return 0, fmt.Errorf("detecting generation failed: status code %d", resp.StatusCode)
+	}
+	var info DeviceInfo
+	if err := json.Unmarshal(bodyBytes, &info); err != nil || info.Gen < Gen2 {
+		return 0, errors.New("detecting generation failed: unexpected response from Shelly.GetDeviceInfo: " + snippet(bodyBytes))
+	}
+	debugf("Detected generation %d of device", info.Gen)
+	return Gen2, nil
+}
+
+// Gen1Relay is the state of relay of Gen1 device.
+type Gen1Relay struct {
+	IsOn           bool `json:"ison"`
+	HasTimer       bool `json:"has_timer"`
+	TimerRemaining int  `json:"timer_remaining"`
+}
+
+// Gen1RelaySet turns the relay of Gen1 device on, off or toggles it, with
+// turn being on, off or toggle. If timer is positive, the relay is flipped
+// back after it.
+func Gen1RelaySet(ctx context.Context, client *Client, uri string, id int, turn string, timer time.Duration) (Gen1Relay, error) {
+	query := url.Values{"turn": {turn}}
+	if timer > 0 {
+		query.Set("timer", strconv.Itoa(int(timer.Round(time.Second)/time.Second)))
+	}
+	var relay Gen1Relay
+	err := gen1Get(ctx, client, uri, "relay/"+strconv.Itoa(id), query, &relay)
+	return relay, err
+}
+
+// Gen1RelaySettings are the schedule and auto-off settings of relay of Gen1
+// device. AutoOff is the auto-off timer in seconds, zero if disabled.
+type Gen1RelaySettings struct {
+	Schedule      bool     `json:"schedule"`
+	ScheduleRules []string `json:"schedule_rules"`
+	AutoOff       float64  `json:"auto_off"`
+}
+
+// Gen1GetRelaySettings returns the settings of relay of Gen1 device.
+func Gen1GetRelaySettings(ctx context.Context, client *Client, uri string, id int) (Gen1RelaySettings, error) {
+	var settings Gen1RelaySettings
+	err := gen1Get(ctx, client, uri, "settings/relay/"+strconv.Itoa(id), nil, &settings)
+	return settings, err
+}
+
+// Gen1SetAutoOff sets the auto-off timer of relay of Gen1 device, rounded to
+// seconds, and returns the settings of the relay. Zero delay disables the
+// timer.
+func Gen1SetAutoOff(ctx context.Context, client *Client, uri string, id int, delay time.Duration) (Gen1RelaySettings, error) {
+	query := url.Values{"auto_off": {strconv.Itoa(int(delay.Round(time.Second) / time.Second))}}
+	var settings Gen1RelaySettings
+	err := gen1Get(ctx, client, uri, "settings/relay/"+strconv.Itoa(id), query, &settings)
+	return settings, err
+}
+
+// Gen1SetScheduleRules replaces the schedule rules of relay of Gen1 device,
+// see Gen1ScheduleRules. The schedule is enabled unless disabled is set.
+func Gen1SetScheduleRules(ctx context.Context, client *Client, uri string, id int, rules []string, disabled bool) error {
+	infof("Setting schedule rules of relay %d: %s", id, strings.Join(rules, ","))
+	if client.DryRun {
+		infof("Dry run, schedule rules not sent to device")
+		return nil
+	}
+	query := url.Values{
+		"schedule":       {strconv.FormatBool(!disabled)},
+		"schedule_rules": {strings.Join(rules, ",")},
+	}
+	return gen1Get(ctx, client, uri, "settings/relay/"+strconv.Itoa(id), query, nil)
+}
+
+// gen1Rule returns the schedule rule of Gen1 device, e.g. 0730-01234-on turns
+// the relay on at 07:30 from Monday to Friday. Days are numbered from Monday
+// being 0 to Sunday being 6.
+func gen1Rule(t time.Time, days []time.Weekday, turn string) string {
+	digits := ""
+	for wd := time.Monday; wd <= time.Saturday; wd++ {
+		if containsWeekday(days, wd) {
+			digits += strconv.Itoa(int(wd) - 1)
+		}
+	}
+	if containsWeekday(days, time.Sunday) {
+		digits += "6"
+	}
+	return fmt.Sprintf("%02d%02d-%s-%s", t.Hour(), t.Minute(), digits, turn)
+}
+
+func containsWeekday(days []time.Weekday, wd time.Weekday) bool {
+	for _, d := range days {
+		if d == wd {
+			return true
+		}
+	}
+	return false
+}
+
+// Gen1ScheduleRules returns the schedule rules of each relay of the plan for
+// Gen1 device. The rules of Gen1 devices repeat weekly and have the precision
+// of a minute, so seconds are dropped. Without opts.Repeat, the rules repeat
+// at the weekdays of the planned times.
+func Gen1ScheduleRules(plan []OnOffSchedule, opts ScheduleOptions) (map[int][]string, error) {
+	if (opts.Method != "" && opts.Method != DefaultMethod) || len(opts.Params) > 0 {
+		return nil, errors.New("Gen1 devices support only switching relays on and off")
+	}
+	rules := map[int][]string{}
+	for _, p := range plan {
+		onDays, offDays := opts.Repeat, p.offRepeat(opts.Repeat)
+		if len(onDays) == 0 {
+			onDays, offDays = []time.Weekday{p.On.Weekday()}, []time.Weekday{p.Off.Weekday()}
+		}
+		if !opts.OffOnly {
+			rules[p.Relay] = append(rules[p.Relay], gen1Rule(p.On, onDays, "on"))
+		}
+		if !opts.OnOnly {
+			rules[p.Relay] = append(rules[p.Relay], gen1Rule(p.Off, offDays, "off"))
+		}
+	}
+	return rules, nil
+}
@@ -1,3 +1,3 @@
 module github.com/ahojukka5/shelly
 
-go 1.15
+go 1.21
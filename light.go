@@ -0,0 +1,71 @@
+package shelly
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// LightStatus is the status of a single light component light:<id>.
+type LightStatus struct {
+	ID         int     `json:"id"`
+	Output     bool    `json:"output"`
+	Brightness float64 `json:"brightness"`
+}
+
+// LightSet calls Light.Set turning the light on with brightness given in
+// percents.
+func LightSet(ctx context.Context, client *Client, uri string, id int, brightness int) error {
+	params := map[string]interface{}{"id": id, "on": true, "brightness": brightness}
+	return rpcCall(ctx, client, uri, "Light.Set", params, nil)
+}
+
+// LightGetStatus calls Light.GetStatus and returns the status of the light.
+func LightGetStatus(ctx context.Context, client *Client, uri string, id int) (LightStatus, error) {
+	var result LightStatus
+	err := rpcCall(ctx, client, uri, "Light.GetStatus", map[string]int{"id": id}, &result)
+	return result, err
+}
+
+// Color is a color given as red, green and blue components 0..255.
+type Color struct {
+	Red, Green, Blue uint8
+}
+
+// String returns the color in hex format #RRGGBB.
+func (c Color) String() string {
+	return fmt.Sprintf("#%02x%02x%02x", c.Red, c.Green, c.Blue)
+}
+
+// ParseColor parses color in hex format #RRGGBB, the # being optional.
+func ParseColor(s string) (Color, error) {
+	hex := strings.TrimPrefix(s, "#")
+	if len(hex) != 6 {
+		return Color{}, errors.New("invalid color: " + s + ", expected #RRGGBB")
+	}
+	value, err := strconv.ParseUint(hex, 16, 32)
+	if err != nil {
+		return Color{}, errors.New("invalid color: " + s + ", expected #RRGGBB")
+	}
+	return Color{uint8(value >> 16), uint8(value >> 8), uint8(value)}, nil
+}
+
+// ColorSet turns the RGB light on with the color. Gen2 devices are called
+// with RGB.Set, while Gen1 devices, e.g. Shelly RGBW2 in color mode, are set
+// with their REST API.
+func ColorSet(ctx context.Context, client *Client, uri string, id int, color Color) error {
+	if client.Gen == Gen1 {
+		query := url.Values{
+			"turn":  {"on"},
+			"red":   {strconv.Itoa(int(color.Red))},
+			"green": {strconv.Itoa(int(color.Green))},
+			"blue":  {strconv.Itoa(int(color.Blue))},
+		}
+		return gen1Get(ctx, client, uri, "color/"+strconv.Itoa(id), query, nil)
+	}
+	params := map[string]interface{}{"id": id, "on": true, "rgb": []int{int(color.Red), int(color.Green), int(color.Blue)}}
+	return rpcCall(ctx, client, uri, "RGB.Set", params, nil)
+}
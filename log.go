@@ -0,0 +1,47 @@
+package shelly
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+)
+
+// LogLevel is the minimum level of diagnostic messages, info by default.
+// Debug messages include request payloads and responses.
+var LogLevel = new(slog.LevelVar)
+
+// Log is the destination of diagnostic messages, by default text on stderr
+// at LogLevel, see SetLogOutput.
+var Log = newLogger(os.Stderr)
+
+func newLogger(w io.Writer) *slog.Logger {
+	return slog.New(slog.NewTextHandler(w, &slog.HandlerOptions{Level: LogLevel}))
+}
+
+// SetLogOutput directs the diagnostic messages to w, as text at LogLevel.
+func SetLogOutput(w io.Writer) {
+	Log = newLogger(w)
+}
+
+// logf formats and logs the message at level, formatting it only if the level
+// is enabled.
+func logf(level slog.Level, format string, v ...interface{}) {
+	ctx := context.Background()
+	if Log.Enabled(ctx, level) {
+		Log.Log(ctx, level, fmt.Sprintf(format, v...))
+	}
+}
+
+func debugf(format string, v ...interface{}) {
+	logf(slog.LevelDebug, format, v...)
+}
+
+func infof(format string, v ...interface{}) {
+	logf(slog.LevelInfo, format, v...)
+}
+
+func warnf(format string, v ...interface{}) {
+	logf(slog.LevelWarn, format, v...)
+}
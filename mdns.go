@@ -0,0 +1,258 @@
+package shelly
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"net"
+	"sort"
+	"strings"
+	"time"
+)
+
+// DefaultDiscoverTimeout is the default time to listen for mDNS responses.
+const DefaultDiscoverTimeout = 3 * time.Second
+
+// mdnsAddr is the IPv4 multicast address of mDNS.
+var mdnsAddr = &net.UDPAddr{IP: net.IPv4(224, 0, 0, 251), Port: 5353}
+
+// mdnsServices are the services browsed by Discover. Gen2 devices announce
+// _shelly._tcp, older devices only _http._tcp.
+var mdnsServices = []string{"_shelly._tcp.local.", "_http._tcp.local."}
+
+const (
+	dnsTypeA   = 1
+	dnsTypePTR = 12
+	dnsTypeSRV = 33
+)
+
+// DiscoveredDevice is a device found with mDNS.
+type DiscoveredDevice struct {
+	Name  string   `json:"name"`
+	Host  string   `json:"host"`
+	Port  int      `json:"port"`
+	Addrs []string `json:"addrs"`
+}
+
+// Discover browses Shelly devices in local network with mDNS, listening for
+// responses for the given time. Services _http._tcp are included only if the
+// instance name contains "shelly".
+func Discover(ctx context.Context, timeout time.Duration) ([]DiscoveredDevice, error) {
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{})
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-done:
+		}
+	}()
+
+	query := mdnsQuery(mdnsServices)
+	debugf("Sending mDNS query to %s", mdnsAddr)
+	if _, err := conn.WriteToUDP(query, mdnsAddr); err != nil {
+		return nil, err
+	}
+	conn.SetReadDeadline(time.Now().Add(timeout))
+
+	records := mdnsRecords{
+		instances: map[string]bool{},
+		srv:       map[string]mdnsSRV{},
+		addrs:     map[string][]string{},
+	}
+	buf := make([]byte, 9000)
+	for {
+		n, from, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			if err, ok := err.(net.Error); ok && err.Timeout() {
+				break
+			}
+			return nil, err
+		}
+		if err := records.parse(buf[:n]); err != nil {
+			debugf("Ignoring malformed mDNS response from %s: %s", from, err)
+		}
+	}
+	return records.devices(), nil
+}
+
+// mdnsQuery returns a query asking PTR records of the services, with unicast
+// response requested.
+func mdnsQuery(services []string) []byte {
+	msg := make([]byte, 12)
+	binary.BigEndian.PutUint16(msg[4:], uint16(len(services)))
+	for _, service := range services {
+		for _, label := range strings.Split(strings.TrimSuffix(service, "."), ".") {
+			msg = append(msg, byte(len(label)))
+			msg = append(msg, label...)
+		}
+		msg = append(msg, 0, 0, dnsTypePTR, 0x80, 1)
+	}
+	return msg
+}
+
+type mdnsSRV struct {
+	target string
+	port   int
+}
+
+// mdnsRecords collects the records of mDNS responses.
+type mdnsRecords struct {
+	instances map[string]bool
+	srv       map[string]mdnsSRV
+	addrs     map[string][]string
+}
+
+// readName reads the possibly compressed domain name at offset off of msg and
+// returns the name and the offset following it.
+func readName(msg []byte, off int) (string, int, error) {
+	labels := []string{}
+	end := -1
+	for jumps := 0; ; {
+		if off >= len(msg) {
+			return "", 0, errors.New("name out of bounds")
+		}
+		length := int(msg[off])
+		switch {
+		case length == 0:
+			if end < 0 {
+				end = off + 1
+			}
+			return strings.Join(labels, ".") + ".", end, nil
+		case length&0xc0 == 0xc0:
+			if off+1 >= len(msg) || jumps > 10 {
+				return "", 0, errors.New("invalid name pointer")
+			}
+			if end < 0 {
+				end = off + 2
+			}
+			off = int(binary.BigEndian.Uint16(msg[off:]) & 0x3fff)
+			jumps++
+		default:
+			if off+1+length > len(msg) {
+				return "", 0, errors.New("label out of bounds")
+			}
+			labels = append(labels, string(msg[off+1:off+1+length]))
+			off += 1 + length
+		}
+	}
+}
+
+// parse adds the answer and additional records of the mDNS response msg.
+func (r *mdnsRecords) parse(msg []byte) error {
+	if len(msg) < 12 {
+		return errors.New("message too short")
+	}
+	questions := int(binary.BigEndian.Uint16(msg[4:]))
+	count := int(binary.BigEndian.Uint16(msg[6:])) +
+		int(binary.BigEndian.Uint16(msg[8:])) +
+		int(binary.BigEndian.Uint16(msg[10:]))
+	off := 12
+	for i := 0; i < questions; i++ {
+		_, next, err := readName(msg, off)
+		if err != nil {
+			return err
+		}
+		off = next + 4
+	}
+	for i := 0; i < count; i++ {
+		name, next, err := readName(msg, off)
+		if err != nil {
+			return err
+		}
+		if next+10 > len(msg) {
+			return errors.New("record out of bounds")
+		}
+		rtype := binary.BigEndian.Uint16(msg[next:])
+		length := int(binary.BigEndian.Uint16(msg[next+8:]))
+		data := next + 10
+		if data+length > len(msg) {
+			return errors.New("record data out of bounds")
+		}
+		switch rtype {
+		case dnsTypePTR:
+			instance, _, err := readName(msg, data)
+			if err != nil {
+				return err
+			}
+			for _, service := range mdnsServices {
+				if strings.EqualFold(name, service) {
+					r.instances[instance] = true
+				}
+			}
+		case dnsTypeSRV:
+			if length < 7 {
+				return errors.New("invalid SRV record")
+			}
+			target, _, err := readName(msg, data+6)
+			if err != nil {
+				return err
+			}
+			port := int(binary.BigEndian.Uint16(msg[data+4:]))
+			r.srv[name] = mdnsSRV{target, port}
+		case dnsTypeA:
+			if length != 4 {
+				return errors.New("invalid A record")
+			}
+			ip := net.IP(msg[data : data+4]).String()
+			if !containsString(r.addrs[name], ip) {
+				r.addrs[name] = append(r.addrs[name], ip)
+			}
+		}
+		off = data + length
+	}
+	return nil
+}
+
+func containsString(strs []string, s string) bool {
+	for _, str := range strs {
+		if str == s {
+			return true
+		}
+	}
+	return false
+}
+
+// devices returns the discovered Shelly devices sorted by name. The same
+// device announcing several services is returned only once.
+func (r *mdnsRecords) devices() []DiscoveredDevice {
+	byName := map[string]DiscoveredDevice{}
+	for instance := range r.instances {
+		name := strings.SplitN(instance, ".", 2)[0]
+		isShelly := strings.HasSuffix(strings.ToLower(instance), "._shelly._tcp.local.")
+		if !isShelly && !strings.Contains(strings.ToLower(name), "shelly") {
+			continue
+		}
+		device := byName[name]
+		device.Name = name
+		if srv, ok := r.srv[instance]; ok {
+			device.Host = strings.TrimSuffix(srv.target, ".")
+			if device.Port == 0 || isShelly {
+				device.Port = srv.port
+			}
+			for _, addr := range r.addrs[srv.target] {
+				if !containsString(device.Addrs, addr) {
+					device.Addrs = append(device.Addrs, addr)
+				}
+			}
+		}
+		if device.Addrs == nil {
+			device.Addrs = []string{}
+		}
+		byName[name] = device
+	}
+	devices := []DiscoveredDevice{}
+	for _, device := range byName {
+		devices = append(devices, device)
+	}
+	sort.Slice(devices, func(i, j int) bool { return devices[i].Name < devices[j].Name })
+	return devices
+}
@@ -0,0 +1,227 @@
+package shelly
+
+import (
+	"encoding/hex"
+	"reflect"
+	"testing"
+)
+
+// mdnsResponses are responses of a Gen2 device announcing _shelly._tcp, a
+// Gen1 device and a printer announcing _http._tcp, with names compressed
+// like devices do.
+var mdnsResponses = []string{
+	// header: response, 0 questions, 1 answers, 3 additional
+	"000084000000000100000003" +
+		// PTR _shelly._tcp.local.
+		"075f7368656c6c79045f746370056c6f63616c00" +
+		// type PTR, class IN, TTL 4500, instance shellyplus1pm-a8032ab12345, compressed
+		"000c000100001194001d1a7368656c6c79706c757331706d2d613830333261623132333435c00c" +
+		// SRV of instance, compressed name
+		"c02a" +
+		// type SRV, class IN, TTL 120, port 80, target shellyplus1pm-a8032ab12345.local., compressed
+		"002180010000007800230000000000501a7368656c6c79706c757331706d2d613830333261623132333435c019" +
+		// TXT of instance, ignored
+		"c02a001080010000007800120567656e3d320b6170703d506c757331504d" +
+		// A of target, compressed name, 192.168.1.50
+		"c05900018001000000780004c0a80132",
+
+	// header: response, 0 questions, 1 answers, 2 additional
+	"000084000000000100000002" +
+		// PTR _http._tcp.local.
+		"055f68747470045f746370056c6f63616c00" +
+		// type PTR, class IN, TTL 4500, instance shelly1-98CDAC1F2B3C, compressed
+		"000c0001000011940017147368656c6c79312d393843444143314632423343c00c" +
+		// SRV of instance, compressed name
+		"c028" +
+		// type SRV, class IN, TTL 120, port 80, target shelly1-98CDAC1F2B3C.local., compressed
+		"0021800100000078001d000000000050147368656c6c79312d393843444143314632423343c017" +
+		// A of target, compressed name, 192.168.1.51
+		"c05100018001000000780004c0a80133",
+
+	// header: response, 0 questions, 1 answers, 2 additional
+	"000084000000000100000002" +
+		// PTR _http._tcp.local.
+		"055f68747470045f746370056c6f63616c00" +
+		// type PTR, class IN, TTL 4500, instance Printer, compressed
+		"000c000100001194000a075072696e746572c00c" +
+		// SRV of instance, compressed name
+		"c028" +
+		// type SRV, class IN, TTL 120, port 631, target printer.local., compressed
+		"00218001000000780010000000000277077072696e746572c017" +
+		// A of target, compressed name, 192.168.1.9
+		"c04400018001000000780004c0a80109",
+}
+
+// mdnsUnicastResponse is a unicast response of a Gen2 device to the query of
+// mdnsQuery, laid out as the devices send it: the questions are echoed, the
+// device answers for both services, and the additional records include TXT,
+// AAAA and NSEC records, which are skipped. Names are compressed also with
+// pointers into the data of earlier records and into the middle of names.
+const mdnsUnicastResponse = "" +
+	// header: id 0, response, 2 questions, 2 answers, 6 additional
+	"000084000002000200000006" +
+	// question _shelly._tcp.local. PTR IN
+	"075f7368656c6c79045f746370056c6f63616c00000c0001" +
+	// question _http._tcp.local. PTR IN, _tcp.local. compressed
+	"055f68747470c014000c0001" +
+	// PTR _shelly._tcp.local. -> ShellyPlus1PM-A8032AB12345._shelly._tcp.local.
+	"c00c000c000100000078001d1a5368656c6c79506c757331504d2d413830333241423132333435c00c" +
+	// PTR _http._tcp.local. -> ShellyPlus1PM-A8032AB12345._http._tcp.local.
+	"c024000c000100000078001d1a5368656c6c79506c757331504d2d413830333241423132333435c024" +
+	// SRV of _shelly._tcp instance, port 80, target ShellyPlus1PM-A8032AB12345.local.
+	"c03c002180010000007800230000000000501a5368656c6c79506c757331504d2d413830333241423132333435c019" +
+	// SRV of _http._tcp instance, port 80, target compressed into the previous SRV
+	"c06500218001000000780008000000000050c094" +
+	// TXT of _shelly._tcp instance: gen=2, app=Plus1PM, ver=1.0.8
+	"c03c0010800100000078001c0567656e3d320b6170703d506c757331504d097665723d312e302e38" +
+	// A of target, 192.168.1.50
+	"c09400018001000000780004c0a80132" +
+	// AAAA of target, fe80::a3a:2bff:fe12:3456
+	"c094001c8001000000780010fe800000000000000a3a2bfffe123456" +
+	// NSEC of target
+	"c094002f8001000000780009c09400054000000008"
+
+func newMDNSRecords() mdnsRecords {
+	return mdnsRecords{
+		instances: map[string]bool{},
+		srv:       map[string]mdnsSRV{},
+		addrs:     map[string][]string{},
+	}
+}
+
+func decodeHex(t *testing.T, s string) []byte {
+	t.Helper()
+	msg, err := hex.DecodeString(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return msg
+}
+
+func TestMDNSParse(t *testing.T) {
+	records := newMDNSRecords()
+	for i, response := range mdnsResponses {
+		if err := records.parse(decodeHex(t, response)); err != nil {
+			t.Fatalf("response %d: %s", i, err)
+		}
+	}
+	want := []DiscoveredDevice{
+		{"shelly1-98CDAC1F2B3C", "shelly1-98CDAC1F2B3C.local", 80, []string{"192.168.1.51"}},
+		{"shellyplus1pm-a8032ab12345", "shellyplus1pm-a8032ab12345.local", 80, []string{"192.168.1.50"}},
+	}
+	if got := records.devices(); !reflect.DeepEqual(got, want) {
+		t.Errorf("got devices %+v, want %+v", got, want)
+	}
+}
+
+func TestMDNSParseTruncated(t *testing.T) {
+	msg := decodeHex(t, mdnsResponses[0])
+	for n := 0; n < len(msg); n++ {
+		records := newMDNSRecords()
+		if err := records.parse(msg[:n]); err == nil {
+			t.Errorf("response truncated to %d bytes of %d parsed without error", n, len(msg))
+		}
+	}
+}
+
+func TestMDNSParseUnicastResponse(t *testing.T) {
+	records := newMDNSRecords()
+	if err := records.parse(decodeHex(t, mdnsUnicastResponse)); err != nil {
+		t.Fatal(err)
+	}
+	// The device answering for both services is listed once.
+	want := []DiscoveredDevice{
+		{"ShellyPlus1PM-A8032AB12345", "ShellyPlus1PM-A8032AB12345.local", 80, []string{"192.168.1.50"}},
+	}
+	if got := records.devices(); !reflect.DeepEqual(got, want) {
+		t.Errorf("got devices %+v, want %+v", got, want)
+	}
+	msg := decodeHex(t, mdnsUnicastResponse)
+	for n := 0; n < len(msg); n++ {
+		records := newMDNSRecords()
+		if err := records.parse(msg[:n]); err == nil {
+			t.Errorf("response truncated to %d bytes of %d parsed without error", n, len(msg))
+		}
+	}
+}
+
+func TestReadNameCompressed(t *testing.T) {
+	msg := decodeHex(t, mdnsUnicastResponse)
+	tests := []struct {
+		off  int
+		name string
+		next int
+	}{
+		// Label followed by pointer into the middle of the first name.
+		{36, "_http._tcp.local.", 44},
+		// Target of SRV pointing into the data of the previous SRV, which
+		// ends with pointer to local.
+		{195, "ShellyPlus1PM-A8032AB12345.local.", 197},
+		{148, "ShellyPlus1PM-A8032AB12345.local.", 177},
+	}
+	for _, tt := range tests {
+		name, next, err := readName(msg, tt.off)
+		if err != nil || name != tt.name || next != tt.next {
+			t.Errorf("readName at %d: got %q, %d, %v, want %q, %d", tt.off, name, next, err, tt.name, tt.next)
+		}
+	}
+}
+
+func TestReadName(t *testing.T) {
+	msg := decodeHex(t, mdnsResponses[0])
+	tests := []struct {
+		off  int
+		name string
+		next int
+	}{
+		{12, "_shelly._tcp.local.", 32},
+		// Instance name ending with pointer to the service name.
+		{42, "shellyplus1pm-a8032ab12345._shelly._tcp.local.", 71},
+		// Pointer to the instance name.
+		{71, "shellyplus1pm-a8032ab12345._shelly._tcp.local.", 73},
+	}
+	for _, tt := range tests {
+		name, next, err := readName(msg, tt.off)
+		if err != nil || name != tt.name || next != tt.next {
+			t.Errorf("readName at %d: got %q, %d, %v, want %q, %d", tt.off, name, next, err, tt.name, tt.next)
+		}
+	}
+}
+
+func TestReadNameInvalid(t *testing.T) {
+	tests := map[string]string{
+		"pointer loop":         "c000",
+		"pointer to itself":    "0161c002",
+		"truncated pointer":    "c0",
+		"pointer out of range": "c0ff",
+		"label out of range":   "0561",
+		"missing terminator":   "0161",
+	}
+	for desc, s := range tests {
+		if name, _, err := readName(decodeHex(t, s), 0); err == nil {
+			t.Errorf("%s: got name %q, want error", desc, name)
+		}
+	}
+}
+
+func TestMDNSQuery(t *testing.T) {
+	msg := mdnsQuery(mdnsServices)
+	if questions := int(msg[4])<<8 | int(msg[5]); questions != len(mdnsServices) {
+		t.Fatalf("got %d questions, want %d", questions, len(mdnsServices))
+	}
+	off := 12
+	for _, service := range mdnsServices {
+		name, next, err := readName(msg, off)
+		if err != nil || name != service {
+			t.Fatalf("got question %q, %v, want %q", name, err, service)
+		}
+		// Type PTR, class IN with unicast response bit.
+		if got := hex.EncodeToString(msg[next : next+4]); got != "000c8001" {
+			t.Errorf("question %s: got type and class %s, want 000c8001", service, got)
+		}
+		off = next + 4
+	}
+	if off != len(msg) {
+		t.Errorf("got %d bytes after questions", len(msg)-off)
+	}
+}
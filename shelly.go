@@ -1,133 +1,348 @@
-package main
+// Package shelly implements scheduling relays of Shelly Gen2 devices over
+// the RPC API. The command line tool is in cmd/shelly.
+package shelly
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
-	"io/ioutil"
-	"log"
-	"net/http"
-	"os"
+	"math/rand"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
-const debug = false
-const appName = "shelly"
-
-// const timeFormat = "2006-01-02 15:04:05"
-
-func usage_onoff() {
-	fmt.Printf("Usage: %s onoff <relays> <timerange>\n\n", appName)
-	fmt.Println("  relays      Relay id or list of relay ids")
-	fmt.Println("  timerange   Date/time range")
-	fmt.Print("\nExamples:\n\n")
-	fmt.Printf("  %s onoff 0,1,2 today 17..18\n", appName)
-	fmt.Printf("  %s onoff 0 tomorrow 2..3\n", appName)
-	fmt.Print("\n\n")
-	fmt.Println("Note 1: by default, all earlier schedules are deleted before settings new ones.")
-	fmt.Println("Note 2: an offset to time is set according to formula <relay_id>*10 seconds.")
-}
-
+// ParseInts parses list of integers separated by sep, e.g. "0,1,2". Empty
+// tokens are skipped, so that empty input and leading, trailing or repeated
+// separators are accepted, e.g. "0,1," gives [0 1] and "" gives an empty
+// list. Whitespace around numbers is ignored, so "0, 1, 2" equals "0,1,2".
+// Negative numbers are accepted, range checks are left to the caller. Any
+// non-numeric token is an error, in which case no values are returned.
 func ParseInts(w string, sep string) ([]int, error) {
 	strs := strings.Split(w, sep)
 	res := []int{}
 	for _, s := range strs {
-		if debug {
-			log.Printf("Parsing string '%s' to integer", s)
-		}
+		debugf("Parsing string '%s' to integer", s)
+		s = strings.TrimSpace(s)
 		if s == "" {
 			continue
 		}
 		val, err := strconv.Atoi(s)
 		if err != nil {
-			return res, errors.New("invalid integer value: " + s)
+			return nil, errors.New("invalid integer value: " + s)
 		}
 		res = append(res, val)
 	}
 	return res, nil
 }
 
-func CheckConnection(uri string) error {
-	uri2 := uri + "Shelly.GetStatus"
-	log.Printf("Getting Shelly status from " + uri2)
-	resp, err := http.Get(uri2)
-	if err != nil {
-		return err
-	}
-	defer resp.Body.Close()
-	log.Printf("Response status code: %d\n", resp.StatusCode)
-	if resp.StatusCode != http.StatusOK {
-		return errors.New("status code != 200")
+func truncateToDay(t time.Time) time.Time {
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+}
+
+// atClock returns the time at clock time d of the day of date, e.g. 18:00 for
+// 18h, with hours 24 and above on the following days. The time is built from
+// the clock fields, so that it is correct also on days on which daylight
+// saving time begins or ends, unlike date.Add(d).
+func atClock(date time.Time, d time.Duration) time.Time {
+	secs := int(d / time.Second)
+	return time.Date(date.Year(), date.Month(), date.Day(), secs/3600, secs/60%60, secs%60,
+		int(d%time.Second), date.Location())
+}
+
+// clockOffset returns the clock time of t as offset from the beginning of
+// day, with hours 24 and above on the following days, see atClock.
+func clockOffset(day time.Time, t time.Time) time.Duration {
+	t = t.In(day.Location())
+	days := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC).Sub(
+		time.Date(day.Year(), day.Month(), day.Day(), 0, 0, 0, 0, time.UTC)) / (24 * time.Hour)
+	return days*24*time.Hour + time.Duration(t.Hour())*time.Hour +
+		time.Duration(t.Minute())*time.Minute + time.Duration(t.Second())*time.Second +
+		time.Duration(t.Nanosecond())
+}
+
+// Location is the time zone in which dates and times are parsed and the
+// schedules are planned, which should be the time zone of the device, see
+// DeviceTimezone. Defaults to the local time zone.
+var Location = time.Local
+
+// timeNow returns the current time, replaced in tests.
+var timeNow = time.Now
+
+// now returns the current time in Location.
+func now() time.Time {
+	return timeNow().In(Location)
+}
+
+// Today returns the beginning of the current day in Location.
+func Today() time.Time {
+	return truncateToDay(now())
+}
+
+// Tomorrow returns the beginning of the next day in Location.
+func Tomorrow() time.Time {
+	return Today().AddDate(0, 0, 1)
+}
+
+// Yesterday returns the beginning of the previous day in Location.
+func Yesterday() time.Time {
+	return Today().AddDate(0, 0, -1)
+}
+
+var weekdayNames = map[string]time.Weekday{
+	"sunday":    time.Sunday,
+	"monday":    time.Monday,
+	"tuesday":   time.Tuesday,
+	"wednesday": time.Wednesday,
+	"thursday":  time.Thursday,
+	"friday":    time.Friday,
+	"saturday":  time.Saturday,
+}
+
+// nextWeekday returns the next upcoming given weekday relative to today. If
+// today already is that weekday, the date one week from today is returned.
+func nextWeekday(weekday time.Weekday) time.Time {
+	t := Today()
+	days := (int(weekday) - int(t.Weekday()) + 7) % 7
+	if days == 0 {
+		days = 7
 	}
-	return nil
+	return t.AddDate(0, 0, days)
 }
 
-func ScheduleDeleteAll(uri string) error {
-	log.Printf("Removing old schedules ... ")
-	resp, err := http.Get(uri + "Schedule.DeleteAll")
+// ParseDate parses date given either as keyword (yesterday, today, tomorrow,
+// or weekday name monday ... sunday) or as ISO date (2006-01-02) in
+// Location. Weekday names resolve to the next upcoming occurrence of the weekday,
+// see nextWeekday. Keyword now resolves to the current moment, carrying also
+// the time of day, which is used as the base of relative time ranges.
+func ParseDate(datestr string) (time.Time, error) {
+	switch datestr {
+	case "now":
+		return now().Truncate(time.Second), nil
+	case "yesterday":
+		return Yesterday(), nil
+	case "today":
+		return Today(), nil
+	case "tomorrow":
+		return Tomorrow(), nil
+	}
+	if weekday, ok := weekdayNames[datestr]; ok {
+		return nextWeekday(weekday), nil
+	}
+	date, err := time.ParseInLocation("2006-01-02", datestr, Location)
 	if err != nil {
-		return err
+		return time.Time{}, errors.New("unknown date format: " + datestr + ", expected now, today, tomorrow, yesterday, weekday name or YYYY-MM-DD")
 	}
-	defer resp.Body.Close()
-	if resp.StatusCode == http.StatusOK {
-		bodyBytes, err := ioutil.ReadAll(resp.Body)
-		if err != nil {
-			return err
+	return truncateToDay(date), nil
+}
+
+// ParseDateTime parses date and time given as YYYY-MM-DD HH:MM[:SS] in
+// Location.
+func ParseDateTime(s string) (time.Time, error) {
+	for _, layout := range []string{"2006-01-02 15:04:05", "2006-01-02 15:04"} {
+		t, err := time.ParseInLocation(layout, strings.TrimSpace(s), Location)
+		if err == nil {
+			return t, nil
 		}
-		bodyString := string(bodyBytes)
-		log.Print("Schedules deleted, response: " + bodyString)
-	} else {
-		return errors.New("status code != 200")
 	}
-	return nil
+	return time.Time{}, errors.New("unknown date and time format: " + s + ", expected YYYY-MM-DD HH:MM[:SS]")
 }
 
-func truncateToDay(t time.Time) time.Time {
-	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+// RangeAt returns the date and the time range starting at t and lasting for
+// duration d, see PlanOnOffSchedule.
+func RangeAt(t time.Time, d time.Duration) (time.Time, TimeOffset) {
+	date := truncateToDay(t)
+	begin := clockOffset(date, t)
+	return date, TimeOffset{Begin: begin, End: begin + d}
 }
 
-func today() time.Time {
-	return truncateToDay(time.Now())
+// TimeOffset is a time range given as offsets from the beginning of a day,
+// or if Relative is set, as offsets from the current time of day. If
+// BeginEvent or EndEvent is set to Sunrise or Sunset, the corresponding offset
+// is from the time of the event, see ResolveSolar.
+type TimeOffset struct {
+	Begin, End           time.Duration
+	Relative             bool
+	BeginEvent, EndEvent string
 }
 
-func tomorrow() time.Time {
-	return today().AddDate(0, 0, 1)
+// Overnight returns true if the absolute time range ends at or before its
+// start, so that it ends on the following day, see PlanOnOffSchedule.
+func (offset TimeOffset) Overnight() bool {
+	return !offset.Relative && offset.End <= offset.Begin
 }
 
-func ParseDate(datestr string) (time.Time, error) {
-	if datestr == "today" {
-		return today(), nil
-	} else if datestr == "tomorrow" {
-		return tomorrow(), nil
-	} else {
-		return time.Time{}, errors.New("unknown date format: " + datestr)
+// String returns the time range as clock times, e.g. 17:00:00..18:00:00, or
+// as durations if relative, e.g. +1h0m0s..+2h0m0s.
+func (offset TimeOffset) String() string {
+	if offset.Relative {
+		return "+" + offset.Begin.String() + "..+" + offset.End.String()
+	}
+	return formatClock(offset.Begin) + ".." + formatClock(offset.End)
+}
+
+// clockField is a field of clock time, with values in range 0..limit.
+type clockField struct {
+	name  string
+	unit  time.Duration
+	limit int
+}
 
+var clockFields = []clockField{
+	{"hour", time.Hour, 23},
+	{"minute", time.Minute, 59},
+	{"second", time.Second, 59},
+}
+
+func parseClock(clockstr string) (time.Duration, error) {
+	strs := strings.Split(clockstr, ":")
+	if len(strs) > len(clockFields) {
+		return 0, errors.New("incorrect time format: " + clockstr + ", expected <hour>[:<minute>[:<second>]]")
+	}
+	var t time.Duration
+	for i, s := range strs {
+		field := clockFields[i]
+		val, err := strconv.Atoi(s)
+		if err != nil {
+			return 0, errors.New("invalid " + field.name + " value: " + s)
+		}
+		if val < 0 || val > field.limit {
+			return 0, fmt.Errorf("%s value out of range 0..%d: %s", field.name, field.limit, s)
+		}
+		t += field.unit * time.Duration(val)
 	}
+	return t, nil
 }
 
-type TimeOffset struct {
-	begin, end time.Duration
+// parseRelative parses time range +<start>..+<end>, where both start and end
+// are durations, e.g. +30m..+2h. Start now is the same as +0s.
+func parseRelative(start string, end string) (TimeOffset, error) {
+	if start == "now" {
+		start = "+0s"
+	}
+	if !strings.HasPrefix(start, "+") || !strings.HasPrefix(end, "+") {
+		return TimeOffset{}, errors.New("incorrect time format: " + start + ".." + end + ", relative and absolute times cannot be mixed")
+	}
+	s1, err := time.ParseDuration(start[1:])
+	if err != nil || s1 < 0 {
+		return TimeOffset{}, errors.New("invalid duration: " + start)
+	}
+	s2, err := time.ParseDuration(end[1:])
+	if err != nil || s2 < 0 {
+		return TimeOffset{}, errors.New("invalid duration: " + end)
+	}
+	if s2 <= s1 {
+		return TimeOffset{}, errors.New("incorrect time range: " + start + ".." + end + ", end must be after start")
+	}
+	return TimeOffset{Begin: s1, End: s2, Relative: true}, nil
 }
 
+// ParseTime parses time range <start>..<end>, where both start and end are
+// given as plain hours (17), hours and minutes (17:30) or hours, minutes and
+// seconds (17:30:15), each within its range, e.g. hours 0..23, or as solar
+// event sunrise or sunset with optional offset, e.g. sunset-30m. If start or
+// end is prefixed with +, the range is relative to the current time and given
+// as durations, e.g. +2h..+4h, or now..+1h starting right away.
 func ParseTime(hourstr string) (TimeOffset, error) {
-	hours, err := ParseInts(hourstr, "..")
+	strs := strings.Split(hourstr, "..")
+	if len(strs) != 2 {
+		return TimeOffset{}, errors.New("incorrect time format: <start>..<end>, where <start> and <end> are <hour>[:<minute>[:<second>]], sunrise[±<duration>], sunset[±<duration>] or +<duration>, and <start> may be now")
+	}
+	if strings.HasPrefix(strs[0], "+") || strings.HasPrefix(strs[1], "+") || strs[0] == "now" {
+		return parseRelative(strs[0], strs[1])
+	}
+	offset := TimeOffset{}
+	var err error
+	offset.BeginEvent, offset.Begin, err = parseTimePoint(strs[0])
 	if err != nil {
 		return TimeOffset{}, err
 	}
-	if len(hours) != 2 {
-		return TimeOffset{}, errors.New("incorrect time format: <hour_start>..<hour_end>")
+	offset.EndEvent, offset.End, err = parseTimePoint(strs[1])
+	if err != nil {
+		return TimeOffset{}, err
+	}
+	return offset, nil
+}
+
+// ParseTimeRanges parses comma separated list of time ranges, each parsed with
+// ParseTime, e.g. 8..9,17..18. Use ValidateRanges to check that the ranges do
+// not overlap, once solar events are resolved.
+func ParseTimeRanges(s string) ([]TimeOffset, error) {
+	offsets := []TimeOffset{}
+	for _, rangestr := range strings.Split(s, ",") {
+		rangestr = strings.TrimSpace(rangestr)
+		if rangestr == "" {
+			return nil, errors.New("empty time range in list: " + s)
+		}
+		offset, err := ParseTime(rangestr)
+		if err != nil {
+			return nil, err
+		}
+		offsets = append(offsets, offset)
+	}
+	return offsets, nil
+}
+
+// ValidateRanges returns an error if any two of the time ranges overlap or
+// touch, or if relative and absolute ranges are mixed. Touching ranges, e.g.
+// 8..9,9..10, would turn the relay off and on at the same time, so they are
+// given as one range instead. Overnight ranges end on the
+// following day, see PlanOnOffSchedule.
+func ValidateRanges(offsets []TimeOffset) error {
+	for i, a := range offsets {
+		for _, b := range offsets[i+1:] {
+			if a.Relative != b.Relative {
+				return errors.New("relative and absolute time ranges cannot be mixed")
+			}
+			aEnd, bEnd := a.End, b.End
+			if a.Overnight() {
+				aEnd += 24 * time.Hour
+			}
+			if b.Overnight() {
+				bEnd += 24 * time.Hour
+			}
+			if a.Begin <= bEnd && b.Begin <= aEnd {
+				return fmt.Errorf("time ranges %s..%s and %s..%s overlap or touch, give them as one range",
+					formatClock(a.Begin), formatClock(aEnd), formatClock(b.Begin), formatClock(bEnd))
+			}
+		}
+	}
+	return nil
+}
+
+// formatClock formats offset from the beginning of day as clock time, e.g.
+// 17:30:00. Offsets of the following day have hours 24 and above.
+func formatClock(d time.Duration) string {
+	return fmt.Sprintf("%02d:%02d:%02d", int(d.Hours()), int(d.Minutes())%60, int(d.Seconds())%60)
+}
+
+// parseTimePoint parses either clock time or solar event with offset.
+func parseTimePoint(s string) (string, time.Duration, error) {
+	event, d, err := parseSolar(s)
+	if err != nil || event != "" {
+		return event, d, err
 	}
-	s1 := time.Hour * time.Duration(hours[0])
-	s2 := time.Hour * time.Duration(hours[1])
-	return TimeOffset{s1, s2}, nil
+	d, err = parseClock(s)
+	return "", d, err
 }
 
-type Params struct {
-	Id int  `json:"id"`
-	On bool `json:"on"`
+// Params are the parameters of RPC call, e.g. {"id": 0, "on": true}.
+type Params map[string]interface{}
+
+// switchParams returns params id and on, together with the extra params.
+func switchParams(id int, on bool, extra Params) Params {
+	params := Params{}
+	for key, val := range extra {
+		params[key] = val
+	}
+	params["id"] = id
+	params["on"] = on
+	return params
 }
 
 type Call struct {
@@ -141,85 +356,1063 @@ type Schedule struct {
 	Calls    []Call `json:"calls"`
 }
 
-func getTimeSpec(t time.Time) string {
-	weekdays := []string{"SUN", "MON", "TUE", "WED", "THU", "FRI", "SAT"}
-	return fmt.Sprintf("%d %d %d %d %d %s", t.Second(), t.Minute(), t.Hour(),
-		t.Day(), t.Month(), weekdays[int(t.Weekday())])
+// ScheduleJob is a schedule as listed by Schedule.List.
+type ScheduleJob struct {
+	ID       int    `json:"id"`
+	Enable   bool   `json:"enable"`
+	TimeSpec string `json:"timespec"`
+	Calls    []Call `json:"calls"`
 }
 
-func createSchedulePayload(rid int, t time.Time, status bool) ([]byte, error) {
-	params := Params{rid, status}
-	call := Call{"Switch.Set", params}
-	calls := []Call{call}
-	schedule := Schedule{true, getTimeSpec(t), calls}
-	return json.Marshal(schedule)
+// ScheduleList calls Schedule.List and returns the existing schedules.
+func ScheduleList(ctx context.Context, client *Client, uri string) ([]ScheduleJob, error) {
+	var result struct {
+		Jobs []ScheduleJob `json:"jobs"`
+	}
+	err := rpcCall(ctx, client, uri, "Schedule.List", nil, &result)
+	if err != nil {
+		return nil, err
+	}
+	return result.Jobs, nil
 }
 
-func sendSchedulePayload(uri string, payload []byte) error {
-	resp, err := http.Post(uri+"Schedule.Create", "application/json", bytes.NewBuffer(payload))
+// ScheduleDelete calls Schedule.Delete removing the schedule with given id.
+func ScheduleDelete(ctx context.Context, client *Client, uri string, id int) error {
+	if client.DryRun {
+		infof("Dry run, schedule %d not deleted", id)
+		return nil
+	}
+	var result struct {
+		Rev *int `json:"rev"`
+	}
+	err := rpcCall(ctx, client, uri, "Schedule.Delete", map[string]int{"id": id}, &result)
 	if err != nil {
 		return err
 	}
-	defer resp.Body.Close()
-	if resp.StatusCode == http.StatusOK {
-		bodyBytes, err := ioutil.ReadAll(resp.Body)
-		if err != nil {
-			return err
+	if result.Rev == nil {
+		return fmt.Errorf("deleting schedule %d not confirmed by device", id)
+	}
+	return nil
+}
+
+// ScheduleSetEnabled calls Schedule.Update enabling or disabling the schedule
+// with given id.
+func ScheduleSetEnabled(ctx context.Context, client *Client, uri string, id int, enable bool) error {
+	var result struct {
+		Rev *int `json:"rev"`
+	}
+	params := struct {
+		ID     int  `json:"id"`
+		Enable bool `json:"enable"`
+	}{id, enable}
+	err := rpcCall(ctx, client, uri, "Schedule.Update", params, &result)
+	if err != nil {
+		return err
+	}
+	if result.Rev == nil {
+		return fmt.Errorf("updating schedule %d not confirmed by device", id)
+	}
+	return nil
+}
+
+// ScheduleUpdate calls Schedule.Update replacing the timespec, calls and
+// enabled state of the schedule with given id, keeping the id.
+func ScheduleUpdate(ctx context.Context, client *Client, uri string, id int, schedule Schedule) error {
+	if client.DryRun {
+		infof("Dry run, schedule %d not updated", id)
+		return nil
+	}
+	var result struct {
+		Rev *int `json:"rev"`
+	}
+	params := struct {
+		ID int `json:"id"`
+		Schedule
+	}{id, schedule}
+	err := rpcCall(ctx, client, uri, "Schedule.Update", params, &result)
+	if err != nil {
+		return err
+	}
+	if result.Rev == nil {
+		return fmt.Errorf("updating schedule %d not confirmed by device", id)
+	}
+	return nil
+}
+
+// ScheduleCollisions returns the existing schedules having the same timespec
+// as any of the planned schedules.
+func ScheduleCollisions(jobs []ScheduleJob, plan []OnOffSchedule, opts ScheduleOptions) []ScheduleJob {
+	timespecs := map[string]bool{}
+	for _, c := range plannedCalls(plan, opts) {
+		timespecs[c.timespec] = true
+	}
+	collisions := []ScheduleJob{}
+	for _, job := range jobs {
+		if timespecs[job.TimeSpec] {
+			collisions = append(collisions, job)
+		}
+	}
+	return collisions
+}
+
+// weekdayAbbrs are the abbreviations of weekdays in timespecs, indexed by
+// time.Weekday, Sunday being 0.
+var weekdayAbbrs = []string{"SUN", "MON", "TUE", "WED", "THU", "FRI", "SAT"}
+
+// weekdayAbbr returns the abbreviation of weekday, or ? if out of range, which
+// is then rejected by ValidateTimeSpec.
+func weekdayAbbr(weekday time.Weekday) string {
+	if weekday < 0 || int(weekday) >= len(weekdayAbbrs) {
+		return "?"
+	}
+	return weekdayAbbrs[weekday]
+}
+
+// getTimeSpec returns the timespec firing once at time t, or if repeat is
+// given, at the time of day of t on every weekday in repeat.
+func getTimeSpec(t time.Time, repeat []time.Weekday) string {
+	if len(repeat) == 0 {
+		return fmt.Sprintf("%d %d %d %d %d %s", t.Second(), t.Minute(), t.Hour(),
+			t.Day(), t.Month(), weekdayAbbr(t.Weekday()))
+	}
+	weekdays := "*"
+	if len(repeat) < len(weekdayAbbrs) {
+		strs := []string{}
+		for _, weekday := range repeat {
+			strs = append(strs, weekdayAbbr(weekday))
+		}
+		weekdays = strings.Join(strs, ",")
+	}
+	return fmt.Sprintf("%d %d %d * * %s", t.Second(), t.Minute(), t.Hour(), weekdays)
+}
+
+// monthAbbrs are the abbreviations of months in timespecs, January being 1.
+var monthAbbrs = []string{"JAN", "FEB", "MAR", "APR", "MAY", "JUN", "JUL", "AUG", "SEP", "OCT", "NOV", "DEC"}
+
+// timeSpecField is a field of timespec with values in range min..max, given
+// as numbers or as names, which are the values from min on.
+type timeSpecField struct {
+	name     string
+	min, max int
+	names    []string
+}
+
+var timeSpecFields = []timeSpecField{
+	{"second", 0, 59, nil},
+	{"minute", 0, 59, nil},
+	{"hour", 0, 23, nil},
+	{"day", 1, 31, nil},
+	{"month", 1, 12, monthAbbrs},
+	{"weekday", 0, 6, weekdayAbbrs},
+}
+
+// value parses a single value of the field, a number or a name.
+func (f timeSpecField) value(s string) (int, bool) {
+	for i, name := range f.names {
+		if strings.EqualFold(s, name) {
+			return f.min + i, true
+		}
+	}
+	value, err := strconv.Atoi(s)
+	return value, err == nil && value >= f.min && value <= f.max
+}
+
+// validate checks the field given as comma separated list of values, ranges
+// of values and *, each with optional step, e.g. MON-FRI, */5 or 0-30/10.
+func (f timeSpecField) validate(s string) error {
+	for _, item := range strings.Split(s, ",") {
+		span, step, hasStep := strings.Cut(item, "/")
+		if n, err := strconv.Atoi(step); hasStep && (err != nil || n < 1) {
+			return fmt.Errorf("invalid step of %s: %s", f.name, item)
+		}
+		if span == "*" {
+			continue
+		}
+		first, last, isRange := strings.Cut(span, "-")
+		lo, ok := f.value(first)
+		hi := lo
+		if ok && isRange {
+			hi, ok = f.value(last)
+		}
+		if !ok {
+			expected := fmt.Sprintf("%d..%d", f.min, f.max)
+			if f.names != nil {
+				expected += " or " + f.names[0] + ".." + f.names[len(f.names)-1]
+			}
+			return fmt.Errorf("%s %s out of range %s", f.name, item, expected)
+		}
+		if hi < lo {
+			return fmt.Errorf("invalid range of %s: %s", f.name, item)
+		}
+	}
+	return nil
+}
+
+// ValidateTimeSpec returns an error if the timespec is not of the form
+// "<second> <minute> <hour> <day> <month> <weekday>" understood by the
+// device. Like in cron, each field is * or comma separated list of values and
+// ranges of values, e.g. 0,30 or MON-FRI, each with optional step, e.g. */5.
+// Months and weekdays may be given as abbreviations JAN..DEC and SUN..SAT.
+// Timespecs of solar events created on the device, e.g. @sunset, are accepted
+// as such.
+func ValidateTimeSpec(spec string) error {
+	if strings.HasPrefix(spec, "@") {
+		return nil
+	}
+	fields := strings.Fields(spec)
+	if len(fields) != len(timeSpecFields) {
+		return fmt.Errorf("invalid timespec %q: expected %d fields, got %d", spec, len(timeSpecFields), len(fields))
+	}
+	for i, f := range timeSpecFields {
+		if err := f.validate(fields[i]); err != nil {
+			return fmt.Errorf("invalid timespec %q: %w", spec, err)
 		}
-		bodyString := string(bodyBytes)
-		log.Print("Schedule created, response: " + bodyString)
-	} else {
-		return errors.New("status code != 200")
 	}
 	return nil
 }
 
-func onoff() int {
-	if len(os.Args) < 5 {
-		usage_onoff()
-		os.Exit(1)
+// ParseRepeat parses weekdays on which the schedule repeats. Accepted values
+// are daily, weekdays, weekends, or comma separated list of weekday
+// abbreviations, e.g. mon,wed,fri.
+func ParseRepeat(repeatstr string) ([]time.Weekday, error) {
+	switch repeatstr {
+	case "daily":
+		return []time.Weekday{time.Sunday, time.Monday, time.Tuesday,
+			time.Wednesday, time.Thursday, time.Friday, time.Saturday}, nil
+	case "weekdays":
+		return []time.Weekday{time.Monday, time.Tuesday, time.Wednesday,
+			time.Thursday, time.Friday}, nil
+	case "weekends":
+		return []time.Weekday{time.Sunday, time.Saturday}, nil
 	}
-	relay_ids, err := ParseInts(os.Args[2], ",")
+	seen := map[time.Weekday]bool{}
+	for _, s := range strings.Split(repeatstr, ",") {
+		found := false
+		for i, abbr := range weekdayAbbrs {
+			if strings.EqualFold(s, abbr) {
+				seen[time.Weekday(i)] = true
+				found = true
+			}
+		}
+		if !found {
+			return nil, errors.New("unknown repeat value: " + s + ", expected daily, weekdays, weekends or list of sun,mon,...,sat")
+		}
+	}
+	repeat := []time.Weekday{}
+	for i := range weekdayAbbrs {
+		if seen[time.Weekday(i)] {
+			repeat = append(repeat, time.Weekday(i))
+		}
+	}
+	return repeat, nil
+}
+
+func createSchedulePayload(schedule Schedule, opts ScheduleOptions) ([]byte, error) {
+	schedule.Enable = !opts.Disabled
+	return json.Marshal(schedule)
+}
+
+// ScheduleCreateResult is the result of Schedule.Create call.
+type ScheduleCreateResult struct {
+	ID  *int `json:"id"`
+	Rev int  `json:"rev"`
+}
+
+// sendSchedulePayload creates the schedule and returns the id of the created
+// schedule.
+func sendSchedulePayload(ctx context.Context, client *Client, uri string, payload []byte) (int, error) {
+	if client.DryRun {
+		debugf("Dry run, schedule not sent")
+		return 0, nil
+	}
+	var result ScheduleCreateResult
+	err := rpcCall(ctx, client, uri, "Schedule.Create", json.RawMessage(payload), &result)
 	if err != nil {
-		log.Fatal(err)
+		return 0, err
 	}
-	ip, ok := os.LookupEnv("SHELLY_IP")
-	if !ok {
-		log.Fatal("Environment variable SHELLY_IP not set")
+	if result.ID == nil {
+		return 0, errors.New("unexpected response from Schedule.Create, schedule id missing")
 	}
-	uri := "http://" + ip + "/rpc/"
+	return *result.ID, nil
+}
 
-	date, err := ParseDate(os.Args[3])
+// ScheduleCreate creates the schedule as such, e.g. a schedule listed by
+// ScheduleList on another device, and returns the id of the created schedule.
+func ScheduleCreate(ctx context.Context, client *Client, uri string, schedule Schedule) (int, error) {
+	if err := ValidateTimeSpec(schedule.TimeSpec); err != nil {
+		return 0, err
+	}
+	payload, err := json.Marshal(schedule)
 	if err != nil {
-		log.Fatal(err)
+		return 0, err
 	}
-	extraInfo := ""
-	if date == today() {
-		extraInfo += " (today)"
+	if client.DryRun {
+		infof("Payload for schedule at %q: %s", schedule.TimeSpec, payload)
+	} else {
+		debugf("Payload for schedule at %q: %s", schedule.TimeSpec, payload)
 	}
-	if date == tomorrow() {
-		extraInfo += " (tomorrow)"
+	return sendSchedulePayload(ctx, client, uri, payload)
+}
+
+// SwitchStatus is the status of a single switch component switch:<id>. The
+// power metering fields are nil for devices without power metering.
+type SwitchStatus struct {
+	ID      int            `json:"id"`
+	Output  bool           `json:"output"`
+	APower  *float64       `json:"apower"`
+	Voltage *float64       `json:"voltage"`
+	Current *float64       `json:"current"`
+	AEnergy *EnergyCounter `json:"aenergy"`
+}
+
+// EnergyCounter is the accumulated energy of a switch.
+type EnergyCounter struct {
+	Total float64 `json:"total"`
+}
+
+// SwitchGetStatus calls Switch.GetStatus and returns the status of the relay.
+func SwitchGetStatus(ctx context.Context, client *Client, uri string, id int) (SwitchStatus, error) {
+	var result SwitchStatus
+	err := rpcCall(ctx, client, uri, "Switch.GetStatus", map[string]int{"id": id}, &result)
+	return result, err
+}
+
+// SwitchConfig is the configuration of a relay, as returned by
+// Switch.GetConfig. Name is nil if the relay has not been named. With
+// AutoOff, the relay turns itself off AutoOffDelay seconds after turned on.
+type SwitchConfig struct {
+	ID           int     `json:"id"`
+	Name         *string `json:"name"`
+	AutoOff      bool    `json:"auto_off"`
+	AutoOffDelay float64 `json:"auto_off_delay"`
+}
+
+// SwitchGetConfig calls Switch.GetConfig and returns the configuration of the
+// relay.
+func SwitchGetConfig(ctx context.Context, client *Client, uri string, id int) (SwitchConfig, error) {
+	var result SwitchConfig
+	err := rpcCall(ctx, client, uri, "Switch.GetConfig", map[string]int{"id": id}, &result)
+	return result, err
+}
+
+// SwitchSetAutoOff calls Switch.SetConfig setting the built-in auto-off timer
+// of the relay, turning it off after delay whenever turned on, or disabling
+// the timer if delay is zero. Returns the configuration of the relay as
+// applied by the device. On Gen1 devices, Gen1SetAutoOff is used instead.
+func SwitchSetAutoOff(ctx context.Context, client *Client, uri string, id int, delay time.Duration) (SwitchConfig, error) {
+	if client.Gen == Gen1 {
+		settings, err := Gen1SetAutoOff(ctx, client, uri, id, delay)
+		return SwitchConfig{ID: id, AutoOff: settings.AutoOff > 0, AutoOffDelay: settings.AutoOff}, err
+	}
+	config := map[string]interface{}{"auto_off": delay > 0}
+	if delay > 0 {
+		config["auto_off_delay"] = delay.Seconds()
+	}
+	var result struct {
+		RestartRequired bool `json:"restart_required"`
+	}
+	params := map[string]interface{}{"id": id, "config": config}
+	if err := rpcCall(ctx, client, uri, "Switch.SetConfig", params, &result); err != nil {
+		return SwitchConfig{}, err
+	}
+	if result.RestartRequired {
+		warnf("Device must be restarted to apply the configuration of relay %d", id)
+	}
+	return SwitchGetConfig(ctx, client, uri, id)
+}
+
+// RelayNames returns the configured names of the relays. Relays without a
+// name are left out.
+func RelayNames(ctx context.Context, client *Client, uri string, ids []int) (map[int]string, error) {
+	names := map[int]string{}
+	for _, id := range ids {
+		config, err := SwitchGetConfig(ctx, client, uri, id)
+		if err != nil {
+			return names, err
+		}
+		if config.Name != nil && *config.Name != "" {
+			names[id] = *config.Name
+		}
 	}
-	log.Printf("Settings relays for date " + date.Format("2006-01-02") + extraInfo)
-	timeOffset, err := ParseTime(os.Args[4])
+	return names, nil
+}
+
+// ResolveRelays parses comma separated list of relays given either as ids or
+// as names configured to the device, e.g. "boiler,1". Tokens consisting of
+// digits are taken as ids, while names are matched case-insensitively. The
+// names are fetched from the device only if the list contains names.
+func ResolveRelays(ctx context.Context, client *Client, uri string, list string) ([]int, error) {
+	ids := []int{}
+	var names map[int]string
+	for _, token := range strings.Split(list, ",") {
+		token = strings.TrimSpace(token)
+		if token == "" {
+			continue
+		}
+		if id, err := strconv.Atoi(token); err == nil {
+			ids = append(ids, id)
+			continue
+		}
+		if names == nil {
+			status, err := GetStatus(ctx, client, uri)
+			if err != nil {
+				return nil, err
+			}
+			all := []int{}
+			for _, sw := range status.Switches {
+				all = append(all, sw.ID)
+			}
+			names, err = RelayNames(ctx, client, uri, all)
+			if err != nil {
+				return nil, err
+			}
+		}
+		id, ok := relayByName(names, token)
+		if !ok {
+			return nil, fmt.Errorf("relay %q not found, device has relays named %s", token, formatNames(names))
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+func relayByName(names map[int]string, name string) (int, bool) {
+	for id, n := range names {
+		if strings.EqualFold(n, name) {
+			return id, true
+		}
+	}
+	return 0, false
+}
+
+// formatNames returns the names and ids of relays sorted by id, e.g.
+// "boiler (0), pump (1)".
+func formatNames(names map[int]string) string {
+	ids := []int{}
+	for id := range names {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	strs := []string{}
+	for _, id := range ids {
+		strs = append(strs, fmt.Sprintf("%s (%d)", names[id], id))
+	}
+	if len(strs) == 0 {
+		return "none"
+	}
+	return strings.Join(strs, ", ")
+}
+
+// Status is the parsed result of Shelly.GetStatus.
+type Status struct {
+	Switches []SwitchStatus
+}
+
+// parseStatus parses the result of Shelly.GetStatus. The result must be a JSON
+// object with component sys, which every Shelly device has, so that e.g. an
+// error page of a proxy is not taken as the status of a device without relays.
+func parseStatus(data []byte) (Status, error) {
+	components := map[string]json.RawMessage{}
+	err := json.Unmarshal(data, &components)
 	if err != nil {
-		log.Fatal(err)
+		return Status{}, errors.New("unexpected response from Shelly.GetStatus, not a Shelly device status: " + snippet(data))
+	}
+	if _, ok := components["sys"]; !ok {
+		return Status{}, errors.New("unexpected response from Shelly.GetStatus, component sys missing: " + snippet(data))
+	}
+	status := Status{Switches: []SwitchStatus{}}
+	for key, raw := range components {
+		if !strings.HasPrefix(key, "switch:") {
+			continue
+		}
+		var sw SwitchStatus
+		err = json.Unmarshal(raw, &sw)
+		if err != nil {
+			return Status{}, errors.New("invalid status of " + key + ": " + err.Error())
+		}
+		status.Switches = append(status.Switches, sw)
+	}
+	sort.Slice(status.Switches, func(i, j int) bool {
+		return status.Switches[i].ID < status.Switches[j].ID
+	})
+	return status, nil
+}
+
+// ValidateRelays returns an error if any of the relay ids does not match a
+// switch component of the device.
+func ValidateRelays(status Status, relayIDs []int) error {
+	available := map[int]bool{}
+	for _, sw := range status.Switches {
+		available[sw.ID] = true
+	}
+	for _, rid := range relayIDs {
+		if !available[rid] {
+			return fmt.Errorf("relay %d not found, device has %d relays", rid, len(status.Switches))
+		}
+	}
+	return nil
+}
+
+// AllRelays returns the ids of all relays of the device, i.e. switch
+// components in the status of Gen2 devices, or relays in the status of Gen1
+// devices. Returns an error if the device has no relays.
+func AllRelays(ctx context.Context, client *Client, uri string) ([]int, error) {
+	ids := []int{}
+	if client.Gen == Gen1 {
+		var status struct {
+			Relays []Gen1Relay `json:"relays"`
+		}
+		if err := gen1Get(ctx, client, uri, "status", nil, &status); err != nil {
+			return nil, err
+		}
+		for id := range status.Relays {
+			ids = append(ids, id)
+		}
+	} else {
+		status, err := GetStatus(ctx, client, uri)
+		if err != nil {
+			return nil, err
+		}
+		for _, sw := range status.Switches {
+			ids = append(ids, sw.ID)
+		}
 	}
+	if len(ids) == 0 {
+		return nil, errors.New("device has no relays")
+	}
+	return ids, nil
+}
 
-	err = CheckConnection(uri)
+// GetStatus calls Shelly.GetStatus and returns the parsed status.
+func GetStatus(ctx context.Context, client *Client, uri string) (Status, error) {
+	var result json.RawMessage
+	err := rpcCall(ctx, client, uri, "Shelly.GetStatus", nil, &result)
 	if err != nil {
-		log.Fatal(err)
+		return Status{}, err
 	}
+	return parseStatus(result)
+}
 
-	err = ScheduleDeleteAll(uri)
+// SwitchSet calls Switch.Set turning the relay on or off. On Gen1 devices,
+// the relay is switched with the REST API instead.
+func SwitchSet(ctx context.Context, client *Client, uri string, id int, on bool) error {
+	if client.Gen == Gen1 {
+		turn := "off"
+		if on {
+			turn = "on"
+		}
+		_, err := Gen1RelaySet(ctx, client, uri, id, turn, 0)
+		return err
+	}
+	return rpcCall(ctx, client, uri, "Switch.Set", switchParams(id, on, nil), nil)
+}
+
+// SwitchSetToggleAfter calls Switch.Set with param toggle_after, turning the
+// relay on or off and having the device flip it back after the duration,
+// without schedules. On Gen1 devices, the timer of the relay is used instead,
+// with the precision of a second.
+func SwitchSetToggleAfter(ctx context.Context, client *Client, uri string, id int, on bool, after time.Duration) error {
+	if client.Gen == Gen1 {
+		turn := "off"
+		if on {
+			turn = "on"
+		}
+		_, err := Gen1RelaySet(ctx, client, uri, id, turn, after)
+		return err
+	}
+	params := switchParams(id, on, Params{"toggle_after": after.Seconds()})
+	return rpcCall(ctx, client, uri, "Switch.Set", params, nil)
+}
+
+// SwitchToggle calls Switch.Toggle for the relay and returns the resulting
+// state of the relay. On Gen1 devices, the relay is toggled with the REST API
+// instead.
+func SwitchToggle(ctx context.Context, client *Client, uri string, id int) (bool, error) {
+	if client.Gen == Gen1 {
+		relay, err := Gen1RelaySet(ctx, client, uri, id, "toggle", 0)
+		return relay.IsOn, err
+	}
+	var result struct {
+		WasOn bool `json:"was_on"`
+	}
+	err := rpcCall(ctx, client, uri, "Switch.Toggle", map[string]int{"id": id}, &result)
 	if err != nil {
-		log.Fatal(err)
+		return false, err
+	}
+	return !result.WasOn, nil
+}
+
+// CheckConnection checks that the device responds with a valid status,
+// discarding the status, and returns the round-trip time of the request,
+// including retries. Use GetStatus instead if the status is needed as well.
+// On Gen1 devices, /shelly is requested instead.
+func CheckConnection(ctx context.Context, client *Client, uri string) (time.Duration, error) {
+	start := time.Now()
+	if client.Gen == Gen1 {
+		err := gen1Get(ctx, client, uri, "shelly", nil, nil)
+		return time.Since(start), err
+	}
+	debugf("Getting Shelly status from %s", uri+"Shelly.GetStatus")
+	_, err := GetStatus(ctx, client, uri)
+	return time.Since(start), err
+}
+
+// SysConfig is the part of the result of Sys.GetConfig used here.
+type SysConfig struct {
+	Location struct {
+		TZ  string   `json:"tz"`
+		Lat *float64 `json:"lat"`
+		Lon *float64 `json:"lon"`
+	} `json:"location"`
+}
+
+// SysGetConfig calls Sys.GetConfig.
+func SysGetConfig(ctx context.Context, client *Client, uri string) (SysConfig, error) {
+	var config SysConfig
+	err := rpcCall(ctx, client, uri, "Sys.GetConfig", nil, &config)
+	return config, err
+}
+
+// DeviceTimezone returns the time zone configured to the device.
+func DeviceTimezone(ctx context.Context, client *Client, uri string) (*time.Location, error) {
+	config, err := SysGetConfig(ctx, client, uri)
+	if err != nil {
+		return nil, err
+	}
+	if config.Location.TZ == "" {
+		return nil, errors.New("time zone of device is not set")
+	}
+	return time.LoadLocation(config.Location.TZ)
+}
+
+// DeviceInfo is the result of Shelly.GetDeviceInfo, identifying the device.
+type DeviceInfo struct {
+	Name       string `json:"name"`
+	ID         string `json:"id"`
+	MAC        string `json:"mac"`
+	Model      string `json:"model"`
+	Gen        int    `json:"gen"`
+	FirmwareID string `json:"fw_id"`
+	Version    string `json:"ver"`
+	App        string `json:"app,omitempty"`
+}
+
+// GetDeviceInfo calls Shelly.GetDeviceInfo. On Gen1 devices, the info is read
+// from /shelly, which has the model as type and the firmware as fw.
+func GetDeviceInfo(ctx context.Context, client *Client, uri string) (DeviceInfo, error) {
+	var info DeviceInfo
+	if client.Gen == Gen1 {
+		var gen1 struct {
+			Type string `json:"type"`
+			MAC  string `json:"mac"`
+			FW   string `json:"fw"`
+		}
+		err := gen1Get(ctx, client, uri, "shelly", nil, &gen1)
+		return DeviceInfo{MAC: gen1.MAC, Model: gen1.Type, Gen: Gen1, FirmwareID: gen1.FW}, err
+	}
+	err := rpcCall(ctx, client, uri, "Shelly.GetDeviceInfo", nil, &info)
+	return info, err
+}
+
+// Reboot calls Shelly.Reboot. The device acknowledges the call before
+// rebooting, and is unreachable for a while after that.
+func Reboot(ctx context.Context, client *Client, uri string) error {
+	debugf("Rebooting device %s", uri)
+	return rpcCall(ctx, client, uri, "Shelly.Reboot", nil, nil)
+}
+
+// ScheduleDeleteAll calls Schedule.DeleteAll deleting all schedules of the
+// device. The schedules are listed first to log how many are deleted, and
+// Schedule.DeleteAll is not called at all if there are none.
+func ScheduleDeleteAll(ctx context.Context, client *Client, uri string) error {
+	jobs, err := ScheduleList(ctx, client, uri)
+	if err != nil {
+		return err
+	}
+	if len(jobs) == 0 {
+		infof("No old schedules to remove")
+		return nil
+	}
+	infof("Removing %d old schedules ... ", len(jobs))
+	if client.DryRun {
+		infof("Dry run, schedules not deleted")
+		return nil
+	}
+	return rpcCall(ctx, client, uri, "Schedule.DeleteAll", nil, nil)
+}
+
+// OnOffSchedule is a planned pair of schedules turning the relay on and off.
+type OnOffSchedule struct {
+	Relay   int
+	On, Off time.Time
+}
+
+// DefaultStagger is the default time between schedules of relays with
+// consecutive ids.
+const DefaultStagger = 2 * time.Second
+
+// DefaultMethod is the RPC method called to switch relays.
+const DefaultMethod = "Switch.Set"
+
+// DefaultRate is the default maximum number of requests per second sent when
+// creating schedules, so that devices are not overwhelmed by large relay
+// lists.
+const DefaultRate = 5.0
+
+// ScheduleOptions are the options for planning on/off schedules.
+type ScheduleOptions struct {
+	// Stagger is the time between schedules of relays with consecutive
+	// ids. Zero means all relays are switched simultaneously.
+	Stagger time.Duration
+	// Repeat is the weekdays on which the schedules repeat. If empty, the
+	// schedules fire only once at the given date, see ParseRepeat.
+	Repeat []time.Weekday
+	// Disabled creates the schedules disabled, so that they do not fire
+	// until enabled, see ScheduleSetEnabled.
+	Disabled bool
+	// Method is the RPC method called with params id and on to switch the
+	// relays, e.g. Light.Set for lights. Defaults to Switch.Set if empty.
+	Method string
+	// Params are the extra params of the calls, e.g. {"brightness": 50} for
+	// Light.Set. Params id and on are always set by the schedule.
+	Params Params
+	// OnOnly creates only the schedules turning the relays on, and OffOnly
+	// only the schedules turning the relays off at the end of the range.
+	OnOnly, OffOnly bool
+	// NoRollback leaves the schedules already created on the device if
+	// creating the rest of them fails, see CreateOnOffSchedule.
+	NoRollback bool
+	// Rate is the maximum number of requests per second sent to the device
+	// when creating, updating and deleting the schedules. Zero means no
+	// limit.
+	Rate float64
+	// Concurrency is the number of schedules created in parallel. Values
+	// below 2 create the schedules one at a time.
+	Concurrency int
+}
+
+// DefaultScheduleOptions returns the default options.
+func DefaultScheduleOptions() ScheduleOptions {
+	return ScheduleOptions{Stagger: DefaultStagger, Method: DefaultMethod, Rate: DefaultRate}
+}
+
+// offRepeat returns the weekdays on which the off schedule repeats, that is,
+// repeat shifted by the number of days from on time to off time.
+func (p OnOffSchedule) offRepeat(repeat []time.Weekday) []time.Weekday {
+	days := 0
+	for d := truncateToDay(p.On); d.Before(truncateToDay(p.Off)); d = d.AddDate(0, 0, 1) {
+		days++
+	}
+	shifted := []time.Weekday{}
+	for _, weekday := range repeat {
+		shifted = append(shifted, (weekday+time.Weekday(days))%7)
+	}
+	sort.Slice(shifted, func(i, j int) bool { return shifted[i] < shifted[j] })
+	return shifted
+}
+
+// PlanOnOffSchedule plans schedules turning the relays on and off at the
+// given date, within time range offset. The schedule of each relay is shifted
+// by <relay id>*opts.Stagger, so that the shift of a relay does not depend on
+// the other relays in the list. If offset.End <= offset.Begin, the range is
+// overnight and relays are turned off on the following day. Relative offsets
+// are counted from date, if it has a time of day (see ParseDate), otherwise
+// from the current time of day at the given date. Absolute offsets are clock
+// times, see atClock.
+func PlanOnOffSchedule(relayIDs []int, date time.Time, offset TimeOffset, opts ScheduleOptions) []OnOffSchedule {
+	plan := []OnOffSchedule{}
+	if !offset.Relative {
+		date = truncateToDay(date)
+	} else if date.Equal(truncateToDay(date)) {
+		t := now()
+		date = time.Date(date.Year(), date.Month(), date.Day(), t.Hour(),
+			t.Minute(), t.Second(), 0, date.Location())
+	}
+	for _, rid := range relayIDs {
+		stagger := opts.Stagger * time.Duration(rid)
+		d1 := date.Add(offset.Begin + stagger)
+		d2 := date.Add(offset.End + stagger)
+		if !offset.Relative {
+			d1 = atClock(date, offset.Begin+stagger)
+			d2 = atClock(date, offset.End+stagger)
+		}
+		if offset.Overnight() {
+			d2 = atClock(date.AddDate(0, 0, 1), offset.End+stagger)
+		}
+		plan = append(plan, OnOffSchedule{rid, d1, d2})
+	}
+	return plan
+}
+
+// PlanOnOffSchedules plans schedules for each of the time ranges at the given
+// date, see PlanOnOffSchedule.
+func PlanOnOffSchedules(relayIDs []int, date time.Time, offsets []TimeOffset, opts ScheduleOptions) []OnOffSchedule {
+	plan := []OnOffSchedule{}
+	for _, offset := range offsets {
+		plan = append(plan, PlanOnOffSchedule(relayIDs, date, offset, opts)...)
+	}
+	return plan
+}
+
+// JitterPlan shifts the on and off times of the planned schedules each by a
+// random duration between -jitter and jitter, in whole seconds, e.g. to make
+// an empty house look occupied. The shifts are drawn from a source seeded
+// with seed, so that the same seed always gives the same times. The off time
+// is kept after the on time.
+func JitterPlan(plan []OnOffSchedule, jitter time.Duration, seed int64) []OnOffSchedule {
+	secs := int64(jitter / time.Second)
+	if secs <= 0 {
+		return plan
 	}
+	rng := rand.New(rand.NewSource(seed))
+	shift := func() time.Duration {
+		return time.Duration(rng.Int63n(2*secs+1)-secs) * time.Second
+	}
+	jittered := []OnOffSchedule{}
+	for _, p := range plan {
+		p.On = p.On.Add(shift())
+		p.Off = p.Off.Add(shift())
+		if !p.Off.After(p.On) {
+			p.Off = p.On.Add(time.Second)
+		}
+		jittered = append(jittered, p)
+	}
+	return jittered
+}
+
+// ScheduleSwitchAt creates a single schedule turning the relays on or off once
+// at time t, e.g. turning relays off after they have been turned on for a
+// while. The timespec is built from t as such, so t must be in the time zone
+// of the device. Returns the id of the created schedule, see
+// CreatePlannedSchedules.
+func ScheduleSwitchAt(ctx context.Context, client *Client, uri string, relayIDs []int, t time.Time, on bool) ([]int, error) {
+	plan := []OnOffSchedule{}
+	for _, rid := range relayIDs {
+		plan = append(plan, OnOffSchedule{Relay: rid, On: t, Off: t})
+	}
+	opts := ScheduleOptions{Method: DefaultMethod, OnOnly: on, OffOnly: !on}
+	return CreatePlannedSchedules(ctx, client, uri, t, plan, opts)
+}
+
+// plannedCall is a call of the planned schedules, to be run at timespec.
+type plannedCall struct {
+	timespec string
+	call     Call
+}
+
+// plannedCalls returns the calls turning the relays on and off, leaving out
+// the on calls if opts.OffOnly is set and the off calls if opts.OnOnly is set.
+func plannedCalls(plan []OnOffSchedule, opts ScheduleOptions) []plannedCall {
+	method := opts.Method
+	if method == "" {
+		method = DefaultMethod
+	}
+	calls := []plannedCall{}
+	for _, p := range plan {
+		if !opts.OffOnly {
+			calls = append(calls, plannedCall{getTimeSpec(p.On, opts.Repeat), Call{method, switchParams(p.Relay, true, opts.Params)}})
+		}
+		if !opts.OnOnly {
+			calls = append(calls, plannedCall{getTimeSpec(p.Off, p.offRepeat(opts.Repeat)), Call{method, switchParams(p.Relay, false, opts.Params)}})
+		}
+	}
+	return calls
+}
+
+// rollbackSchedules deletes the schedules with given ids and returns the ids
+// of the schedules which could not be deleted. The schedules are deleted even
+// if the context of the failed operation was cancelled.
+func rollbackSchedules(client *Client, uri string, ids []int) []int {
+	left := []int{}
+	for _, id := range ids {
+		infof("Rolling back schedule %d", id)
+		err := ScheduleDelete(context.Background(), client, uri, id)
+		if err != nil {
+			warnf("Rolling back schedule %d failed: %s", id, err)
+			left = append(left, id)
+		}
+	}
+	return left
+}
+
+// DefaultMaxSchedules is the typical maximum number of schedules on device.
+const DefaultMaxSchedules = 20
+
+// rateLimiter spaces requests to at most rate per second with a ticker. The
+// first request is not delayed. A nil limiter does not limit requests.
+type rateLimiter struct {
+	ticker  *time.Ticker
+	started bool
+}
+
+// newRateLimiter returns a limiter for rate requests per second, or nil if
+// rate is not positive or nothing is sent to the device in dry run.
+func newRateLimiter(client *Client, rate float64) *rateLimiter {
+	if rate <= 0 || client.DryRun {
+		return nil
+	}
+	return &rateLimiter{ticker: time.NewTicker(time.Duration(float64(time.Second) / rate))}
+}
+
+// wait waits until the next request may be sent, or until the context is
+// cancelled. A cancelled context is reported even if a tick is pending.
+func (l *rateLimiter) wait(ctx context.Context) error {
+	if l == nil {
+		return nil
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if !l.started {
+		l.started = true
+		return nil
+	}
+	select {
+	case <-l.ticker.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// stop releases the ticker of the limiter.
+func (l *rateLimiter) stop() {
+	if l != nil {
+		l.ticker.Stop()
+	}
+}
+
+// ScheduleCount returns the number of schedules created for the plan, see
+// CreateOnOffSchedule.
+func ScheduleCount(plan []OnOffSchedule, opts ScheduleOptions) int {
+	return len(groupSchedules(plan, opts))
+}
+
+// groupSchedules collects the calls of the planned schedules into schedules,
+// one per timespec. The device runs all calls of a schedule at the same time,
+// so the on and off calls of a relay always need separate schedules, but the
+// calls of several relays switched at the same time, e.g. with zero stagger,
+// share a single schedule.
+func groupSchedules(plan []OnOffSchedule, opts ScheduleOptions) []Schedule {
+	schedules := []Schedule{}
+	index := map[string]int{}
+	for _, c := range plannedCalls(plan, opts) {
+		if i, ok := index[c.timespec]; ok {
+			schedules[i].Calls = append(schedules[i].Calls, c.call)
+			continue
+		}
+		index[c.timespec] = len(schedules)
+		schedules = append(schedules, Schedule{true, c.timespec, []Call{c.call}})
+	}
+	return schedules
+}
+
+// CreateOnOffSchedule creates schedules turning the relays on and off at the
+// given date, within time range offset, see PlanOnOffSchedule. Calls with the
+// same timespec are grouped into a single schedule, see groupSchedules.
+// Returns the ids of the created schedules, which is empty in dry run. If
+// creating any schedule fails, the schedules already created are deleted
+// unless opts.NoRollback is set, and the ids of the schedules left on the
+// device are returned together with the error.
+func CreateOnOffSchedule(ctx context.Context, client *Client, uri string, relayIDs []int, date time.Time, offset TimeOffset, opts ScheduleOptions) ([]int, error) {
+	return CreatePlannedSchedules(ctx, client, uri, date, PlanOnOffSchedule(relayIDs, date, offset, opts), opts)
+}
+
+// CreatePlannedSchedules creates the schedules of the plan made at the given
+// date, e.g. with PlanOnOffSchedules, see CreateOnOffSchedule.
+func CreatePlannedSchedules(ctx context.Context, client *Client, uri string, date time.Time, plan []OnOffSchedule, opts ScheduleOptions) ([]int, error) {
+	logPlan(date, plan, opts)
+	schedules := groupSchedules(plan, opts)
+	for _, schedule := range schedules {
+		if err := ValidateTimeSpec(schedule.TimeSpec); err != nil {
+			return []int{}, err
+		}
+	}
+	limiter := newRateLimiter(client, opts.Rate)
+	defer limiter.stop()
+	ids, err := createSchedules(ctx, client, uri, schedules, opts, limiter)
+	if err != nil && !opts.NoRollback {
+		return rollbackSchedules(client, uri, ids), err
+	}
+	return ids, err
+}
 
-	for i, rid := range relay_ids {
-		offset := time.Second * time.Duration(2*i)
-		d1 := date.Add(timeOffset.begin + offset)
-		d2 := date.Add(timeOffset.end + offset)
+// createSchedules creates the schedules with opts.Concurrency workers, sent
+// as allowed by the limiter, and returns the ids of the created schedules in
+// the order of schedules. The payloads are logged in order
+// before sending any of them, so that the log does not depend on the order
+// in which the requests complete. After a failure, no more schedules are
+// sent, and the ids of the schedules created so far are returned with the
+// first error.
+func createSchedules(ctx context.Context, client *Client, uri string, schedules []Schedule, opts ScheduleOptions, limiter *rateLimiter) ([]int, error) {
+	logPayload := debugf
+	if client.DryRun {
+		logPayload = infof
+	}
+	payloads := make([][]byte, len(schedules))
+	for i, schedule := range schedules {
+		payload, err := createSchedulePayload(schedule, opts)
+		if err != nil {
+			return []int{}, err
+		}
+		logPayload("Payload for schedule at %q: %s", schedule.TimeSpec, payload)
+		payloads[i] = payload
+	}
+	workers := opts.Concurrency
+	if workers < 1 || client.webSocket() != nil {
+		// Calls over the WebSocket connection are sent one at a time anyway.
+		workers = 1
+	}
+	ids := make([]int, len(payloads))
+	errs := make([]error, len(payloads))
+	sent := make([]bool, len(payloads))
+	var failed atomic.Bool
+	var wg sync.WaitGroup
+	jobs := make(chan int)
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				if failed.Load() {
+					continue
+				}
+				sent[i] = true
+				ids[i], errs[i] = sendSchedulePayload(ctx, client, uri, payloads[i])
+				if errs[i] != nil {
+					failed.Store(true)
+				}
+			}
+		}()
+	}
+	for i := range payloads {
+		if failed.Load() {
+			break
+		}
+		if errs[i] = limiter.wait(ctx); errs[i] != nil {
+			break
+		}
+		jobs <- i
+	}
+	close(jobs)
+	wg.Wait()
+	created := []int{}
+	var err error
+	for i := range payloads {
+		if errs[i] != nil && err == nil {
+			err = errs[i]
+		}
+		if sent[i] && errs[i] == nil && !client.DryRun {
+			created = append(created, ids[i])
+		}
+	}
+	return created, err
+}
+
+// logPlan logs the planned times of each relay.
+func logPlan(date time.Time, plan []OnOffSchedule, opts ScheduleOptions) {
+	for _, p := range plan {
+		rid, d1, d2 := p.Relay, p.On, p.Off
 		f1 := d1.Format("15:04:05")
 		f2 := d2.Format("15:04:05")
 		if (date.Format("2006-01-02") != d1.Format("2006-01-02")) ||
@@ -228,51 +1421,154 @@ func onoff() int {
 			f2 = d2.Format("2006-01-02 15:04:05")
 		}
 
-		log.Printf("Settings relay %d on between: %s ... %s\n", rid, f1, f2)
-		payload, err := createSchedulePayload(rid, d1, true)
-		if err != nil {
-			log.Fatal(err)
+		switch {
+		case opts.OnOnly:
+			infof("Settings relay %d on at: %s", rid, f1)
+		case opts.OffOnly:
+			infof("Settings relay %d off at: %s", rid, f2)
+		default:
+			infof("Settings relay %d on between: %s ... %s", rid, f1, f2)
 		}
-		log.Print("Payload for turn relay on: " + string(payload))
-		err = sendSchedulePayload(uri, payload)
-		if err != nil {
-			log.Fatal(err)
+	}
+}
+
+// sameCalls returns true if both lists have the same calls in the same
+// order. Params are compared as JSON, as the params of listed schedules are
+// decoded with numbers as float64.
+func sameCalls(a []Call, b []Call) bool {
+	aj, err1 := json.Marshal(a)
+	bj, err2 := json.Marshal(b)
+	return err1 == nil && err2 == nil && bytes.Equal(aj, bj)
+}
+
+// PlanSchedules returns the schedules created for the plan, enabled unless
+// opts.Disabled is set, see groupSchedules.
+func PlanSchedules(plan []OnOffSchedule, opts ScheduleOptions) []Schedule {
+	schedules := groupSchedules(plan, opts)
+	for i := range schedules {
+		schedules[i].Enable = !opts.Disabled
+	}
+	return schedules
+}
+
+// ScheduleChanges are the changes setting the planned schedules to a device
+// with existing schedules, see DiffSchedules.
+type ScheduleChanges struct {
+	// Kept are the ids of existing schedules identical to planned ones.
+	Kept []int
+	// Updated are the existing schedules updated to planned ones, with the
+	// timespec and calls of the planned schedule.
+	Updated []ScheduleJob
+	// Deleted are the existing schedules not reused.
+	Deleted []ScheduleJob
+	// Created are the planned schedules not matching existing ones.
+	Created []Schedule
+}
+
+// Empty returns true if the schedules already exist on the device.
+func (c ScheduleChanges) Empty() bool {
+	return len(c.Updated) == 0 && len(c.Deleted) == 0 && len(c.Created) == 0
+}
+
+// DiffSchedules returns the changes setting the planned schedules, reusing
+// the existing schedules: an existing schedule identical to a planned one is
+// kept as such. With update, an existing schedule with the same calls is
+// updated to a planned one, so that only its timespec changes. The existing
+// schedules not reused are deleted, and the rest of the planned schedules
+// are created.
+func DiffSchedules(schedules []Schedule, existing []ScheduleJob, update bool) ScheduleChanges {
+	changes := ScheduleChanges{Kept: []int{}, Updated: []ScheduleJob{}, Deleted: []ScheduleJob{}, Created: []Schedule{}}
+	// Identical schedules are matched first, so that they are not taken
+	// for updating other schedules.
+	matched := make([]bool, len(schedules))
+	used := map[int]bool{}
+	for i, schedule := range schedules {
+		for _, job := range existing {
+			if !used[job.ID] && job.Enable == schedule.Enable && job.TimeSpec == schedule.TimeSpec && sameCalls(job.Calls, schedule.Calls) {
+				changes.Kept = append(changes.Kept, job.ID)
+				matched[i], used[job.ID] = true, true
+				break
+			}
 		}
-		payload, err = createSchedulePayload(rid, d2, false)
-		if err != nil {
-			log.Fatal(err)
+	}
+	for i, schedule := range schedules {
+		if matched[i] || !update {
+			continue
 		}
-		log.Print("Payload for turn relay off: " + string(payload))
-		err = sendSchedulePayload(uri, payload)
-		if err != nil {
-			log.Fatal(err)
+		for _, job := range existing {
+			if !used[job.ID] && sameCalls(job.Calls, schedule.Calls) {
+				changes.Updated = append(changes.Updated, ScheduleJob{job.ID, schedule.Enable, schedule.TimeSpec, schedule.Calls})
+				matched[i], used[job.ID] = true, true
+				break
+			}
 		}
 	}
-	log.Println("Everything done!")
-	return 0
-}
-
-func usage() {
-	fmt.Printf("Usage: %s <command> [<args>]\n\n", appName)
-	fmt.Println("Command to easily turn relays on and off:")
-	fmt.Println("  onoff      turn relay of list of relays on and off at certain time")
-	fmt.Print("\nExamples:\n\n")
-	fmt.Printf("  %s onoff 0,1,2 today 17..18\n", appName)
-	fmt.Printf("  %s onoff 0 tomorrow 2..3\n", appName)
-	fmt.Print("\n\n")
-	fmt.Println("Note 1: by default, all earlier schedules are deleted before settings new ones.")
-	fmt.Println("Note 2: an offset to time is set according to formula <relay_id>*10 seconds.")
+	for _, job := range existing {
+		if !used[job.ID] {
+			changes.Deleted = append(changes.Deleted, job)
+		}
+	}
+	for i, schedule := range schedules {
+		if !matched[i] {
+			changes.Created = append(changes.Created, schedule)
+		}
+	}
+	return changes
 }
 
-func main() {
-	if len(os.Args) < 2 {
-		usage()
-		os.Exit(1)
+// SyncPlannedSchedules sets the schedules of the plan like
+// CreatePlannedSchedules, but reuses the given existing schedules, so that
+// running the same plan twice does not write to the device, see
+// DiffSchedules. Updated schedules keep their ids, which is useful if
+// something refers to them. The existing schedules not reused are deleted
+// before creating the rest, so that the device does not run out of
+// schedules. Returns the ids of the kept, updated and created schedules, and
+// the ids of the deleted schedules. Updated schedules are not rolled back on
+// failure.
+func SyncPlannedSchedules(ctx context.Context, client *Client, uri string, date time.Time, plan []OnOffSchedule, opts ScheduleOptions, existing []ScheduleJob, update bool) ([]int, []int, error) {
+	ids, deleted := []int{}, []int{}
+	logPlan(date, plan, opts)
+	schedules := PlanSchedules(plan, opts)
+	for _, schedule := range schedules {
+		if err := ValidateTimeSpec(schedule.TimeSpec); err != nil {
+			return ids, deleted, err
+		}
 	}
-	if os.Args[1] == "onoff" {
-		os.Exit(onoff())
-	} else {
-		usage()
-		os.Exit(1)
+	changes := DiffSchedules(schedules, existing, update)
+	if changes.Empty() {
+		infof("No changes, the schedules already exist on the device")
+	}
+	limiter := newRateLimiter(client, opts.Rate)
+	defer limiter.stop()
+	for _, job := range changes.Deleted {
+		infof("Deleting schedule %d", job.ID)
+		if err := limiter.wait(ctx); err != nil {
+			return ids, deleted, err
+		}
+		if err := ScheduleDelete(ctx, client, uri, job.ID); err != nil {
+			return ids, deleted, err
+		}
+		deleted = append(deleted, job.ID)
+	}
+	if !client.DryRun {
+		ids = append(ids, changes.Kept...)
+	}
+	for _, job := range changes.Updated {
+		infof("Updating schedule %d to %q", job.ID, job.TimeSpec)
+		schedule := Schedule{job.Enable, job.TimeSpec, job.Calls}
+		if err := limiter.wait(ctx); err != nil {
+			return ids, deleted, err
+		}
+		if err := ScheduleUpdate(ctx, client, uri, job.ID, schedule); err != nil {
+			return ids, deleted, err
+		}
+		if !client.DryRun {
+			ids = append(ids, job.ID)
+		}
+	}
+	created, err := createSchedules(ctx, client, uri, changes.Created, opts, limiter)
+	if err != nil && !opts.NoRollback {
+		created = rollbackSchedules(client, uri, created)
 	}
+	return append(ids, created...), deleted, err
 }
@@ -0,0 +1,729 @@
+package shelly
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+	_ "time/tzdata"
+)
+
+// setNow fixes the current time to at, and Location to the location of at,
+// for the duration of the test.
+func setNow(t *testing.T, at time.Time) {
+	t.Helper()
+	oldNow, oldLocation := timeNow, Location
+	timeNow = func() time.Time { return at }
+	Location = at.Location()
+	t.Cleanup(func() { timeNow, Location = oldNow, oldLocation })
+}
+
+func TestParseInts(t *testing.T) {
+	tests := []struct {
+		w, sep string
+		want   []int
+	}{
+		{"0,1,2", ",", []int{0, 1, 2}},
+		{"7", ",", []int{7}},
+		{"-1,10", ",", []int{-1, 10}},
+		{" 0 , 1\t,2 ", ",", []int{0, 1, 2}},
+		{"", ",", []int{}},
+		{"0,1,", ",", []int{0, 1}},
+		{",0,,1", ",", []int{0, 1}},
+		{" , ", ",", []int{}},
+		{"0;1;2", ";", []int{0, 1, 2}},
+		{"0 1  2", " ", []int{0, 1, 2}},
+		{"0..2", "..", []int{0, 2}},
+	}
+	for _, tt := range tests {
+		got, err := ParseInts(tt.w, tt.sep)
+		if err != nil {
+			t.Errorf("ParseInts(%q, %q): %s", tt.w, tt.sep, err)
+		} else if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("ParseInts(%q, %q) = %v, want %v", tt.w, tt.sep, got, tt.want)
+		}
+	}
+}
+
+func TestParseIntsSpaces(t *testing.T) {
+	want, err := ParseInts("0,1,2", ",")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, w := range []string{"0, 1, 2", "0 ,1 ,2", " 0,  1,\t2 "} {
+		got, err := ParseInts(w, ",")
+		if err != nil || !reflect.DeepEqual(got, want) {
+			t.Errorf("ParseInts(%q) = %v, %v, want %v as for %q", w, got, err, want, "0,1,2")
+		}
+	}
+}
+
+func TestParseIntsInvalid(t *testing.T) {
+	tests := []struct {
+		w, sep string
+	}{
+		{"a", ","},
+		{"0,x,2", ","},
+		{"1.5", ","},
+		{"0x10", ","},
+		{"1 2", ","},
+		{"0,1,2", ";"},
+	}
+	for _, tt := range tests {
+		if got, err := ParseInts(tt.w, tt.sep); err == nil || got != nil {
+			t.Errorf("ParseInts(%q, %q) = %v, %v, want error", tt.w, tt.sep, got, err)
+		}
+	}
+}
+
+func TestParseDateWeekday(t *testing.T) {
+	// 2024-03-10 is a Sunday.
+	setNow(t, time.Date(2024, 3, 10, 12, 30, 0, 0, time.UTC))
+	tests := []struct {
+		datestr string
+		want    string
+	}{
+		{"monday", "2024-03-11"},
+		{"friday", "2024-03-15"},
+		{"saturday", "2024-03-16"},
+		// Today already is sunday, so the next one is a week from today.
+		{"sunday", "2024-03-17"},
+		{"today", "2024-03-10"},
+		{"tomorrow", "2024-03-11"},
+		{"yesterday", "2024-03-09"},
+		{"2024-12-24", "2024-12-24"},
+	}
+	for _, tt := range tests {
+		date, err := ParseDate(tt.datestr)
+		if err != nil {
+			t.Fatalf("ParseDate(%q): %s", tt.datestr, err)
+		}
+		if got := date.Format("2006-01-02 15:04:05"); got != tt.want+" 00:00:00" {
+			t.Errorf("ParseDate(%q) = %s, want %s 00:00:00", tt.datestr, got, tt.want)
+		}
+	}
+}
+
+func TestParseDateWeekdayWrapAround(t *testing.T) {
+	// 2024-03-16 is a Saturday, the last day of the week.
+	setNow(t, time.Date(2024, 3, 16, 23, 59, 0, 0, time.UTC))
+	for name, weekday := range weekdayNames {
+		date, err := ParseDate(name)
+		if err != nil {
+			t.Fatalf("ParseDate(%q): %s", name, err)
+		}
+		days := int(date.Sub(Today()) / (24 * time.Hour))
+		if date.Weekday() != weekday || days < 1 || days > 7 {
+			t.Errorf("ParseDate(%q) = %s, want next %s within a week", name, date.Format("2006-01-02"), weekday)
+		}
+	}
+}
+
+func TestParseDateInvalid(t *testing.T) {
+	for _, datestr := range []string{"", "Monday", "mon", "2024-13-01", "2024-02-30"} {
+		if _, err := ParseDate(datestr); err == nil {
+			t.Errorf("ParseDate(%q) did not fail", datestr)
+		}
+	}
+}
+
+func TestPlanOnOffSchedulesSparseStagger(t *testing.T) {
+	date := time.Date(2024, 3, 10, 0, 0, 0, 0, time.UTC)
+	offsets := []TimeOffset{{Begin: 17 * time.Hour, End: 18 * time.Hour}}
+	opts := DefaultScheduleOptions()
+	opts.Stagger = 10 * time.Second
+	plan := PlanOnOffSchedules([]int{0, 5, 9}, date, offsets, opts)
+	if len(plan) != 3 {
+		t.Fatalf("got %d planned schedules, want 3", len(plan))
+	}
+	for _, p := range plan {
+		// The shift depends on the relay id, not on the position in list.
+		shift := time.Duration(p.Relay) * opts.Stagger
+		if want := date.Add(17*time.Hour + shift); !p.On.Equal(want) {
+			t.Errorf("relay %d on at %s, want %s", p.Relay, p.On, want)
+		}
+		if want := date.Add(18*time.Hour + shift); !p.Off.Equal(want) {
+			t.Errorf("relay %d off at %s, want %s", p.Relay, p.Off, want)
+		}
+	}
+}
+
+func TestPlanOnOffScheduleOvernight(t *testing.T) {
+	date := time.Date(2024, 3, 10, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		rangestr string
+		on, off  string
+	}{
+		{"23..1", "2024-03-10 23:00:00", "2024-03-11 01:00:00"},
+		{"22..6", "2024-03-10 22:00:00", "2024-03-11 06:00:00"},
+		{"22:30..22:30", "2024-03-10 22:30:00", "2024-03-11 22:30:00"},
+		{"6..22", "2024-03-10 06:00:00", "2024-03-10 22:00:00"},
+	}
+	for _, tt := range tests {
+		offset, err := ParseTime(tt.rangestr)
+		if err != nil {
+			t.Fatalf("ParseTime(%q): %s", tt.rangestr, err)
+		}
+		plan := PlanOnOffSchedule([]int{0}, date, offset, ScheduleOptions{})
+		on, off := plan[0].On.Format("2006-01-02 15:04:05"), plan[0].Off.Format("2006-01-02 15:04:05")
+		if on != tt.on || off != tt.off {
+			t.Errorf("%s: got %s..%s, want %s..%s", tt.rangestr, on, off, tt.on, tt.off)
+		}
+	}
+}
+
+func TestOvernightOffRepeat(t *testing.T) {
+	date := time.Date(2024, 3, 10, 0, 0, 0, 0, time.UTC)
+	offset, err := ParseTime("22..6")
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts := ScheduleOptions{Repeat: []time.Weekday{time.Friday, time.Saturday}}
+	calls := plannedCalls(PlanOnOffSchedule([]int{0}, date, offset, opts), opts)
+	// Turned on on friday and saturday evening, off on the following
+	// saturday and sunday morning.
+	want := []string{"0 0 22 * * FRI,SAT", "0 0 6 * * SUN,SAT"}
+	if len(calls) != len(want) {
+		t.Fatalf("got %d calls, want %d", len(calls), len(want))
+	}
+	for i, c := range calls {
+		if c.timespec != want[i] {
+			t.Errorf("call %d: got timespec %q, want %q", i, c.timespec, want[i])
+		}
+	}
+}
+
+func TestParseTime(t *testing.T) {
+	tests := []struct {
+		hourstr    string
+		begin, end time.Duration
+	}{
+		{"0..23", 0, 23 * time.Hour},
+		{"17..18", 17 * time.Hour, 18 * time.Hour},
+		{"23..0", 23 * time.Hour, 0},
+		{"17:30..18:45:15", 17*time.Hour + 30*time.Minute, 18*time.Hour + 45*time.Minute + 15*time.Second},
+		{"0:0:0..23:59:59", 0, 24*time.Hour - time.Second},
+	}
+	for _, tt := range tests {
+		offset, err := ParseTime(tt.hourstr)
+		if err != nil {
+			t.Errorf("ParseTime(%q): %s", tt.hourstr, err)
+			continue
+		}
+		if offset.Begin != tt.begin || offset.End != tt.end || offset.Relative {
+			t.Errorf("ParseTime(%q) = %s, want %s..%s", tt.hourstr, offset, formatClock(tt.begin), formatClock(tt.end))
+		}
+	}
+}
+
+func TestParseTimeOutOfRange(t *testing.T) {
+	for _, hourstr := range []string{
+		"24..1", "1..24", "25..30", "-1..2",
+		"17:60..18", "17..18:00:60", "17:-1..18",
+		"17", "17..18..19", "a..b", "17:00:00:00..18", "..18",
+	} {
+		if offset, err := ParseTime(hourstr); err == nil {
+			t.Errorf("ParseTime(%q) = %s, want error", hourstr, offset)
+		}
+	}
+}
+
+func TestParseTimeRanges(t *testing.T) {
+	h := time.Hour
+	tests := []struct {
+		s    string
+		want []TimeOffset
+	}{
+		{"8..9", []TimeOffset{{Begin: 8 * h, End: 9 * h}}},
+		{"8..9,17..18", []TimeOffset{{Begin: 8 * h, End: 9 * h}, {Begin: 17 * h, End: 18 * h}}},
+		{"6..7, 12..13 ,20..21", []TimeOffset{{Begin: 6 * h, End: 7 * h}, {Begin: 12 * h, End: 13 * h}, {Begin: 20 * h, End: 21 * h}}},
+		// The ranges are kept in the given order.
+		{"17..18,8..9", []TimeOffset{{Begin: 17 * h, End: 18 * h}, {Begin: 8 * h, End: 9 * h}}},
+		{"+1h..+2h,+3h..+4h", []TimeOffset{{Begin: 1 * h, End: 2 * h, Relative: true}, {Begin: 3 * h, End: 4 * h, Relative: true}}},
+		{"sunset..23,6..sunrise", []TimeOffset{{End: 23 * h, BeginEvent: Sunset}, {Begin: 6 * h, EndEvent: Sunrise}}},
+	}
+	for _, tt := range tests {
+		got, err := ParseTimeRanges(tt.s)
+		if err != nil {
+			t.Errorf("ParseTimeRanges(%q): %s", tt.s, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("ParseTimeRanges(%q) = %v, want %v", tt.s, got, tt.want)
+		}
+		// Ranges with solar events are validated once resolved.
+		if err := ValidateRanges(got); err != nil && !strings.Contains(tt.s, "sun") {
+			t.Errorf("ValidateRanges(%q): %s", tt.s, err)
+		}
+	}
+}
+
+func TestParseTimeRangesRelative(t *testing.T) {
+	tests := []struct {
+		s    string
+		want []TimeOffset
+	}{
+		{"now..+1h", []TimeOffset{{End: time.Hour, Relative: true}}},
+		{"+0s..+1h", []TimeOffset{{End: time.Hour, Relative: true}}},
+		{"+30m..+2h", []TimeOffset{{Begin: 30 * time.Minute, End: 2 * time.Hour, Relative: true}}},
+		{"now..+15m,+1h..+2h", []TimeOffset{{End: 15 * time.Minute, Relative: true}, {Begin: time.Hour, End: 2 * time.Hour, Relative: true}}},
+	}
+	for _, tt := range tests {
+		got, err := ParseTimeRanges(tt.s)
+		if err != nil {
+			t.Errorf("ParseTimeRanges(%q): %s", tt.s, err)
+		} else if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("ParseTimeRanges(%q) = %v, want %v", tt.s, got, tt.want)
+		}
+	}
+	invalid := []struct {
+		s   string
+		err string
+	}{
+		{"+2h..+1h", "end must be after start"},
+		{"+1h..+1h", "end must be after start"},
+		{"now..+0s", "end must be after start"},
+		{"+1h..now", "relative and absolute times cannot be mixed"},
+		{"now..17", "relative and absolute times cannot be mixed"},
+		{"17..+1h", "relative and absolute times cannot be mixed"},
+		{"+-1h..+1h", "invalid duration"},
+		{"now..+1x", "invalid duration"},
+	}
+	for _, tt := range invalid {
+		if got, err := ParseTimeRanges(tt.s); err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("ParseTimeRanges(%q) = %v, %v, want error containing %q", tt.s, got, err, tt.err)
+		}
+	}
+}
+
+func TestPlanRelativeFromNow(t *testing.T) {
+	loc, err := time.LoadLocation("Europe/Helsinki")
+	if err != nil {
+		t.Fatal(err)
+	}
+	at := time.Date(2024, 6, 1, 10, 15, 30, 0, loc)
+	setNow(t, at)
+	tests := []struct {
+		datestr, timerange string
+		on, off            time.Time
+	}{
+		{"now", "now..+1h", at, at.Add(time.Hour)},
+		{"now", "+1h..+2h", at.Add(time.Hour), at.Add(2 * time.Hour)},
+		// Relative ranges at a date are counted from the current time of
+		// day at that date.
+		{"today", "+1h..+2h", at.Add(time.Hour), at.Add(2 * time.Hour)},
+		{"tomorrow", "now..+1h", at.AddDate(0, 0, 1), at.AddDate(0, 0, 1).Add(time.Hour)},
+		// The computed times are in the past, and are not moved forward.
+		{"yesterday", "+1h..+2h", at.AddDate(0, 0, -1).Add(time.Hour), at.AddDate(0, 0, -1).Add(2 * time.Hour)},
+		{"2024-05-01", "now..+30m", at.AddDate(0, -1, 0), at.AddDate(0, -1, 0).Add(30 * time.Minute)},
+	}
+	for _, tt := range tests {
+		date, err := ParseDate(tt.datestr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		offsets, err := ParseTimeRanges(tt.timerange)
+		if err != nil {
+			t.Fatal(err)
+		}
+		plan := PlanOnOffSchedules([]int{0}, date, offsets, ScheduleOptions{})
+		if len(plan) != 1 || !plan[0].On.Equal(tt.on) || !plan[0].Off.Equal(tt.off) {
+			t.Errorf("%s %s: planned %v, want on at %s and off at %s", tt.datestr, tt.timerange, plan, tt.on, tt.off)
+		}
+	}
+}
+
+func TestParseTimeRangesInvalid(t *testing.T) {
+	tests := []struct {
+		s   string
+		err string
+	}{
+		{"8..9,,10..11", "empty time range"},
+		{"8..9,", "empty time range"},
+		{",8..9", "empty time range"},
+		{"", "empty time range"},
+		{"8..9,17", "incorrect time format"},
+		{"8..9,24..25", "out of range"},
+	}
+	for _, tt := range tests {
+		if got, err := ParseTimeRanges(tt.s); err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("ParseTimeRanges(%q) = %v, %v, want error containing %q", tt.s, got, err, tt.err)
+		}
+	}
+}
+
+func TestValidateRangesOverlap(t *testing.T) {
+	tests := []struct {
+		s   string
+		err string
+	}{
+		{"8..10,9..11", "time ranges 08:00:00..10:00:00 and 09:00:00..11:00:00 overlap"},
+		{"8..12,9..10", "overlap"},
+		{"9..11,8..10", "overlap"},
+		{"8..9,9..10", "time ranges 08:00:00..09:00:00 and 09:00:00..10:00:00 overlap or touch"},
+		{"17..18,8..9,8:30..8:45", "overlap"},
+		// Overnight range ends on the following day.
+		{"22..2,23..23:30", "overlap"},
+		{"+1h..+2h,+90m..+3h", "overlap"},
+		{"8..9,+1h..+2h", "relative and absolute time ranges cannot be mixed"},
+	}
+	for _, tt := range tests {
+		offsets, err := ParseTimeRanges(tt.s)
+		if err != nil {
+			t.Errorf("ParseTimeRanges(%q): %s", tt.s, err)
+			continue
+		}
+		if err := ValidateRanges(offsets); err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("ValidateRanges(%q) = %v, want error containing %q", tt.s, err, tt.err)
+		}
+	}
+}
+
+func TestPlanOnOffScheduleDST(t *testing.T) {
+	loc, err := time.LoadLocation("Europe/Helsinki")
+	if err != nil {
+		t.Fatal(err)
+	}
+	const format = "2006-01-02 15:04:05 MST"
+	tests := []struct {
+		date     string
+		rangestr string
+		on, off  string
+	}{
+		// Daylight saving time begins at 03:00 on 2024-03-31.
+		{"2024-03-31", "17..18", "2024-03-31 17:00:00 EEST", "2024-03-31 18:00:00 EEST"},
+		{"2024-03-31", "1..5", "2024-03-31 01:00:00 EET", "2024-03-31 05:00:00 EEST"},
+		{"2024-03-30", "22..6", "2024-03-30 22:00:00 EET", "2024-03-31 06:00:00 EEST"},
+		// Daylight saving time ends at 04:00 on 2024-10-27.
+		{"2024-10-27", "17..18", "2024-10-27 17:00:00 EET", "2024-10-27 18:00:00 EET"},
+		{"2024-10-26", "22..6", "2024-10-26 22:00:00 EEST", "2024-10-27 06:00:00 EET"},
+	}
+	for _, tt := range tests {
+		date, err := time.ParseInLocation("2006-01-02", tt.date, loc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		offset, err := ParseTime(tt.rangestr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		opts := ScheduleOptions{Stagger: 10 * time.Second}
+		plan := PlanOnOffSchedule([]int{0, 1}, date, offset, opts)
+		on, off := plan[0].On.Format(format), plan[0].Off.Format(format)
+		if on != tt.on || off != tt.off {
+			t.Errorf("%s %s: got %s..%s, want %s..%s", tt.date, tt.rangestr, on, off, tt.on, tt.off)
+		}
+		if d := plan[1].On.Sub(plan[0].On); d != opts.Stagger {
+			t.Errorf("%s %s: relay 1 shifted by %s, want %s", tt.date, tt.rangestr, d, opts.Stagger)
+		}
+	}
+}
+
+func TestRangeAtDST(t *testing.T) {
+	loc, err := time.LoadLocation("Europe/Helsinki")
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Date(2024, 3, 31, 17, 30, 0, 0, loc)
+	date, offset := RangeAt(start, time.Hour)
+	if offset.Begin != 17*time.Hour+30*time.Minute || offset.End != 18*time.Hour+30*time.Minute {
+		t.Errorf("RangeAt(%s) = %s, want 17:30:00..18:30:00", start, offset)
+	}
+	plan := PlanOnOffSchedule([]int{0}, date, offset, ScheduleOptions{})
+	if !plan[0].On.Equal(start) || !plan[0].Off.Equal(start.Add(time.Hour)) {
+		t.Errorf("got %s..%s, want %s..%s", plan[0].On, plan[0].Off, start, start.Add(time.Hour))
+	}
+}
+
+func TestDiffSchedules(t *testing.T) {
+	on := []Call{{DefaultMethod, switchParams(0, true, nil)}}
+	off := []Call{{DefaultMethod, switchParams(0, false, nil)}}
+	other := []Call{{DefaultMethod, switchParams(1, true, nil)}}
+	// Existing schedules are listed with numbers as float64.
+	listed := func(calls []Call) []Call {
+		var decoded []Call
+		data, _ := json.Marshal(calls)
+		json.Unmarshal(data, &decoded)
+		return decoded
+	}
+	existing := []ScheduleJob{
+		{1, true, "0 0 17 * * *", listed(on)},
+		{2, true, "0 0 19 * * *", listed(off)},
+		{3, true, "0 0 7 * * *", listed(other)},
+		{4, false, "0 0 17 * * *", listed(on)},
+	}
+	schedules := []Schedule{
+		{true, "0 0 17 * * *", on},
+		{true, "0 0 18 * * *", off},
+	}
+	ids := func(jobs []ScheduleJob) []int {
+		ids := []int{}
+		for _, job := range jobs {
+			ids = append(ids, job.ID)
+		}
+		return ids
+	}
+
+	changes := DiffSchedules(schedules, existing, false)
+	if !reflect.DeepEqual(changes.Kept, []int{1}) || len(changes.Updated) != 0 ||
+		!reflect.DeepEqual(ids(changes.Deleted), []int{2, 3, 4}) ||
+		!reflect.DeepEqual(changes.Created, schedules[1:]) {
+		t.Errorf("without update: got %+v", changes)
+	}
+
+	changes = DiffSchedules(schedules, existing, true)
+	want := ScheduleJob{2, true, "0 0 18 * * *", off}
+	if !reflect.DeepEqual(changes.Kept, []int{1}) || !reflect.DeepEqual(changes.Updated, []ScheduleJob{want}) ||
+		!reflect.DeepEqual(ids(changes.Deleted), []int{3, 4}) || len(changes.Created) != 0 {
+		t.Errorf("with update: got %+v", changes)
+	}
+
+	changes = DiffSchedules(schedules, existing[:1], false)
+	if changes.Empty() || len(changes.Created) != 1 {
+		t.Errorf("missing schedule: got %+v", changes)
+	}
+	if changes := DiffSchedules(schedules[:1], existing[:1], false); !changes.Empty() {
+		t.Errorf("existing schedule: got %+v, want no changes", changes)
+	}
+}
+
+func TestValidateTimeSpec(t *testing.T) {
+	for _, spec := range []string{
+		"0 0 17 * * *",
+		"0 30 6 * * MON,TUE,WED,THU,FRI",
+		"15 0 17 24 12 TUE",
+		"0 0 7 * * MON-FRI",
+		"0 0 9 * * sat,sun",
+		"0 */5 * * * *",
+		"*/30 * * * * *",
+		"0 0-30/10 8-17 * * 1-5",
+		"0 0 12 1 JAN-MAR,OCT-DEC *",
+		"0 0 0 1,15 */2 *",
+		"@sunset",
+		"@sunrise+0h30m * * MON",
+	} {
+		if err := ValidateTimeSpec(spec); err != nil {
+			t.Errorf("ValidateTimeSpec(%q): %s", spec, err)
+		}
+	}
+}
+
+func TestValidateTimeSpecInvalid(t *testing.T) {
+	for _, spec := range []string{
+		"",
+		"0 0 17 * *",
+		"0 0 17 * * * *",
+		"60 0 17 * * *",
+		"0 0 24 * * *",
+		"0 0 17 0 * *",
+		"0 0 17 32 * *",
+		"0 0 17 * 13 *",
+		"0 0 17 * * 7",
+		"0 0 17 * * ?",
+		"0 0 17 * * MONDAY",
+		"0 0 17 * * FRI-MON",
+		"0 0 17 * * MON-",
+		"0 */0 * * * *",
+		"0 */x * * * *",
+		"0 5/ * * * *",
+		"0 0 17,,18 * * *",
+		"0 0 17 * * MON,,FRI",
+	} {
+		if err := ValidateTimeSpec(spec); err == nil {
+			t.Errorf("ValidateTimeSpec(%q) did not fail", spec)
+		}
+	}
+}
+
+func TestWeekdayAbbr(t *testing.T) {
+	want := map[time.Weekday]string{
+		time.Sunday: "SUN", time.Monday: "MON", time.Tuesday: "TUE", time.Wednesday: "WED",
+		time.Thursday: "THU", time.Friday: "FRI", time.Saturday: "SAT",
+		-1: "?", 7: "?", 100: "?",
+	}
+	for weekday, abbr := range want {
+		if got := weekdayAbbr(weekday); got != abbr {
+			t.Errorf("weekdayAbbr(%d) = %q, want %q", weekday, got, abbr)
+		}
+	}
+	if err := ValidateTimeSpec("0 0 17 * * " + weekdayAbbr(7)); err == nil {
+		t.Error("timespec with out-of-range weekday accepted")
+	}
+}
+
+func TestGetTimeSpec(t *testing.T) {
+	// 2024-03-10 is a Sunday, so the days of the week are 10..16.
+	for day := 10; day <= 16; day++ {
+		at := time.Date(2024, 3, day, 17, 30, 15, 0, time.UTC)
+		want := fmt.Sprintf("15 30 17 %d 3 %s", day, weekdayAbbrs[day-10])
+		spec := getTimeSpec(at, nil)
+		if spec != want {
+			t.Errorf("getTimeSpec(%s) = %q, want %q", at, spec, want)
+		}
+		if err := ValidateTimeSpec(spec); err != nil {
+			t.Error(err)
+		}
+	}
+	at := time.Date(2024, 3, 10, 6, 0, 0, 0, time.UTC)
+	tests := []struct {
+		repeat []time.Weekday
+		want   string
+	}{
+		{[]time.Weekday{time.Monday}, "0 0 6 * * MON"},
+		{[]time.Weekday{time.Sunday, time.Saturday}, "0 0 6 * * SUN,SAT"},
+		{[]time.Weekday{time.Monday, time.Tuesday, time.Wednesday, time.Thursday, time.Friday}, "0 0 6 * * MON,TUE,WED,THU,FRI"},
+		{[]time.Weekday{0, 1, 2, 3, 4, 5, 6}, "0 0 6 * * *"},
+		{[]time.Weekday{time.Monday, 7}, "0 0 6 * * MON,?"},
+	}
+	for _, tt := range tests {
+		if spec := getTimeSpec(at, tt.repeat); spec != tt.want {
+			t.Errorf("getTimeSpec with repeat %v = %q, want %q", tt.repeat, spec, tt.want)
+		}
+	}
+	if err := ValidateTimeSpec(getTimeSpec(at, []time.Weekday{time.Monday, 7})); err == nil {
+		t.Error("timespec repeating on out-of-range weekday accepted")
+	}
+}
+
+func TestRateLimiter(t *testing.T) {
+	const rate = 50
+	interval := time.Second / rate
+	limiter := newRateLimiter(NewClient(), rate)
+	if limiter == nil {
+		t.Fatal("newRateLimiter() = nil, want limiter")
+	}
+	defer limiter.stop()
+	ctx := context.Background()
+	start := time.Now()
+	if err := limiter.wait(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed >= interval {
+		t.Errorf("first wait took %s, want no delay", elapsed)
+	}
+	for i := 0; i < 3; i++ {
+		if err := limiter.wait(ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if elapsed := time.Since(start); elapsed < 3*interval-interval/2 {
+		t.Errorf("4 waits took %s, want at least %s", elapsed, 3*interval)
+	}
+}
+
+func TestRateLimiterCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	// The first request is not delayed, but it is not sent either once the
+	// context is cancelled.
+	limiter := newRateLimiter(NewClient(), 1000)
+	defer limiter.stop()
+	if err := limiter.wait(ctx); err != context.Canceled {
+		t.Errorf("first wait() with cancelled context = %v, want %v", err, context.Canceled)
+	}
+	// A tick already pending does not hide the cancellation.
+	running := newRateLimiter(NewClient(), 1000)
+	defer running.stop()
+	if err := running.wait(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(5 * time.Millisecond)
+	for i := 0; i < 10; i++ {
+		if err := running.wait(ctx); err != context.Canceled {
+			t.Errorf("wait() with cancelled context and pending tick = %v, want %v", err, context.Canceled)
+		}
+	}
+}
+
+func TestRateLimiterDisabled(t *testing.T) {
+	dryRun := NewClient()
+	dryRun.DryRun = true
+	tests := []struct {
+		name   string
+		client *Client
+		rate   float64
+	}{
+		{"zero rate", NewClient(), 0},
+		{"negative rate", NewClient(), -1},
+		{"dry run", dryRun, 10},
+	}
+	for _, tt := range tests {
+		limiter := newRateLimiter(tt.client, tt.rate)
+		if limiter != nil {
+			t.Errorf("%s: newRateLimiter() = %v, want nil", tt.name, limiter)
+		}
+		// A nil limiter does not limit requests.
+		for i := 0; i < 3; i++ {
+			if err := limiter.wait(context.Background()); err != nil {
+				t.Errorf("%s: wait() = %v, want nil", tt.name, err)
+			}
+		}
+		limiter.stop()
+	}
+}
+
+func TestJitterPlan(t *testing.T) {
+	start := time.Date(2024, 6, 1, 17, 0, 0, 0, time.UTC)
+	plan := []OnOffSchedule{}
+	for id := 0; id < 20; id++ {
+		plan = append(plan, OnOffSchedule{Relay: id, On: start.Add(time.Duration(id) * time.Minute), Off: start.Add(time.Hour)})
+	}
+	original := append([]OnOffSchedule{}, plan...)
+	const jitter = 10 * time.Minute
+	jittered := JitterPlan(plan, jitter, 42)
+	if !reflect.DeepEqual(plan, original) {
+		t.Errorf("JitterPlan modified the plan")
+	}
+	if again := JitterPlan(plan, jitter, 42); !reflect.DeepEqual(again, jittered) {
+		t.Errorf("same seed gave different plans:\n%v\n%v", jittered, again)
+	}
+	if other := JitterPlan(plan, jitter, 43); reflect.DeepEqual(other, jittered) {
+		t.Errorf("different seeds gave the same plan %v", other)
+	}
+	if len(jittered) != len(plan) {
+		t.Fatalf("got %d schedules, want %d", len(jittered), len(plan))
+	}
+	shifted := false
+	for i, p := range jittered {
+		if p.Relay != plan[i].Relay {
+			t.Errorf("schedule %d: relay %d, want %d", i, p.Relay, plan[i].Relay)
+		}
+		for _, d := range []time.Duration{p.On.Sub(plan[i].On), p.Off.Sub(plan[i].Off)} {
+			if d < -jitter || d > jitter || d%time.Second != 0 {
+				t.Errorf("relay %d: shifted by %s, want whole seconds within ±%s", p.Relay, d, jitter)
+			}
+			shifted = shifted || d != 0
+		}
+	}
+	if !shifted {
+		t.Errorf("no time shifted")
+	}
+}
+
+func TestJitterPlanKeepsOrder(t *testing.T) {
+	// A range shorter than the jitter could end before it starts.
+	start := time.Date(2024, 6, 1, 17, 0, 0, 0, time.UTC)
+	plan := []OnOffSchedule{}
+	for id := 0; id < 50; id++ {
+		plan = append(plan, OnOffSchedule{Relay: id, On: start, Off: start.Add(time.Minute)})
+	}
+	for _, p := range JitterPlan(plan, time.Hour, 1) {
+		if !p.Off.After(p.On) {
+			t.Errorf("relay %d: off at %s not after on at %s", p.Relay, p.Off, p.On)
+		}
+	}
+}
+
+func TestJitterPlanDisabled(t *testing.T) {
+	start := time.Date(2024, 6, 1, 17, 0, 0, 0, time.UTC)
+	plan := []OnOffSchedule{{Relay: 0, On: start, Off: start.Add(time.Hour)}}
+	// Jitter below a second cannot shift times in whole seconds.
+	for _, jitter := range []time.Duration{0, -time.Minute, 500 * time.Millisecond} {
+		if got := JitterPlan(plan, jitter, 1); !reflect.DeepEqual(got, plan) {
+			t.Errorf("JitterPlan(%s) = %v, want %v", jitter, got, plan)
+		}
+	}
+}
@@ -0,0 +1,138 @@
+package shelly
+
+import (
+	"errors"
+	"math"
+	"strings"
+	"time"
+)
+
+// Solar events which can be used in time ranges instead of clock times, see
+// ParseTime.
+const (
+	Sunrise = "sunrise"
+	Sunset  = "sunset"
+)
+
+// Coordinates are the geographic latitude and longitude in degrees, north
+// and east being positive.
+type Coordinates struct {
+	Lat float64
+	Lon float64
+}
+
+// julianDay returns the Julian day of time t.
+func julianDay(t time.Time) float64 {
+	return float64(t.Unix())/86400 + 2440587.5
+}
+
+// fromJulianDay returns the time of Julian day j in location loc.
+func fromJulianDay(j float64, loc *time.Location) time.Time {
+	sec := (j - 2440587.5) * 86400
+	return time.Unix(int64(math.Round(sec)), 0).In(loc)
+}
+
+func sinDeg(x float64) float64 { return math.Sin(x * math.Pi / 180) }
+func cosDeg(x float64) float64 { return math.Cos(x * math.Pi / 180) }
+
+// SunTimes returns the times of sunrise and sunset at the date of date in the
+// location of date, computed with the sunrise equation. The accuracy is about
+// a minute, which is enough for switching lights. Returns an error if the sun
+// does not rise or set at the date, e.g. during polar night.
+func SunTimes(date time.Time, c Coordinates) (time.Time, time.Time, error) {
+	midnight := time.Date(date.Year(), date.Month(), date.Day(), 0, 0, 0, 0, time.UTC)
+	n := math.Ceil(julianDay(midnight) - 2451545.0 + 0.0008)
+	meanNoon := n - c.Lon/360
+	anomaly := math.Mod(357.5291+0.98560028*meanNoon, 360)
+	center := 1.9148*sinDeg(anomaly) + 0.02*sinDeg(2*anomaly) + 0.0003*sinDeg(3*anomaly)
+	longitude := math.Mod(anomaly+center+180+102.9372, 360)
+	transit := 2451545.0 + meanNoon + 0.0053*sinDeg(anomaly) - 0.0069*sinDeg(2*longitude)
+	sinDecl := sinDeg(longitude) * sinDeg(23.4397)
+	cosDecl := math.Cos(math.Asin(sinDecl))
+	cosHour := (sinDeg(-0.833) - sinDeg(c.Lat)*sinDecl) / (cosDeg(c.Lat) * cosDecl)
+	day := date.Format("2006-01-02")
+	if cosHour > 1 {
+		return time.Time{}, time.Time{}, errors.New("sun does not rise at " + day)
+	}
+	if cosHour < -1 {
+		return time.Time{}, time.Time{}, errors.New("sun does not set at " + day)
+	}
+	hourAngle := math.Acos(cosHour) * 180 / math.Pi
+	sunrise := fromJulianDay(transit-hourAngle/360, date.Location())
+	sunset := fromJulianDay(transit+hourAngle/360, date.Location())
+	return sunrise, sunset, nil
+}
+
+// parseSolar parses solar event with optional offset, e.g. sunset-30m, and
+// returns the event and the offset. Returns empty event if s is not a solar
+// event.
+func parseSolar(s string) (string, time.Duration, error) {
+	for _, event := range []string{Sunrise, Sunset} {
+		if !strings.HasPrefix(s, event) {
+			continue
+		}
+		rest := s[len(event):]
+		if rest == "" {
+			return event, 0, nil
+		}
+		if !strings.HasPrefix(rest, "+") && !strings.HasPrefix(rest, "-") {
+			break
+		}
+		d, err := time.ParseDuration(rest)
+		if err != nil {
+			return "", 0, errors.New("invalid offset of " + event + ": " + rest)
+		}
+		return event, d, nil
+	}
+	return "", 0, nil
+}
+
+// solarTime returns the time of the event at the date of date.
+func solarTime(event string, date time.Time, c Coordinates) (time.Time, error) {
+	sunrise, sunset, err := SunTimes(date, c)
+	if event == Sunrise {
+		return sunrise, err
+	}
+	return sunset, err
+}
+
+// ResolveSolar returns offset with the solar events resolved to offsets from
+// the beginning of date, using the times of sunrise and sunset at the given
+// coordinates. If the end of range would not be after the start, the end event
+// is resolved at the following day, e.g. sunset..sunrise ends at the sunrise
+// of the next day. Offsets without solar events are returned as such.
+func ResolveSolar(offset TimeOffset, date time.Time, c *Coordinates) (TimeOffset, error) {
+	if offset.BeginEvent == "" && offset.EndEvent == "" {
+		return offset, nil
+	}
+	if c == nil {
+		return offset, errors.New("sunrise and sunset require the coordinates of the device")
+	}
+	day := truncateToDay(date)
+	resolved := TimeOffset{Begin: offset.Begin, End: offset.End}
+	if offset.BeginEvent != "" {
+		t, err := solarTime(offset.BeginEvent, day, *c)
+		if err != nil {
+			return offset, err
+		}
+		resolved.Begin += clockOffset(day, t)
+	}
+	if offset.EndEvent != "" {
+		t, err := solarTime(offset.EndEvent, day, *c)
+		if err != nil {
+			return offset, err
+		}
+		resolved.End += clockOffset(day, t)
+		if resolved.End <= resolved.Begin {
+			next := day.AddDate(0, 0, 1)
+			t, err = solarTime(offset.EndEvent, next, *c)
+			if err != nil {
+				return offset, err
+			}
+			resolved.End = offset.End + clockOffset(day, t)
+		}
+	}
+	debugf("Resolved time range with sunrise or sunset to %s ... %s",
+		atClock(day, resolved.Begin).Format("2006-01-02 15:04:05"), atClock(day, resolved.End).Format("2006-01-02 15:04:05"))
+	return resolved, nil
+}
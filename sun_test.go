@@ -0,0 +1,188 @@
+package shelly
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+var (
+	helsinki = Coordinates{60.1699, 24.9384}
+	sydney   = Coordinates{-33.8688, 151.2093}
+	tromso   = Coordinates{69.6492, 18.9553}
+)
+
+// loadLocation returns the named location, failing the test if it is not
+// found.
+func loadLocation(t *testing.T, name string) *time.Location {
+	t.Helper()
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return loc
+}
+
+// near returns true if t is within the accuracy of SunTimes from the clock
+// time want, given as HH:MM.
+func near(t time.Time, want string) bool {
+	clock, err := time.Parse("15:04", want)
+	if err != nil {
+		panic(err)
+	}
+	expected := time.Date(t.Year(), t.Month(), t.Day(), clock.Hour(), clock.Minute(), 0, 0, t.Location())
+	d := t.Sub(expected)
+	return d > -2*time.Minute && d < 2*time.Minute
+}
+
+func TestSunTimes(t *testing.T) {
+	tests := []struct {
+		name            string
+		coords          Coordinates
+		tz              string
+		date            string
+		sunrise, sunset string
+	}{
+		{"Helsinki at midsummer", helsinki, "Europe/Helsinki", "2024-06-21", "03:54", "22:50"},
+		{"Helsinki at midwinter", helsinki, "Europe/Helsinki", "2024-12-21", "09:24", "15:13"},
+		{"Sydney in winter", sydney, "Australia/Sydney", "2024-06-21", "07:00", "16:54"},
+		{"Sydney in summer", sydney, "Australia/Sydney", "2024-12-21", "05:41", "20:05"},
+	}
+	for _, tt := range tests {
+		loc := loadLocation(t, tt.tz)
+		date, _ := time.ParseInLocation("2006-01-02", tt.date, loc)
+		sunrise, sunset, err := SunTimes(date, tt.coords)
+		if err != nil {
+			t.Errorf("%s: %s", tt.name, err)
+			continue
+		}
+		if !near(sunrise, tt.sunrise) || sunrise.Format("2006-01-02") != tt.date {
+			t.Errorf("%s: sunrise at %s, want %s %s", tt.name, sunrise, tt.date, tt.sunrise)
+		}
+		if !near(sunset, tt.sunset) || sunset.Format("2006-01-02") != tt.date {
+			t.Errorf("%s: sunset at %s, want %s %s", tt.name, sunset, tt.date, tt.sunset)
+		}
+	}
+}
+
+func TestSunTimesPolar(t *testing.T) {
+	loc := loadLocation(t, "Europe/Oslo")
+	tests := []struct {
+		date string
+		err  string
+	}{
+		{"2024-06-21", "sun does not set at 2024-06-21"},
+		{"2024-12-21", "sun does not rise at 2024-12-21"},
+	}
+	for _, tt := range tests {
+		date, _ := time.ParseInLocation("2006-01-02", tt.date, loc)
+		if _, _, err := SunTimes(date, tromso); err == nil || err.Error() != tt.err {
+			t.Errorf("SunTimes(%s) in Tromsø: got error %v, want %s", tt.date, err, tt.err)
+		}
+	}
+}
+
+func TestParseSolar(t *testing.T) {
+	tests := []struct {
+		s      string
+		event  string
+		offset time.Duration
+	}{
+		{"sunrise", Sunrise, 0},
+		{"sunset", Sunset, 0},
+		{"sunset-30m", Sunset, -30 * time.Minute},
+		{"sunrise+1h15m", Sunrise, 75 * time.Minute},
+		{"17:30", "", 0},
+		{"sunsets", "", 0},
+	}
+	for _, tt := range tests {
+		event, offset, err := parseSolar(tt.s)
+		if err != nil || event != tt.event || offset != tt.offset {
+			t.Errorf("parseSolar(%q) = %q, %s, %v, want %q, %s", tt.s, event, offset, err, tt.event, tt.offset)
+		}
+	}
+	for _, s := range []string{"sunset+", "sunset-x", "sunrise+1"} {
+		if event, _, err := parseSolar(s); err == nil {
+			t.Errorf("parseSolar(%q) = %q, want error", s, event)
+		}
+	}
+}
+
+func TestResolveSolar(t *testing.T) {
+	loc := loadLocation(t, "Europe/Helsinki")
+	oldLocation := Location
+	Location = loc
+	defer func() { Location = oldLocation }()
+	date := time.Date(2024, 6, 21, 0, 0, 0, 0, loc)
+	tests := []struct {
+		timerange  string
+		begin, end string
+	}{
+		{"sunset..23", "2024-06-21 22:50", "2024-06-21 23:00"},
+		{"sunrise+30m..12", "2024-06-21 04:24", "2024-06-21 12:00"},
+		{"12..sunset-1h", "2024-06-21 12:00", "2024-06-21 21:50"},
+		// The range ending at sunrise before its start rolls over to the
+		// sunrise of the following day.
+		{"sunset..sunrise", "2024-06-21 22:50", "2024-06-22 03:54"},
+		{"sunset-30m..sunrise+15m", "2024-06-21 22:20", "2024-06-22 04:09"},
+		{"22..sunrise", "2024-06-21 22:00", "2024-06-22 03:54"},
+	}
+	for _, tt := range tests {
+		offset, err := ParseTime(tt.timerange)
+		if err != nil {
+			t.Fatalf("ParseTime(%s): %s", tt.timerange, err)
+		}
+		resolved, err := ResolveSolar(offset, date, &helsinki)
+		if err != nil {
+			t.Errorf("%s: %s", tt.timerange, err)
+			continue
+		}
+		if resolved.BeginEvent != "" || resolved.EndEvent != "" {
+			t.Errorf("%s: events not resolved: %+v", tt.timerange, resolved)
+		}
+		begin, end := atClock(date, resolved.Begin), atClock(date, resolved.End)
+		if !near(begin, tt.begin[11:]) || begin.Format("2006-01-02") != tt.begin[:10] {
+			t.Errorf("%s: begins at %s, want %s", tt.timerange, begin, tt.begin)
+		}
+		if !near(end, tt.end[11:]) || end.Format("2006-01-02") != tt.end[:10] {
+			t.Errorf("%s: ends at %s, want %s", tt.timerange, end, tt.end)
+		}
+		if err := ValidateRanges([]TimeOffset{resolved}); err != nil {
+			t.Errorf("%s: %s", tt.timerange, err)
+		}
+	}
+}
+
+func TestResolveSolarErrors(t *testing.T) {
+	loc := loadLocation(t, "Europe/Oslo")
+	tests := []struct {
+		name      string
+		timerange string
+		date      time.Time
+		coords    *Coordinates
+		err       string
+	}{
+		{"no coordinates", "sunset..23", time.Date(2024, 6, 21, 0, 0, 0, 0, loc), nil, "require the coordinates"},
+		{"midnight sun", "sunset..23", time.Date(2024, 6, 21, 0, 0, 0, 0, loc), &tromso, "sun does not set"},
+		{"polar night", "sunrise..12", time.Date(2024, 12, 21, 0, 0, 0, 0, loc), &tromso, "sun does not rise"},
+		// The sun sets at the date, but does not rise the following day.
+		{"polar night begins", "sunset..sunrise", time.Date(2024, 11, 27, 0, 0, 0, 0, loc), &tromso, "sun does not rise at 2024-11-28"},
+	}
+	for _, tt := range tests {
+		offset, err := ParseTime(tt.timerange)
+		if err != nil {
+			t.Fatalf("ParseTime(%s): %s", tt.timerange, err)
+		}
+		if _, err := ResolveSolar(offset, tt.date, tt.coords); err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("%s: got error %v, want error containing %q", tt.name, err, tt.err)
+		}
+	}
+}
+
+func TestResolveSolarWithoutEvents(t *testing.T) {
+	offset := TimeOffset{Begin: 17 * time.Hour, End: 18 * time.Hour}
+	resolved, err := ResolveSolar(offset, time.Now(), nil)
+	if err != nil || resolved != offset {
+		t.Errorf("ResolveSolar(%s) = %s, %v, want %s", offset, resolved, err, offset)
+	}
+}
@@ -0,0 +1,376 @@
+package shelly
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// wsGUID is the fixed GUID of WebSocket handshake, see RFC 6455.
+const wsGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+const (
+	wsOpContinuation = 0x0
+	wsOpText         = 0x1
+	wsOpClose        = 0x8
+	wsOpPing         = 0x9
+	wsOpPong         = 0xa
+)
+
+// wsConn is a WebSocket connection to the RPC endpoint of the device. Calls
+// are sent as JSON-RPC frames, one at a time.
+type wsConn struct {
+	mu     sync.Mutex
+	conn   net.Conn
+	reader *bufio.Reader
+	nextID int
+}
+
+// wsRequest is a JSON-RPC request frame.
+type wsRequest struct {
+	ID     int         `json:"id"`
+	Src    string      `json:"src"`
+	Method string      `json:"method"`
+	Params interface{} `json:"params,omitempty"`
+	Auth   *wsAuth     `json:"auth,omitempty"`
+}
+
+// wsResponse is a JSON-RPC response frame. Notifications sent by the device
+// have no id and are skipped.
+type wsResponse struct {
+	ID     *int            `json:"id"`
+	Result json.RawMessage `json:"result"`
+	Error  *RPCError       `json:"error"`
+}
+
+// wsAuth is the authentication object answering to the digest challenge
+// sent by the device in error 401.
+type wsAuth struct {
+	Realm     string `json:"realm"`
+	Username  string `json:"username"`
+	Nonce     int64  `json:"nonce"`
+	CNonce    string `json:"cnonce"`
+	Response  string `json:"response"`
+	Algorithm string `json:"algorithm"`
+}
+
+// wsURL returns the WebSocket URL of the RPC base URI, e.g.
+// http://192.168.1.50/rpc/ gives ws://192.168.1.50/rpc.
+func wsURL(uri string) (*url.URL, error) {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return nil, err
+	}
+	switch u.Scheme {
+	case "http":
+		u.Scheme = "ws"
+	case "https":
+		u.Scheme = "wss"
+	default:
+		return nil, errors.New("unsupported scheme: " + u.Scheme)
+	}
+	u.Path = strings.TrimRight(u.Path, "/")
+	return u, nil
+}
+
+// DialWebSocket opens a WebSocket connection to the device, which is used for
+// all subsequent calls instead of HTTP requests. If the connection breaks, the
+// calls fall back to HTTP. The connection is closed with Close.
+func (c *Client) DialWebSocket(ctx context.Context, uri string) error {
+	u, err := wsURL(uri)
+	if err != nil {
+		return err
+	}
+	host := u.Host
+	if u.Port() == "" {
+		if u.Scheme == "wss" {
+			host = net.JoinHostPort(u.Hostname(), "443")
+		} else {
+			host = net.JoinHostPort(u.Hostname(), "80")
+		}
+	}
+	dialer := &net.Dialer{Timeout: c.HTTPClient.Timeout}
+	conn, err := dialer.DialContext(ctx, "tcp", host)
+	if err != nil {
+		return &ConnectionError{u.Host, err}
+	}
+	if u.Scheme == "wss" {
+		tlsConn := tls.Client(conn, &tls.Config{ServerName: u.Hostname()})
+		conn = tlsConn
+	}
+	conn.SetDeadline(time.Now().Add(c.HTTPClient.Timeout))
+
+	keyBytes := make([]byte, 16)
+	if _, err := rand.Read(keyBytes); err != nil {
+		conn.Close()
+		return err
+	}
+	key := base64.StdEncoding.EncodeToString(keyBytes)
+	fmt.Fprintf(conn, "GET %s HTTP/1.1\r\nHost: %s\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n"+
+		"Sec-WebSocket-Key: %s\r\nSec-WebSocket-Version: 13\r\n\r\n", u.RequestURI(), u.Host, key)
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, nil)
+	if err != nil {
+		conn.Close()
+		return &ConnectionError{u.Host, err}
+	}
+	resp.Body.Close()
+	accept := sha1.Sum([]byte(key + wsGUID))
+	if resp.StatusCode != http.StatusSwitchingProtocols ||
+		resp.Header.Get("Sec-WebSocket-Accept") != base64.StdEncoding.EncodeToString(accept[:]) {
+		conn.Close()
+		return fmt.Errorf("WebSocket handshake with %s failed with status code %d", u.Host, resp.StatusCode)
+	}
+	conn.SetDeadline(time.Time{})
+	debugf("Opened WebSocket connection to %s", u)
+	c.wsMu.Lock()
+	old := c.ws
+	c.ws = &wsConn{conn: conn, reader: reader, nextID: 1}
+	c.wsMu.Unlock()
+	if old != nil {
+		old.close()
+	}
+	return nil
+}
+
+// webSocket returns the open WebSocket connection, or nil if there is none.
+func (c *Client) webSocket() *wsConn {
+	c.wsMu.Lock()
+	defer c.wsMu.Unlock()
+	return c.ws
+}
+
+// dropWebSocket forgets the broken connection ws, unless it has already been
+// replaced, so that the following calls fall back to HTTP.
+func (c *Client) dropWebSocket(ws *wsConn) {
+	c.wsMu.Lock()
+	defer c.wsMu.Unlock()
+	if c.ws == ws {
+		c.ws = nil
+	}
+}
+
+// Close closes the WebSocket connection, if any.
+func (c *Client) Close() error {
+	c.wsMu.Lock()
+	ws := c.ws
+	c.ws = nil
+	c.wsMu.Unlock()
+	if ws == nil {
+		return nil
+	}
+	return ws.close()
+}
+
+// close sends a close frame and closes the connection, waiting for the call
+// in progress, if any.
+func (ws *wsConn) close() error {
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+	ws.writeFrame(wsOpClose, nil)
+	return ws.conn.Close()
+}
+
+// writeFrame writes a masked frame, as required from clients.
+func (ws *wsConn) writeFrame(opcode byte, payload []byte) error {
+	header := []byte{0x80 | opcode}
+	switch {
+	case len(payload) < 126:
+		header = append(header, 0x80|byte(len(payload)))
+	case len(payload) <= 0xffff:
+		header = append(header, 0x80|126, 0, 0)
+		binary.BigEndian.PutUint16(header[2:], uint16(len(payload)))
+	default:
+		header = append(header, 0x80|127, 0, 0, 0, 0, 0, 0, 0, 0)
+		binary.BigEndian.PutUint64(header[2:], uint64(len(payload)))
+	}
+	mask := make([]byte, 4)
+	if _, err := rand.Read(mask); err != nil {
+		return err
+	}
+	header = append(header, mask...)
+	masked := make([]byte, len(payload))
+	for i, b := range payload {
+		masked[i] = b ^ mask[i%4]
+	}
+	_, err := ws.conn.Write(append(header, masked...))
+	return err
+}
+
+// readMessage reads a complete text message, answering to pings on the way.
+func (ws *wsConn) readMessage() ([]byte, error) {
+	message := []byte{}
+	for {
+		header := make([]byte, 2)
+		if _, err := io.ReadFull(ws.reader, header); err != nil {
+			return nil, err
+		}
+		fin, opcode := header[0]&0x80 != 0, header[0]&0x0f
+		length := uint64(header[1] & 0x7f)
+		switch length {
+		case 126:
+			ext := make([]byte, 2)
+			if _, err := io.ReadFull(ws.reader, ext); err != nil {
+				return nil, err
+			}
+			length = uint64(binary.BigEndian.Uint16(ext))
+		case 127:
+			ext := make([]byte, 8)
+			if _, err := io.ReadFull(ws.reader, ext); err != nil {
+				return nil, err
+			}
+			length = binary.BigEndian.Uint64(ext)
+		}
+		var mask []byte
+		if header[1]&0x80 != 0 {
+			mask = make([]byte, 4)
+			if _, err := io.ReadFull(ws.reader, mask); err != nil {
+				return nil, err
+			}
+		}
+		if length > 1<<24 {
+			return nil, errors.New("WebSocket frame too large")
+		}
+		payload := make([]byte, length)
+		if _, err := io.ReadFull(ws.reader, payload); err != nil {
+			return nil, err
+		}
+		for i := range mask {
+			for j := i; j < len(payload); j += 4 {
+				payload[j] ^= mask[i]
+			}
+		}
+		switch opcode {
+		case wsOpPing:
+			if err := ws.writeFrame(wsOpPong, payload); err != nil {
+				return nil, err
+			}
+			continue
+		case wsOpPong:
+			continue
+		case wsOpClose:
+			return nil, errors.New("WebSocket connection closed by device")
+		case wsOpText, wsOpContinuation:
+			message = append(message, payload...)
+		}
+		if fin {
+			return message, nil
+		}
+	}
+}
+
+// wsDigestAuth computes the authentication object answering to the challenge
+// in the message of error 401, e.g.
+// {"auth_type": "digest", "nonce": 1625038762, "realm": "shellyplus1-abc", "algorithm": "SHA-256"}
+func wsDigestAuth(challenge string, creds Credentials) (*wsAuth, error) {
+	var params struct {
+		Nonce     int64  `json:"nonce"`
+		Realm     string `json:"realm"`
+		Algorithm string `json:"algorithm"`
+	}
+	if err := json.Unmarshal([]byte(challenge), &params); err != nil || params.Realm == "" {
+		return nil, errors.New("malformed authentication challenge: " + challenge)
+	}
+	cnonceBytes := make([]byte, 8)
+	if _, err := rand.Read(cnonceBytes); err != nil {
+		return nil, err
+	}
+	cnonce := hex.EncodeToString(cnonceBytes)
+	ha1, err := digestHash(params.Algorithm, creds.User+":"+params.Realm+":"+creds.Password)
+	if err != nil {
+		return nil, err
+	}
+	ha2, err := digestHash(params.Algorithm, "dummy_method:dummy_uri")
+	if err != nil {
+		return nil, err
+	}
+	response, err := digestHash(params.Algorithm, fmt.Sprintf("%s:%d:1:%s:auth:%s", ha1, params.Nonce, cnonce, ha2))
+	if err != nil {
+		return nil, err
+	}
+	return &wsAuth{params.Realm, creds.User, params.Nonce, cnonce, response, params.Algorithm}, nil
+}
+
+// call sends the request and waits for the response with the same id.
+func (ws *wsConn) call(ctx context.Context, client *Client, method string, params interface{}, auth *wsAuth) (wsResponse, error) {
+	req := wsRequest{ws.nextID, "shelly-go", method, params, auth}
+	ws.nextID++
+	payload, err := json.Marshal(req)
+	if err != nil {
+		return wsResponse{}, err
+	}
+	deadline := time.Now().Add(client.HTTPClient.Timeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	ws.conn.SetDeadline(deadline)
+	debugf("Sending WebSocket request: %s", payload)
+	if err := ws.writeFrame(wsOpText, payload); err != nil {
+		return wsResponse{}, err
+	}
+	for {
+		message, err := ws.readMessage()
+		if err != nil {
+			return wsResponse{}, err
+		}
+		var resp wsResponse
+		if err := json.Unmarshal(message, &resp); err != nil {
+			return wsResponse{}, fmt.Errorf("%s: unexpected response: %s", method, message)
+		}
+		if resp.ID == nil || *resp.ID != req.ID {
+			debugf("Skipping WebSocket message: %s", message)
+			continue
+		}
+		debugf("Response from %s: %s", method, message)
+		return resp, nil
+	}
+}
+
+// wsCall calls RPC method over the WebSocket connection ws of the client and
+// returns the result. Calls are sent one at a time. Errors of the connection
+// are returned as *ConnectionError, in which case the connection is closed.
+func wsCall(ctx context.Context, client *Client, ws *wsConn, method string, params interface{}) (json.RawMessage, error) {
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	resp, err := ws.call(ctx, client, method, params, nil)
+	if err == nil && resp.Error != nil && resp.Error.Code == http.StatusUnauthorized {
+		if client.Credentials.Password == "" {
+			return nil, errors.New("device requires authentication, but password is not set")
+		}
+		auth, authErr := wsDigestAuth(resp.Error.Message, client.Credentials)
+		if authErr != nil {
+			return nil, authErr
+		}
+		resp, err = ws.call(ctx, client, method, params, auth)
+		if err == nil && resp.Error != nil && resp.Error.Code == http.StatusUnauthorized {
+			return nil, errors.New("authentication failed, check user name and password")
+		}
+	}
+	if err != nil {
+		client.dropWebSocket(ws)
+		ws.conn.Close()
+		return nil, &ConnectionError{ws.conn.RemoteAddr().String(), err}
+	}
+	if resp.Error != nil {
+		return nil, fmt.Errorf("%s: %w", method, resp.Error)
+	}
+	return resp.Result, nil
+}
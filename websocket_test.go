@@ -0,0 +1,260 @@
+package shelly
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// wsAccept returns the correct Sec-WebSocket-Accept for key.
+func wsAccept(key string) string {
+	sum := sha1.Sum([]byte(key + wsGUID))
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// wsServerFrame returns an unmasked frame, as sent by servers.
+func wsServerFrame(opcode byte, fin bool, payload []byte) []byte {
+	frame := []byte{opcode}
+	if fin {
+		frame[0] |= 0x80
+	}
+	switch {
+	case len(payload) < 126:
+		frame = append(frame, byte(len(payload)))
+	case len(payload) <= 0xffff:
+		frame = append(frame, 126, 0, 0)
+		binary.BigEndian.PutUint16(frame[2:], uint16(len(payload)))
+	default:
+		frame = append(frame, 127, 0, 0, 0, 0, 0, 0, 0, 0)
+		binary.BigEndian.PutUint64(frame[2:], uint64(len(payload)))
+	}
+	return append(frame, payload...)
+}
+
+// readClientFrame reads a frame sent by the client, which must be masked.
+func readClientFrame(r *bufio.Reader) (byte, []byte, error) {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return 0, nil, err
+	}
+	if header[1]&0x80 == 0 {
+		return 0, nil, errors.New("frame from client not masked")
+	}
+	length := int(header[1] & 0x7f)
+	switch length {
+	case 126:
+		ext := make([]byte, 2)
+		if _, err := io.ReadFull(r, ext); err != nil {
+			return 0, nil, err
+		}
+		length = int(binary.BigEndian.Uint16(ext))
+	case 127:
+		ext := make([]byte, 8)
+		if _, err := io.ReadFull(r, ext); err != nil {
+			return 0, nil, err
+		}
+		length = int(binary.BigEndian.Uint64(ext))
+	}
+	mask := make([]byte, 4)
+	if _, err := io.ReadFull(r, mask); err != nil {
+		return 0, nil, err
+	}
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return 0, nil, err
+	}
+	for i := range payload {
+		payload[i] ^= mask[i%4]
+	}
+	return header[0] & 0x0f, payload, nil
+}
+
+// readClientRequest reads a JSON-RPC request sent by the client.
+func readClientRequest(r *bufio.Reader) (wsRequest, error) {
+	var req wsRequest
+	opcode, payload, err := readClientFrame(r)
+	if err != nil {
+		return req, err
+	}
+	if opcode != wsOpText {
+		return req, fmt.Errorf("got opcode %d, want text frame", opcode)
+	}
+	err = json.Unmarshal(payload, &req)
+	return req, err
+}
+
+// newWSDevice starts a fake device upgrading requests of /rpc to WebSocket
+// connections, answering the handshake with accept and then serving the
+// connection with serve. Plain HTTP calls get a switch status, so that
+// falling back to HTTP can be checked.
+func newWSDevice(t *testing.T, accept func(key string) string, serve func(conn net.Conn, r *bufio.Reader)) (*testDevice, *Client, string) {
+	t.Helper()
+	return newTestDevice(t, func(w http.ResponseWriter, r *http.Request, method string, body []byte) {
+		if r.URL.Path != "/rpc" {
+			io.WriteString(w, `{"id": 0, "output": true}`)
+			return
+		}
+		if !strings.EqualFold(r.Header.Get("Upgrade"), "websocket") || r.Header.Get("Sec-WebSocket-Version") != "13" {
+			http.Error(w, "not a WebSocket handshake", http.StatusBadRequest)
+			return
+		}
+		conn, rw, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer conn.Close()
+		fmt.Fprintf(conn, "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n"+
+			"Sec-WebSocket-Accept: %s\r\n\r\n", accept(r.Header.Get("Sec-WebSocket-Key")))
+		serve(conn, rw.Reader)
+	})
+}
+
+func TestWebSocketCall(t *testing.T) {
+	closed := make(chan bool, 1)
+	_, client, uri := newWSDevice(t, wsAccept, func(conn net.Conn, r *bufio.Reader) {
+		req, err := readClientRequest(r)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		if req.Method != "Switch.GetStatus" || req.Src == "" {
+			t.Errorf("got request %+v", req)
+		}
+		// A notification and a ping before the response, which is split
+		// into a text frame and a continuation frame.
+		response := fmt.Sprintf(`{"id": %d, "src": "shellypro4pm", "result": {"id": 0, "output": true}}`, req.ID)
+		conn.Write(wsServerFrame(wsOpText, true, []byte(`{"src": "shellypro4pm", "method": "NotifyStatus"}`)))
+		conn.Write(wsServerFrame(wsOpPing, true, []byte("ping")))
+		conn.Write(wsServerFrame(wsOpText, false, []byte(response[:20])))
+		conn.Write(wsServerFrame(wsOpContinuation, true, []byte(response[20:])))
+		opcode, payload, err := readClientFrame(r)
+		if err != nil || opcode != wsOpPong || string(payload) != "ping" {
+			t.Errorf("got opcode %d, payload %q, error %v, want pong", opcode, payload, err)
+		}
+		opcode, _, err = readClientFrame(r)
+		closed <- err == nil && opcode == wsOpClose
+	})
+	if err := client.DialWebSocket(context.Background(), uri); err != nil {
+		t.Fatal(err)
+	}
+	status, err := SwitchGetStatus(context.Background(), client, uri, 0)
+	if err != nil || !status.Output {
+		t.Errorf("SwitchGetStatus over WebSocket: got %+v, %v", status, err)
+	}
+	if err := client.Close(); err != nil {
+		t.Error(err)
+	}
+	if !<-closed {
+		t.Error("close frame not sent by Close")
+	}
+}
+
+func TestWebSocketHandshake(t *testing.T) {
+	tests := map[string]func(key string) string{
+		"wrong accept key": func(key string) string { return wsAccept(key + "x") },
+		"missing accept":   func(key string) string { return "" },
+	}
+	for desc, accept := range tests {
+		_, client, uri := newWSDevice(t, accept, func(conn net.Conn, r *bufio.Reader) {})
+		err := client.DialWebSocket(context.Background(), uri)
+		if err == nil || !strings.Contains(err.Error(), "handshake") {
+			t.Errorf("%s: got error %v, want failed handshake", desc, err)
+		}
+		if client.webSocket() != nil {
+			t.Errorf("%s: connection left open", desc)
+		}
+	}
+}
+
+func TestWebSocketNotSupported(t *testing.T) {
+	_, client, uri := newTestDevice(t, func(w http.ResponseWriter, r *http.Request, method string, body []byte) {
+		http.NotFound(w, r)
+	})
+	err := client.DialWebSocket(context.Background(), uri)
+	if err == nil || !strings.Contains(err.Error(), "status code 404") {
+		t.Errorf("got error %v, want failed handshake with status code 404", err)
+	}
+}
+
+func TestWebSocketFallback(t *testing.T) {
+	tests := map[string][]byte{
+		"oversized frame": {0x81, 127, 0, 0, 0, 0, 0x10, 0, 0, 0},
+		"close frame":     wsServerFrame(wsOpClose, true, []byte{0x03, 0xe8}),
+		"closed":          nil,
+		"truncated frame": wsServerFrame(wsOpText, true, []byte(`{"id": 1, "result": {}}`))[:10],
+		"not JSON":        wsServerFrame(wsOpText, true, []byte(`<html>`)),
+	}
+	for desc, frame := range tests {
+		device, client, uri := newWSDevice(t, wsAccept, func(conn net.Conn, r *bufio.Reader) {
+			if _, err := readClientRequest(r); err != nil {
+				t.Error(err)
+			}
+			conn.Write(frame)
+		})
+		if err := client.DialWebSocket(context.Background(), uri); err != nil {
+			t.Fatal(err)
+		}
+		// Failing WebSocket calls fall back to HTTP.
+		status, err := SwitchGetStatus(context.Background(), client, uri, 0)
+		if err != nil || !status.Output {
+			t.Errorf("%s: got %+v, %v, want status over HTTP", desc, status, err)
+		}
+		if client.webSocket() != nil {
+			t.Errorf("%s: broken connection left open", desc)
+		}
+		if methods := device.called(); len(methods) != 2 || methods[1] != "Switch.GetStatus" {
+			t.Errorf("%s: got requests %v, want fallback to HTTP", desc, methods)
+		}
+	}
+}
+
+func TestWebSocketConcurrentCalls(t *testing.T) {
+	// The connection breaks after a few calls, while other calls are in
+	// progress, e.g. scrapes of the metrics handler.
+	_, client, uri := newWSDevice(t, wsAccept, func(conn net.Conn, r *bufio.Reader) {
+		for i := 0; i < 5; i++ {
+			req, err := readClientRequest(r)
+			if err != nil {
+				return
+			}
+			conn.Write(wsServerFrame(wsOpText, true, []byte(fmt.Sprintf(`{"id": %d, "result": {"id": 0, "output": true}}`, req.ID))))
+		}
+	})
+	if err := client.DialWebSocket(context.Background(), uri); err != nil {
+		t.Fatal(err)
+	}
+	var wg sync.WaitGroup
+	errs := make(chan error, 40)
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 5; j++ {
+				if _, err := SwitchGetStatus(context.Background(), client, uri, 0); err != nil {
+					errs <- err
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Errorf("SwitchGetStatus: %s", err)
+	}
+	if client.webSocket() != nil {
+		t.Error("broken connection left open")
+	}
+	client.Close()
+}